@@ -1,11 +1,13 @@
 package djv_ads
 
 import (
-	"sync"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
 	"time"
 
 	"github.com/golang/glog"
-	"golang.org/x/time/rate"
 )
 
 const TimeFormat = "2006-01-02 3:04pm"
@@ -15,17 +17,32 @@ var Pacific *time.Location
 type Option func(*AdsController) error
 
 type AdsController struct {
-	campaignWhitelist []string
-	readOnly          bool
-	undercutAmount    float64
+	campaignWhitelist  []string
+	excludedCampaigns  map[string]bool
+	readOnly           bool
+	strategy           BidStrategy
+	campaignStrategies map[string]BidStrategy
+	campaignLimits     map[string]*BidLimit
+	countryLimits      map[string]*BidLimit
+	spotLimits         map[string]*BidLimit
+	limitAction        LimitAction
+	guardrails         *Guardrails
+	campaignCountries  map[string][]string
+	client             TJClient
+	runTimeout         time.Duration
 }
 
 type BidUpdate struct {
+	RunId       string
 	CampaignId  string
 	BidId       string
+	SpotId      string
+	CountryCode string
 	PreviousBid float64
 	NewBid      float64
 	Timestamp   string
+	Skipped     bool
+	Reason      string
 }
 
 func ReadOnly(readOnly bool) Option {
@@ -37,7 +54,60 @@ func ReadOnly(readOnly bool) Option {
 
 func UndercutBy(amount float64) Option {
 	return func(controller *AdsController) error {
-		controller.undercutAmount = amount
+		controller.strategy = NewUndercutStrategy(amount)
+		return nil
+	}
+}
+
+func WithStrategy(strategy BidStrategy) Option {
+	return func(controller *AdsController) error {
+		if strategy == nil {
+			return errors.New("Bid strategy must not be nil")
+		}
+
+		controller.strategy = strategy
+		return nil
+	}
+}
+
+// UndercutCountryBy overrides the undercut amount for bids in a country. It
+// only applies to the default undercut strategy and must follow UndercutBy.
+func UndercutCountryBy(countryCode string, amount float64) Option {
+	return func(controller *AdsController) error {
+		strategy, ok := controller.strategy.(*UndercutStrategy)
+		if !ok {
+			return errors.New("Country undercut requires the undercut strategy")
+		}
+
+		strategy.CountryAmounts[strings.ToUpper(countryCode)] = amount
+		return nil
+	}
+}
+
+// WithCampaignCountries prices a campaign's bids in each of the countries it
+// targets, rather than only in DefaultCountryCode. TJ's bids api doesn't say
+// where a bid is shown, so this has to match the campaign's targeting in TJ.
+func WithCampaignCountries(campaignId string, countryCodes ...string) Option {
+	return func(controller *AdsController) error {
+		for _, countryCode := range countryCodes {
+			if strings.TrimSpace(countryCode) == "" {
+				return errors.New("Country codes must not be empty")
+			}
+		}
+
+		controller.campaignCountries[campaignId] = countryCodes
+		return nil
+	}
+}
+
+// WithRunTimeout bounds a whole RunOnce call, 0 means no deadline.
+func WithRunTimeout(timeout time.Duration) Option {
+	return func(controller *AdsController) error {
+		if timeout < 0 {
+			return errors.New("Run timeout must not be negative")
+		}
+
+		controller.runTimeout = timeout
 		return nil
 	}
 }
@@ -49,9 +119,39 @@ func WithCampaignWhitelist(campaignIds ...string) Option {
 	}
 }
 
+// WithoutCampaigns leaves campaigns alone even if they're whitelisted.
+func WithoutCampaigns(campaignIds ...string) Option {
+	return func(controller *AdsController) error {
+		for _, campaignId := range campaignIds {
+			controller.excludedCampaigns[campaignId] = true
+		}
+		return nil
+	}
+}
+
+// WithCampaignStrategy uses a different strategy for one campaign's bids.
+func WithCampaignStrategy(campaignId string, strategy BidStrategy) Option {
+	return func(controller *AdsController) error {
+		if strategy == nil {
+			return errors.New("Bid strategy must not be nil")
+		}
+
+		controller.campaignStrategies[campaignId] = strategy
+		return nil
+	}
+}
+
 func NewAdsController(opts ...Option) (*AdsController, error) {
-	controller := &AdsController{}
-	controller.undercutAmount = 0.001
+	controller := &AdsController{
+		excludedCampaigns:  make(map[string]bool),
+		campaignStrategies: make(map[string]BidStrategy),
+		campaignLimits:     make(map[string]*BidLimit),
+		countryLimits:      make(map[string]*BidLimit),
+		spotLimits:         make(map[string]*BidLimit),
+		campaignCountries:  make(map[string][]string),
+	}
+	controller.strategy = NewUndercutStrategy(0.001)
+	controller.client = NewClient(DefaultClientConfig())
 
 	for _, opt := range opts {
 		if err := opt(controller); err != nil {
@@ -62,95 +162,192 @@ func NewAdsController(opts ...Option) (*AdsController, error) {
 	return controller, nil
 }
 
-func (controller *AdsController) RunOnce() []*BidUpdate {
-	rateLimiter := rate.NewLimiter(rate.Every(300*time.Millisecond), 1)
+func (controller *AdsController) RunOnce(ctx context.Context) *RunResult {
+	result := newRunResult(time.Now(), controller.readOnly)
+	defer func() {
+		result.EndTime = time.Now()
+	}()
+
+	if controller.runTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, controller.runTimeout)
+		defer cancel()
+	}
+
+	client := controller.client
 
-	session, err := NewSpoofedSession()
+	err := client.EnsureLoggedIn(ctx)
 	if err != nil {
 		glog.Errorf("Error creating spoofed TJ session: %v", err)
-		return nil
+		result.Error = err.Error()
+		return result
 	}
 
 	var campaignIds []string
-	if (len(controller.campaignWhitelist) > 0) {
+	if len(controller.campaignWhitelist) > 0 {
 		campaignIds = controller.campaignWhitelist
 	} else {
-		campaignIds, err = session.GetActiveCampaignIds()
+		campaignIds, err = client.GetActiveCampaignIds(ctx)
 		if err != nil {
 			glog.Errorf("Error getting active campaign ID list: %v", err)
-			return nil
+			result.Error = err.Error()
+			return result
 		}
 	}
 
-	accountState, err := GetAccountState(campaignIds, session, rateLimiter)
+	campaignIds = controller.withoutExcluded(campaignIds)
+
+	// An empty whitelist would mean every campaign
+	if len(campaignIds) == 0 {
+		glog.Infof("No campaigns to process")
+		return result
+	}
+
+	accountState, err := GetAccountState(ctx, campaignIds, client, controller.campaignCountries)
 	if err != nil {
 		glog.Errorf("Error getting account state: %v", err)
-		return nil
+		result.Error = err.Error()
+		return result
 	}
 
-	bidUpdates := controller.calculateNewBids(accountState)
+	result.AccountState = accountState
+	result.CampaignsScanned = len(accountState.Campaigns)
+	for _, campaign := range accountState.Campaigns {
+		result.BidsEvaluated += len(campaign.Bids)
+	}
+	result.Errors = append(result.Errors, accountState.Errors...)
+
+	for _, update := range controller.calculateNewBids(accountState) {
+		update.RunId = result.RunId
+		if update.Skipped {
+			glog.Infof("Skipping campaignId=%v bidId=%v country=%v prevBid=%v newBid=%v: %v\n",
+				update.CampaignId, update.BidId, update.CountryCode, update.PreviousBid,
+				update.NewBid, update.Reason)
+			result.Skipped = append(result.Skipped, update)
+			continue
+		}
 
-	var wg sync.WaitGroup
-	for _, update := range bidUpdates {
-		glog.Infof("campaignId=%v bidId=%v prevBid=%v newBid=%v\n",
-			update.CampaignId, update.BidId, update.PreviousBid, update.NewBid)
+		result.Proposed = append(result.Proposed, update)
+	}
+
+	controller.enforceGuardrails(result)
 
-		if !controller.readOnly {
-			wg.Add(1)
-			go func() {
-				if err := UpdateBid(update.BidId, update.NewBid, rateLimiter); err != nil {
-					glog.Errorf("Error updating bid: %v\n", err)
-				}
+	for _, update := range result.Proposed {
+		glog.Infof("campaignId=%v bidId=%v country=%v prevBid=%v newBid=%v\n",
+			update.CampaignId, update.BidId, update.CountryCode, update.PreviousBid,
+			update.NewBid)
 
-				wg.Done()
-			}()
+		if controller.readOnly {
+			continue
 		}
 
-		wg.Wait()
-	}
+		if err := client.UpdateBid(ctx, update.BidId, update.NewBid); err != nil {
+			glog.Errorf("Error updating bid: %v\n", err)
+			result.Errors = append(result.Errors, &BidError{
+				CampaignId:  update.CampaignId,
+				BidId:       update.BidId,
+				SpotId:      update.SpotId,
+				CountryCode: update.CountryCode,
+				Operation:   OpUpdateBid,
+				Error:       err.Error(),
+			})
+			continue
+		}
 
-	if !controller.readOnly {
-		return bidUpdates
-	} else {
-		return nil
+		result.Applied = append(result.Applied, update)
 	}
+
+	return result
 }
 
 func (controller *AdsController) calculateNewBids(
 	accountState *AccountState) []*BidUpdate {
 
-	updates := make([]*BidUpdate, 0)
-	for _, campaign := range accountState.Campaigns {
-		for _, bid := range campaign.Bids {
-			maxBidForSpot := bid.CurrentMaxTrafficBid
+	strategy := controller.strategy
+	if len(controller.campaignStrategies) > 0 {
+		strategy = &CampaignStrategy{
+			Default:   controller.strategy,
+			Campaigns: controller.campaignStrategies,
+		}
+	}
 
-			// Policy: no updates to spots with no current max bid
-			if maxBidForSpot == 0 {
-				continue
-			}
+	updates := strategy.CalculateNewBids(accountState)
+	for _, update := range updates {
+		controller.enforceLimits(update)
+	}
 
-			idealBid := maxBidForSpot - controller.undercutAmount
+	// Strategies go through the account state's maps in any order
+	sortUpdates(updates)
+	collapseCountryUpdates(accountState, updates)
+	return updates
+}
+
+func (controller *AdsController) withoutExcluded(campaignIds []string) []string {
+	included := make([]string, 0, len(campaignIds))
+	for _, campaignId := range campaignIds {
+		if !controller.excludedCampaigns[campaignId] {
+			included = append(included, campaignId)
+		}
+	}
+
+	return included
+}
+
+// collapseCountryUpdates keeps a single update per TJ bid. A bid targeting
+// several countries has one price, so the lowest ideal bid wins to avoid
+// overpaying in any of them. Countries that didn't propose a change want the
+// current bid, unless they had no competition to go by.
+func collapseCountryUpdates(accountState *AccountState, updates []*BidUpdate) {
+	type proposal struct {
+		countryCode string
+		amount      float64
+		// nil when the country is happy with the current bid
+		update *BidUpdate
+	}
+
+	proposed := proposedByBid(updates)
+	lowest := make(map[string]*proposal)
+	consider := func(candidate *proposal, bidId string) {
+		current, ok := lowest[bidId]
+		if !ok || candidate.amount < current.amount {
+			lowest[bidId] = candidate
+		}
+	}
+
+	for _, update := range proposed {
+		consider(&proposal{update.CountryCode, update.NewBid, update}, update.BidId)
+	}
 
-			// If our current bid is close enough to ideal, we don't update
-			bidDelta := idealBid - bid.BidAmount
-			if bidDelta >= 0 && bidDelta < 0.001 {
+	for _, campaign := range accountState.Campaigns {
+		for _, bid := range campaign.Bids {
+			// Without competition, or when the placement list failed, the
+			// strategy had nothing to say about this country
+			if bid.CurrentMaxTrafficBid == 0 {
 				continue
 			}
 
-			// Current bid needs to be updated
-			update := &BidUpdate{
-				CampaignId:  campaign.CampaignId,
-				BidId:       bid.BidId,
-				PreviousBid: bid.BidAmount,
-				NewBid:      idealBid,
-				Timestamp:   time.Now().In(Pacific).Format(TimeFormat),
+			key := updateKey(campaign.CampaignId, bid.BidId, bid.CountryCode)
+			if _, ok := proposed[key]; !ok {
+				consider(&proposal{bid.CountryCode, bid.BidAmount, nil}, bid.BidId)
 			}
-
-			updates = append(updates, update)
 		}
 	}
 
-	return updates
+	for _, update := range proposed {
+		winner := lowest[update.BidId]
+		if winner.update == update {
+			continue
+		}
+
+		update.Skipped = true
+		if winner.update == nil {
+			update.Reason = fmt.Sprintf("held at %.4f, already right for %v",
+				winner.amount, winner.countryCode)
+		} else {
+			update.Reason = fmt.Sprintf("superseded by lower %v bid %.4f",
+				winner.countryCode, winner.amount)
+		}
+	}
 }
 
 func init() {
@@ -0,0 +1,77 @@
+package djv_ads
+
+import (
+	"math"
+	"testing"
+)
+
+func TestCollapseCountryUpdates(t *testing.T) {
+	tests := []struct {
+		name string
+		// Current bid and top traffic bid by country, and the update each
+		// proposes, 0 for none
+		bids     map[string][2]float64
+		proposed map[string]float64
+		// The country whose update goes through, "" for none
+		winner string
+	}{
+		{
+			"lowest proposal wins",
+			map[string][2]float64{"US": {0.10, 0.09}, "CA": {0.10, 0.30}},
+			map[string]float64{"US": 0.089, "CA": 0.299},
+			"US",
+		},
+		{
+			"country happy at the current bid holds back a raise",
+			map[string][2]float64{"US": {0.10, 0.101}, "CA": {0.10, 0.30}},
+			map[string]float64{"CA": 0.299},
+			"",
+		},
+		{
+			"country without competition doesn't hold back a raise",
+			map[string][2]float64{"US": {0.10, 0}, "CA": {0.10, 0.30}},
+			map[string]float64{"CA": 0.299},
+			"CA",
+		},
+	}
+
+	for _, test := range tests {
+		campaign := &Campaign{CampaignId: "1", Bids: make(map[string]*Bid)}
+		for countryCode, amounts := range test.bids {
+			campaign.Bids[bidKey("11", countryCode)] = &Bid{
+				BidId:                "11",
+				CountryCode:          countryCode,
+				BidAmount:            amounts[0],
+				CurrentMaxTrafficBid: amounts[1],
+			}
+		}
+		accountState := &AccountState{Campaigns: map[string]*Campaign{"1": campaign}}
+
+		updates := make([]*BidUpdate, 0)
+		for countryCode, newBid := range test.proposed {
+			bid := campaign.Bids[bidKey("11", countryCode)]
+			updates = append(updates, newBidUpdate(campaign, bid, newBid))
+		}
+
+		collapseCountryUpdates(accountState, updates)
+		winner := ""
+		for _, update := range updates {
+			if update.Skipped {
+				continue
+			}
+
+			if winner != "" {
+				t.Errorf("%v: both %v and %v went through", test.name, winner, update.CountryCode)
+			}
+			winner = update.CountryCode
+
+			if math.Abs(update.NewBid-test.proposed[winner]) > 0.00001 {
+				t.Errorf("%v: %v update changed to %v", test.name, winner, update.NewBid)
+			}
+		}
+
+		if winner != test.winner {
+			t.Errorf("%v: expected %q to go through, got %q", test.name, test.winner, winner)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package djv_ads
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Daypart is a window of time repeating every week, such as weekday
+// evenings. End before Start runs past midnight into the next day, End equal
+// to Start covers the whole day.
+type Daypart struct {
+	// Days the window starts on, every day when empty
+	Days []time.Weekday
+	// Offsets from midnight
+	Start time.Duration
+	End   time.Duration
+}
+
+var weekdayNames = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday,
+	"wed": time.Wednesday, "thu": time.Thursday, "fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// ParseDaypart reads days like "mon-fri", "sat,sun" or "daily" and a time
+// range like "20:00-02:00".
+func ParseDaypart(days, hours string) (*Daypart, error) {
+	daypart := &Daypart{}
+
+	if days != "daily" {
+		for _, dayRange := range strings.Split(days, ",") {
+			first, last := dayRange, dayRange
+			if i := strings.Index(dayRange, "-"); i >= 0 {
+				first, last = dayRange[:i], dayRange[i+1:]
+			}
+
+			firstDay, ok := weekdayNames[strings.ToLower(first)]
+			if !ok {
+				return nil, fmt.Errorf("unknown day %q", first)
+			}
+
+			lastDay, ok := weekdayNames[strings.ToLower(last)]
+			if !ok {
+				return nil, fmt.Errorf("unknown day %q", last)
+			}
+
+			// Ranges can wrap around the week, like fri-mon
+			for day := firstDay; ; day = (day + 1) % 7 {
+				daypart.Days = append(daypart.Days, day)
+				if day == lastDay {
+					break
+				}
+			}
+		}
+	}
+
+	parts := strings.Split(hours, "-")
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("expected a time range like 20:00-02:00, got %q", hours)
+	}
+
+	var err error
+	if daypart.Start, err = parseClock(parts[0]); err != nil {
+		return nil, err
+	}
+
+	if daypart.End, err = parseClock(parts[1]); err != nil {
+		return nil, err
+	}
+
+	return daypart, nil
+}
+
+func parseClock(clock string) (time.Duration, error) {
+	// 24:00 is the end of the day
+	if clock == "24:00" {
+		return 24 * time.Hour, nil
+	}
+
+	parsed, err := time.Parse("15:04", clock)
+	if err != nil {
+		return 0, fmt.Errorf("expected a time like 20:00, got %q", clock)
+	}
+
+	return time.Duration(parsed.Hour())*time.Hour + time.Duration(parsed.Minute())*time.Minute, nil
+}
+
+// Contains reports whether t, in the schedule's time zone, is in the window.
+func (daypart *Daypart) Contains(t time.Time) bool {
+	// Wall clock rather than time since midnight, which is off on DST changes
+	offset := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+
+	if daypart.Start == daypart.End {
+		return daypart.onDay(t.Weekday())
+	}
+
+	if daypart.Start < daypart.End {
+		return daypart.onDay(t.Weekday()) && offset >= daypart.Start && offset < daypart.End
+	}
+
+	// Runs past midnight, so early hours belong to the previous day's window
+	if offset >= daypart.Start {
+		return daypart.onDay(t.Weekday())
+	}
+
+	return offset < daypart.End && daypart.onDay((t.Weekday()+6)%7)
+}
+
+// EndAfter is when the window t is in ends, in t's time zone. t must be in
+// the window. Whole day windows end at midnight, even when the next day's
+// window carries on from there.
+func (daypart *Daypart) EndAfter(t time.Time) time.Time {
+	offset := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+
+	end, days := daypart.End, 0
+	if daypart.Start == daypart.End {
+		end, days = 0, 1
+	} else if daypart.Start > daypart.End && offset >= daypart.Start {
+		// Runs past midnight into tomorrow
+		days = 1
+	}
+
+	return time.Date(t.Year(), t.Month(), t.Day()+days,
+		int(end/time.Hour), int(end%time.Hour/time.Minute), 0, 0, t.Location())
+}
+
+func (daypart *Daypart) onDay(day time.Weekday) bool {
+	if len(daypart.Days) == 0 {
+		return true
+	}
+
+	for _, windowDay := range daypart.Days {
+		if windowDay == day {
+			return true
+		}
+	}
+
+	return false
+}
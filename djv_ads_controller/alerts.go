@@ -0,0 +1,331 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emef/djv_ads"
+	"github.com/golang/glog"
+)
+
+const ALERT_RUN_FAILURES = "run_failures"
+const ALERT_RUN_RECOVERED = "run_recovered"
+const ALERT_LOGIN_FAILURE = "login_failure"
+const ALERT_GUARDRAIL = "guardrail"
+const ALERT_COMPETITOR_JUMP = "competitor_jump"
+
+const NOTIFY_TIMEOUT = 30 * time.Second
+
+var (
+	alertWebhookUrl = flag.String("alert_webhook_url", "",
+		"POST alerts as JSON to this url")
+	alertSlackUrl = flag.String("alert_slack_url", "",
+		"Post alerts to this Slack compatible incoming webhook")
+	alertSmtpAddr = flag.String("alert_smtp_addr", "",
+		"Email alerts through this SMTP server, host:port")
+	alertSmtpUsername = flag.String("alert_smtp_username", "",
+		"SMTP username, the password is read from ALERT_SMTP_PASSWORD")
+	alertEmailFrom = flag.String("alert_email_from", "",
+		"Sender of alert emails")
+	alertEmailTo = flag.String("alert_email_to", "",
+		"Comma separated recipients of alert emails")
+	alertCooldown = flag.Duration("alert_cooldown", time.Hour,
+		"Send the same alert at most once per cooldown")
+	alertRunFailures = flag.Int("alert_run_failures", 3,
+		"Alert after this many runs in a row fail (0 to disable)")
+	alertCompetitorJumpPercent = flag.Float64("alert_competitor_jump_percent", 50,
+		"Alert when a spot's top competitor bid rises this much between runs (0 to disable)")
+	alertCompetitorJumpMin = flag.Float64("alert_competitor_jump_min", 0.01,
+		"Ignore competitor bid rises smaller than this many dollars")
+)
+
+type Alert struct {
+	Kind string
+	// Alerts with the same key are deduplicated
+	Key     string
+	Title   string
+	Message string
+	Time    time.Time
+	// How many other alerts like this the cooldown held back since one was
+	// last sent
+	Suppressed int
+}
+
+func (alert *Alert) fullMessage() string {
+	if alert.Suppressed == 0 {
+		return alert.Message
+	}
+
+	return fmt.Sprintf("%v\n\n(%v more like this during the cooldown)",
+		alert.Message, alert.Suppressed)
+}
+
+// Alerter sends alerts to every notifier, holding back repeats of an alert
+// until its cooldown has passed. The last one held back goes out when the
+// cooldown ends, so repeats are reported even if the alert doesn't fire
+// again.
+type Alerter struct {
+	notifiers []Notifier
+	cooldown  time.Duration
+	// Consecutive failed runs before alerting, 0 disables
+	failureThreshold int
+	// Competitor bid rise that's alerted on, as a percentage and in dollars
+	jumpPercent float64
+	jumpMin     float64
+
+	mu         sync.Mutex
+	lastSent   map[string]time.Time
+	suppressed map[string]int
+	// The latest alert held back by key, and the timer sending it
+	held       map[string]*Alert
+	heldTimers map[string]*time.Timer
+	failures   int
+	// Set once the failures were alerted on, so the recovery is too
+	failureAlerted bool
+}
+
+var alerter *Alerter
+
+func alerterFromFlags() (*Alerter, error) {
+	notifiers := make([]Notifier, 0)
+	if *alertWebhookUrl != "" {
+		notifiers = append(notifiers, &webhookNotifier{url: *alertWebhookUrl})
+	}
+
+	if *alertSlackUrl != "" {
+		notifiers = append(notifiers, &slackNotifier{url: *alertSlackUrl})
+	}
+
+	if *alertSmtpAddr != "" {
+		to := make([]string, 0)
+		for _, address := range strings.Split(*alertEmailTo, ",") {
+			if address = strings.TrimSpace(address); address != "" {
+				to = append(to, address)
+			}
+		}
+
+		if *alertEmailFrom == "" || len(to) == 0 {
+			return nil, errors.New("-alert_smtp_addr needs -alert_email_from and -alert_email_to")
+		}
+
+		notifiers = append(notifiers, &smtpNotifier{
+			addr:     *alertSmtpAddr,
+			username: *alertSmtpUsername,
+			password: os.Getenv("ALERT_SMTP_PASSWORD"),
+			from:     *alertEmailFrom,
+			to:       to,
+		})
+	}
+
+	return newAlerter(notifiers, *alertCooldown, *alertRunFailures,
+		*alertCompetitorJumpPercent, *alertCompetitorJumpMin), nil
+}
+
+func newAlerter(
+	notifiers []Notifier,
+	cooldown time.Duration,
+	failureThreshold int,
+	jumpPercent, jumpMin float64) *Alerter {
+
+	return &Alerter{
+		notifiers:        notifiers,
+		cooldown:         cooldown,
+		failureThreshold: failureThreshold,
+		jumpPercent:      jumpPercent,
+		jumpMin:          jumpMin,
+		lastSent:         make(map[string]time.Time),
+		suppressed:       make(map[string]int),
+		held:             make(map[string]*Alert),
+		heldTimers:       make(map[string]*time.Timer),
+	}
+}
+
+// Fire sends the alert in the background, unless the same one went out
+// within the cooldown.
+func (alerter *Alerter) Fire(alert *Alert) {
+	alert.Time = time.Now()
+
+	alerter.mu.Lock()
+	if lastSent, ok := alerter.lastSent[alert.Key]; ok && alert.Time.Sub(lastSent) < alerter.cooldown {
+		alerter.suppressed[alert.Key]++
+		alerter.held[alert.Key] = alert
+		if _, ok := alerter.heldTimers[alert.Key]; !ok {
+			key := alert.Key
+			alerter.heldTimers[key] = time.AfterFunc(
+				lastSent.Add(alerter.cooldown).Sub(alert.Time), func() { alerter.sendHeld(key) })
+		}
+		alerter.mu.Unlock()
+		glog.Infof("Holding back alert %v during its cooldown", alert.Key)
+		return
+	}
+
+	alerter.lastSent[alert.Key] = alert.Time
+	alert.Suppressed = alerter.suppressed[alert.Key]
+	alerter.forget(alert.Key)
+	alerter.mu.Unlock()
+
+	alerter.sendAll(alert)
+}
+
+// sendHeld sends the last alert held back under key once its cooldown is
+// over, counting the others held back with it.
+func (alerter *Alerter) sendHeld(key string) {
+	alerter.mu.Lock()
+	alert, ok := alerter.held[key]
+	if !ok {
+		// Fired again, or reset, since
+		alerter.mu.Unlock()
+		return
+	}
+
+	alerter.lastSent[key] = time.Now()
+	alert.Suppressed = alerter.suppressed[key] - 1
+	alerter.forget(key)
+	alerter.mu.Unlock()
+
+	alerter.sendAll(alert)
+}
+
+// forget drops what's held back under key. alerter.mu must be held.
+func (alerter *Alerter) forget(key string) {
+	if timer, ok := alerter.heldTimers[key]; ok {
+		timer.Stop()
+		delete(alerter.heldTimers, key)
+	}
+
+	delete(alerter.held, key)
+	delete(alerter.suppressed, key)
+}
+
+func (alerter *Alerter) sendAll(alert *Alert) {
+	glog.Warningf("Alert %v: %v: %v", alert.Key, alert.Title, alert.Message)
+	alertsFired.WithLabelValues(alert.Kind).Inc()
+	for _, notifier := range alerter.notifiers {
+		go alerter.send(notifier, alert)
+	}
+}
+
+func (alerter *Alerter) send(notifier Notifier, alert *Alert) {
+	ctx, cancel := context.WithTimeout(context.Background(), NOTIFY_TIMEOUT)
+	defer cancel()
+
+	if err := notifier.Notify(ctx, alert); err != nil {
+		glog.Errorf("Error sending alert %v through %v: %v", alert.Key, notifier.Name(), err)
+		notifyErrors.WithLabelValues(notifier.Name()).Inc()
+	}
+}
+
+// recordRun alerts once enough runs in a row have failed, and again when
+// they start succeeding.
+func (alerter *Alerter) recordRun(result *djv_ads.RunResult) {
+	alerter.mu.Lock()
+	if !result.Failed() {
+		recovered := alerter.failureAlerted
+		failures := alerter.failures
+		alerter.failures = 0
+		alerter.failureAlerted = false
+		if recovered {
+			// The next streak is news, not a repeat of this one
+			delete(alerter.lastSent, ALERT_RUN_FAILURES)
+			alerter.forget(ALERT_RUN_FAILURES)
+		}
+		alerter.mu.Unlock()
+
+		if recovered {
+			alerter.Fire(&Alert{
+				Kind:    ALERT_RUN_RECOVERED,
+				Key:     ALERT_RUN_RECOVERED,
+				Title:   "Runs are succeeding again",
+				Message: fmt.Sprintf("Run %v succeeded after %v failures", result.RunId, failures),
+			})
+		}
+		return
+	}
+
+	alerter.failures++
+	failures := alerter.failures
+	tripped := alerter.failureThreshold > 0 && failures >= alerter.failureThreshold
+	if tripped {
+		alerter.failureAlerted = true
+	}
+	alerter.mu.Unlock()
+
+	if tripped {
+		alerter.Fire(&Alert{
+			Kind:    ALERT_RUN_FAILURES,
+			Key:     ALERT_RUN_FAILURES,
+			Title:   fmt.Sprintf("%v runs in a row failed", failures),
+			Message: fmt.Sprintf("Run %v failed: %v", result.RunId, result.Error),
+		})
+	}
+}
+
+// checkCompetitorBids alerts on spots whose top competitor bid rose past the
+// thresholds since the previous run.
+func (alerter *Alerter) checkCompetitorBids(previous, current *djv_ads.AccountState) {
+	if previous == nil || current == nil || alerter.jumpPercent <= 0 {
+		return
+	}
+
+	before := topCompetitorBids(previous)
+	after := topCompetitorBids(current)
+
+	spots := make([]string, 0, len(after))
+	for spot := range after {
+		spots = append(spots, spot)
+	}
+	sort.Strings(spots)
+
+	for _, spot := range spots {
+		was, ok := before[spot]
+		if !ok || was <= 0 {
+			continue
+		}
+
+		jump := after[spot] - was
+		if jump < alerter.jumpMin || jump/was*100 < alerter.jumpPercent {
+			continue
+		}
+
+		alerter.Fire(&Alert{
+			Kind:  ALERT_COMPETITOR_JUMP,
+			Key:   ALERT_COMPETITOR_JUMP + "/" + spot,
+			Title: fmt.Sprintf("Competitor bid jumped on spot %v", spot),
+			Message: fmt.Sprintf("Top competitor bid on spot %v went from %.4f to %.4f (+%.0f%%)",
+				spot, was, after[spot], jump/was*100),
+		})
+	}
+}
+
+// topCompetitorBids is the highest competing bid by spot/country.
+func topCompetitorBids(accountState *djv_ads.AccountState) map[string]float64 {
+	bids := make(map[string]float64)
+	for _, campaign := range accountState.Campaigns {
+		for _, bid := range campaign.Bids {
+			spot := bid.SpotId + "/" + bid.CountryCode
+			if competitorBid := bid.TopCompetitorBid(); competitorBid > bids[spot] {
+				bids[spot] = competitorBid
+			}
+		}
+	}
+
+	return bids
+}
+
+// loginFailed alerts that TJ rejected a login, at the start of a run or
+// renewing a session that expired during one.
+func (alerter *Alerter) loginFailed(loginErr *djv_ads.LoginError) {
+	alerter.Fire(&Alert{
+		Kind:    ALERT_LOGIN_FAILURE,
+		Key:     ALERT_LOGIN_FAILURE,
+		Title:   "Can't log in to TJ",
+		Message: loginErr.Error(),
+	})
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emef/djv_ads"
+)
+
+// recordingNotifier passes on every alert it's sent.
+type recordingNotifier struct {
+	alerts chan *Alert
+}
+
+func (notifier *recordingNotifier) Name() string {
+	return "recording"
+}
+
+func (notifier *recordingNotifier) Notify(ctx context.Context, alert *Alert) error {
+	notifier.alerts <- alert
+	return nil
+}
+
+func newTestAlerter(cooldown time.Duration) (*Alerter, *recordingNotifier) {
+	notifier := &recordingNotifier{alerts: make(chan *Alert, 10)}
+	return newAlerter([]Notifier{notifier}, cooldown, 2, 0, 0), notifier
+}
+
+func expectAlert(t *testing.T, notifier *recordingNotifier, key string, suppressed int) *Alert {
+	t.Helper()
+
+	select {
+	case alert := <-notifier.alerts:
+		if alert.Key != key || alert.Suppressed != suppressed {
+			t.Errorf("expected %v with %v suppressed, got %v with %v", key, suppressed,
+				alert.Key, alert.Suppressed)
+		}
+		return alert
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected alert %v", key)
+		return nil
+	}
+}
+
+func expectNoAlert(t *testing.T, notifier *recordingNotifier, wait time.Duration) {
+	t.Helper()
+
+	select {
+	case alert := <-notifier.alerts:
+		t.Errorf("expected no alert, got %v: %v", alert.Key, alert.Message)
+	case <-time.After(wait):
+	}
+}
+
+func TestAlertCooldown(t *testing.T) {
+	alerter, notifier := newTestAlerter(100 * time.Millisecond)
+
+	alerter.Fire(&Alert{Key: "a", Message: "first"})
+	expectAlert(t, notifier, "a", 0)
+
+	// Other keys have their own cooldown
+	alerter.Fire(&Alert{Key: "b", Message: "other"})
+	expectAlert(t, notifier, "b", 0)
+
+	alerter.Fire(&Alert{Key: "a", Message: "second"})
+	alerter.Fire(&Alert{Key: "a", Message: "third"})
+	expectNoAlert(t, notifier, 20*time.Millisecond)
+
+	// The last one held back goes out when the cooldown ends, without
+	// waiting for another
+	alert := expectAlert(t, notifier, "a", 1)
+	if alert.Message != "third" || !strings.Contains(alert.fullMessage(), "1 more like this") {
+		t.Errorf("expected the third alert counting the second, got %q", alert.fullMessage())
+	}
+
+	expectNoAlert(t, notifier, 200*time.Millisecond)
+}
+
+func TestAlertAfterCooldownCountsHeld(t *testing.T) {
+	alerter, notifier := newTestAlerter(time.Hour)
+
+	alerter.Fire(&Alert{Key: "a"})
+	expectAlert(t, notifier, "a", 0)
+
+	alerter.Fire(&Alert{Key: "a"})
+	alerter.Fire(&Alert{Key: "a"})
+
+	// As if the hour had passed before the held alert was sent
+	alerter.mu.Lock()
+	alerter.lastSent["a"] = time.Now().Add(-2 * time.Hour)
+	alerter.mu.Unlock()
+
+	alerter.Fire(&Alert{Key: "a"})
+	expectAlert(t, notifier, "a", 2)
+
+	alerter.mu.Lock()
+	held, timers := len(alerter.held), len(alerter.heldTimers)
+	alerter.mu.Unlock()
+	if held != 0 || timers != 0 {
+		t.Errorf("expected nothing left held back, got %v alerts and %v timers", held, timers)
+	}
+}
+
+func TestRunFailureAlerts(t *testing.T) {
+	alerter, notifier := newTestAlerter(time.Hour)
+	failed := &djv_ads.RunResult{RunId: "1", Error: "TJ is down"}
+	succeeded := &djv_ads.RunResult{RunId: "2"}
+
+	alerter.recordRun(failed)
+	expectNoAlert(t, notifier, 20*time.Millisecond)
+
+	alerter.recordRun(failed)
+	expectAlert(t, notifier, ALERT_RUN_FAILURES, 0)
+
+	// Held back, then dropped by the recovery
+	alerter.recordRun(failed)
+	alerter.recordRun(succeeded)
+	alert := expectAlert(t, notifier, ALERT_RUN_RECOVERED, 0)
+	if !strings.Contains(alert.Message, "after 3 failures") {
+		t.Errorf("expected the recovery to count 3 failures, got %q", alert.Message)
+	}
+
+	alerter.recordRun(succeeded)
+	expectNoAlert(t, notifier, 20*time.Millisecond)
+
+	// A new streak within the hour is alerted on, not held back
+	alerter.recordRun(failed)
+	alerter.recordRun(failed)
+	expectAlert(t, notifier, ALERT_RUN_FAILURES, 0)
+	expectNoAlert(t, notifier, 20*time.Millisecond)
+}
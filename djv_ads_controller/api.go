@@ -0,0 +1,624 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/emef/djv_ads"
+	"github.com/golang/glog"
+)
+
+const API_PREFIX = "/api/v1/"
+
+const API_DEFAULT_LIMIT = 50
+const API_MAX_LIMIT = 500
+
+// apiSettings is State without the UI strings. In a PUT, fields left out
+// (or null) keep their current value.
+type apiSettings struct {
+	Undercut        *float64
+	TargetPosition  *int
+	GeoUndercuts    map[string]float64
+	GeoMaxBids      map[string]float64
+	RunEveryMinutes *int
+	DebugEnabled    *bool
+	Enabled         *bool
+	RequireApproval *bool
+	// Replaced as a whole when set
+	Campaigns map[string]*CampaignSettings
+	// Read only
+	LastUpdated string
+}
+
+type apiError struct {
+	Error string
+}
+
+// apiDecision picks the proposals to approve or reject, All must be set to
+// decide every pending one.
+type apiDecision struct {
+	Ids []uint64
+	All bool
+}
+
+type apiKillSwitch struct {
+	Reason string
+}
+
+// apiRollback picks a whole run, or individual updates, to roll back.
+type apiRollback struct {
+	RunId     string
+	UpdateIds []uint64
+}
+
+func apiRouter(client djv_ads.TJClient) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(API_PREFIX+"settings", handleApiSettings)
+	mux.HandleFunc(API_PREFIX+"runs", handleApiRuns)
+	mux.HandleFunc(API_PREFIX+"runs/", handleApiRun)
+	mux.HandleFunc(API_PREFIX+"updates", handleApiUpdates)
+	mux.HandleFunc(API_PREFIX+"account_state", handleApiAccountState)
+	mux.HandleFunc(API_PREFIX+"schedule", handleApiSchedule)
+	mux.HandleFunc(API_PREFIX+"proposals", handleApiProposals)
+	mux.HandleFunc(API_PREFIX+"proposals/approve", handleApiDecision(client, PROPOSAL_APPLIED))
+	mux.HandleFunc(API_PREFIX+"proposals/reject", handleApiDecision(client, PROPOSAL_REJECTED))
+	mux.HandleFunc(API_PREFIX+"rollback", handleApiRollback(client))
+	mux.HandleFunc(API_PREFIX+"kill_switch", handleApiKillSwitch)
+	mux.HandleFunc(API_PREFIX+"kill_switch/engage", handleApiKillSwitchAction)
+	mux.HandleFunc(API_PREFIX+"kill_switch/rearm", handleApiKillSwitchAction)
+	mux.HandleFunc(API_PREFIX, func(w http.ResponseWriter, r *http.Request) {
+		writeApiError(w, http.StatusNotFound, "no such endpoint")
+	})
+	return mux
+}
+
+// requireApiAuth accepts basic auth against the users file, or a UI session
+// cookie. Cookie authenticated writes also need the session's csrf token in
+// an X-CSRF-Token header.
+func requireApiAuth(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var session *UISession
+		if username, password, ok := r.BasicAuth(); ok {
+			if !checkPassword(username, password) {
+				glog.Warningf("Failed api login for %q from %v", username, r.RemoteAddr)
+				w.Header().Set("WWW-Authenticate", `Basic realm="djv_ads"`)
+				writeApiError(w, http.StatusUnauthorized, "wrong username or password")
+				return
+			}
+
+			session = &UISession{Username: username}
+		} else {
+			session = sessionFromCookie(r)
+			if session == nil {
+				w.Header().Set("WWW-Authenticate", `Basic realm="djv_ads"`)
+				writeApiError(w, http.StatusUnauthorized, "login required")
+				return
+			}
+
+			token := r.Header.Get("X-CSRF-Token")
+			if r.Method != http.MethodGet && r.Method != http.MethodHead &&
+				subtle.ConstantTimeCompare([]byte(token), []byte(session.CsrfToken)) != 1 {
+
+				writeApiError(w, http.StatusForbidden, "invalid csrf token")
+				return
+			}
+		}
+
+		ctx := context.WithValue(r.Context(), sessionContextKey{}, session)
+		handler.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func handleApiSettings(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		state, err := getState(*statePath)
+		if err != nil {
+			glog.Errorf("Error reading state: %v", err)
+			writeApiError(w, http.StatusInternalServerError, "could not read settings")
+			return
+		}
+
+		writeApiJson(w, http.StatusOK, settingsFromState(state))
+	case http.MethodPut:
+		settings := &apiSettings{}
+		decoder := json.NewDecoder(r.Body)
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(settings); err != nil {
+			writeApiError(w, http.StatusBadRequest, fmt.Sprintf("invalid settings: %v", err))
+			return
+		}
+
+		var invalid error
+		state, err := updateState(*statePath, func(state *State) error {
+			invalid = applySettings(state, settings)
+			return invalid
+		})
+		if invalid != nil {
+			writeApiError(w, http.StatusUnprocessableEntity, invalid.Error())
+			return
+		} else if err != nil {
+			glog.Errorf("Error updating state: %v", err)
+			writeApiError(w, http.StatusInternalServerError, "could not update settings")
+			return
+		}
+
+		glog.Infof("%v updated settings through the api", currentSession(r).Username)
+		scheduler.SettingsChanged()
+		writeApiJson(w, http.StatusOK, settingsFromState(state))
+	default:
+		writeMethodNotAllowed(w, http.MethodGet, http.MethodPut)
+	}
+}
+
+func settingsFromState(state *State) *apiSettings {
+	// Malformed values were rejected when they were saved
+	geoUndercuts, _ := parseCountryAmounts(state.GeoUndercuts)
+	geoMaxBids, _ := parseCountryAmounts(state.GeoMaxBids)
+	debugEnabled := state.DebugEnabled == ENABLED
+	enabled := state.Enabled == ENABLED
+	requireApproval := state.RequireApproval == ENABLED
+
+	return &apiSettings{
+		Undercut:        &state.Undercut,
+		TargetPosition:  &state.TargetPosition,
+		GeoUndercuts:    geoUndercuts,
+		GeoMaxBids:      geoMaxBids,
+		RunEveryMinutes: &state.RunEvery,
+		DebugEnabled:    &debugEnabled,
+		Enabled:         &enabled,
+		RequireApproval: &requireApproval,
+		Campaigns:       state.Campaigns,
+		LastUpdated:     state.LastUpdated,
+	}
+}
+
+func applySettings(state *State, settings *apiSettings) error {
+	if settings.Undercut != nil {
+		if *settings.Undercut < 0 {
+			return fmt.Errorf("Undercut must not be negative")
+		}
+		state.Undercut = *settings.Undercut
+	}
+
+	if settings.TargetPosition != nil {
+		if *settings.TargetPosition < 0 {
+			return fmt.Errorf("TargetPosition must not be negative")
+		}
+		state.TargetPosition = *settings.TargetPosition
+	}
+
+	if settings.GeoUndercuts != nil {
+		if err := checkCountryAmounts("GeoUndercuts", settings.GeoUndercuts); err != nil {
+			return err
+		}
+		state.GeoUndercuts = formatCountryAmounts(settings.GeoUndercuts)
+	}
+
+	if settings.GeoMaxBids != nil {
+		if err := checkCountryAmounts("GeoMaxBids", settings.GeoMaxBids); err != nil {
+			return err
+		}
+		state.GeoMaxBids = formatCountryAmounts(settings.GeoMaxBids)
+	}
+
+	if settings.RunEveryMinutes != nil {
+		if *settings.RunEveryMinutes < 1 {
+			return fmt.Errorf("RunEveryMinutes must be at least 1")
+		}
+		state.RunEvery = *settings.RunEveryMinutes
+	}
+
+	if settings.Campaigns != nil {
+		for campaignId, campaignSettings := range settings.Campaigns {
+			if campaignSettings == nil {
+				return fmt.Errorf("Campaigns %v must not be null", campaignId)
+			}
+
+			if err := campaignSettings.validate(); err != nil {
+				return fmt.Errorf("Campaigns %v: %v", campaignId, err)
+			}
+		}
+		state.Campaigns = settings.Campaigns
+	}
+
+	if settings.DebugEnabled != nil {
+		state.setDebugEnabled(*settings.DebugEnabled)
+	}
+
+	if settings.Enabled != nil {
+		state.setEnabled(*settings.Enabled)
+	}
+
+	if settings.RequireApproval != nil {
+		state.setRequireApproval(*settings.RequireApproval)
+	}
+
+	return state.checkGeoUndercuts()
+}
+
+// checkCountryAmounts makes sure the amounts survive the round trip through
+// the State's "US=0.001, CA=0.002" format.
+func checkCountryAmounts(name string, amounts map[string]float64) error {
+	for countryCode, amount := range amounts {
+		if countryCode == "" || strings.ContainsAny(countryCode, "=, ") {
+			return fmt.Errorf("%v has an invalid country code %q", name, countryCode)
+		}
+
+		if amount < 0 {
+			return fmt.Errorf("%v for %v must not be negative", name, countryCode)
+		}
+	}
+
+	return nil
+}
+
+// handleApiRuns lists runs newest first, or starts a run on POST.
+func handleApiRuns(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		limit, offset, err := parseLimitOffset(r)
+		if err != nil {
+			writeApiError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		runs, err := store.ListRuns(limit, offset)
+		if err != nil {
+			glog.Errorf("Error reading runs: %v", err)
+			writeApiError(w, http.StatusInternalServerError, "could not read runs")
+			return
+		}
+
+		writeApiJson(w, http.StatusOK, map[string]interface{}{
+			"Runs":   runs,
+			"Limit":  limit,
+			"Offset": offset,
+		})
+	case http.MethodPost:
+		if err := scheduler.RunNow(); err != nil {
+			writeApiError(w, http.StatusConflict, err.Error())
+			return
+		}
+
+		glog.Infof("%v requested a run through the api", currentSession(r).Username)
+		writeApiJson(w, http.StatusAccepted, map[string]bool{"Queued": true})
+	default:
+		writeMethodNotAllowed(w, http.MethodGet, http.MethodPost)
+	}
+}
+
+func handleApiRun(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeMethodNotAllowed(w, http.MethodGet)
+		return
+	}
+
+	runId := strings.TrimPrefix(r.URL.Path, API_PREFIX+"runs/")
+	run, err := store.GetRun(runId)
+	if err != nil {
+		glog.Errorf("Error reading run %v: %v", runId, err)
+		writeApiError(w, http.StatusInternalServerError, "could not read run")
+		return
+	}
+
+	if run == nil {
+		writeApiError(w, http.StatusNotFound, fmt.Sprintf("no run %q", runId))
+		return
+	}
+
+	writeApiJson(w, http.StatusOK, run)
+}
+
+// handleApiUpdates lists applied bid updates newest first, filtered by
+// campaign_id, bid_id, since and until.
+func handleApiUpdates(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeMethodNotAllowed(w, http.MethodGet)
+		return
+	}
+
+	limit, offset, err := parseLimitOffset(r)
+	if err != nil {
+		writeApiError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	params := r.URL.Query()
+	query := UpdateQuery{
+		CampaignId: params.Get("campaign_id"),
+		BidId:      params.Get("bid_id"),
+		Limit:      limit,
+		Offset:     offset,
+	}
+
+	if since := params.Get("since"); since != "" {
+		if query.Since, err = parseQueryTime(since); err != nil {
+			writeApiError(w, http.StatusBadRequest, fmt.Sprintf("could not parse since: %v", since))
+			return
+		}
+	}
+
+	if until := params.Get("until"); until != "" {
+		if query.Until, err = parseQueryTime(until); err != nil {
+			writeApiError(w, http.StatusBadRequest, fmt.Sprintf("could not parse until: %v", until))
+			return
+		}
+	}
+
+	updates, err := store.ListUpdates(query)
+	if err != nil {
+		glog.Errorf("Error reading updates: %v", err)
+		writeApiError(w, http.StatusInternalServerError, "could not read updates")
+		return
+	}
+
+	writeApiJson(w, http.StatusOK, map[string]interface{}{
+		"Updates": updates,
+		"Limit":   limit,
+		"Offset":  offset,
+	})
+}
+
+// handleApiAccountState returns the account state seen by the latest run.
+func handleApiAccountState(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeMethodNotAllowed(w, http.MethodGet)
+		return
+	}
+
+	accountState, err := store.LatestSnapshot()
+	if err != nil {
+		glog.Errorf("Error reading snapshot: %v", err)
+		writeApiError(w, http.StatusInternalServerError, "could not read account state")
+		return
+	}
+
+	if accountState == nil {
+		writeApiError(w, http.StatusNotFound, "no run has completed yet")
+		return
+	}
+
+	writeApiJson(w, http.StatusOK, accountState)
+}
+
+func handleApiSchedule(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeMethodNotAllowed(w, http.MethodGet)
+		return
+	}
+
+	writeApiJson(w, http.StatusOK, scheduler.Status())
+}
+
+// handleApiProposals lists proposals newest first, pending ones unless
+// another status is asked for.
+func handleApiProposals(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeMethodNotAllowed(w, http.MethodGet)
+		return
+	}
+
+	limit, _, err := parseLimitOffset(r)
+	if err != nil {
+		writeApiError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	status := r.URL.Query().Get("status")
+	if status == "" {
+		status = PROPOSAL_PENDING
+	} else if status == "all" {
+		status = ""
+	}
+
+	proposals, err := store.ListProposals(status, limit)
+	if err != nil {
+		glog.Errorf("Error reading proposals: %v", err)
+		writeApiError(w, http.StatusInternalServerError, "could not read proposals")
+		return
+	}
+
+	writeApiJson(w, http.StatusOK, map[string]interface{}{
+		"Proposals": proposals,
+		"Limit":     limit,
+	})
+}
+
+func handleApiDecision(client djv_ads.TJClient, status string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeMethodNotAllowed(w, http.MethodPost)
+			return
+		}
+
+		decision := &apiDecision{}
+		if err := json.NewDecoder(r.Body).Decode(decision); err != nil {
+			writeApiError(w, http.StatusBadRequest, fmt.Sprintf("invalid decision: %v", err))
+			return
+		}
+
+		if len(decision.Ids) == 0 && !decision.All {
+			writeApiError(w, http.StatusBadRequest, "set Ids or All")
+			return
+		}
+
+		ids := decision.Ids
+		if decision.All {
+			ids = nil
+		}
+
+		username := currentSession(r).Username
+		if status == PROPOSAL_REJECTED {
+			rejected, err := rejectProposals(ids, username)
+			if err != nil {
+				glog.Errorf("Error rejecting proposals: %v", err)
+				writeApiError(w, http.StatusInternalServerError, "could not reject proposals")
+				return
+			}
+
+			writeApiJson(w, http.StatusOK, map[string]int{"Rejected": rejected})
+			return
+		}
+
+		applied, failed, stale, err := approveProposals(r.Context(), client, ids, username)
+		if err == ErrKillSwitchEngaged {
+			writeApiError(w, http.StatusConflict, err.Error())
+			return
+		}
+
+		if err != nil {
+			glog.Errorf("Error approving proposals: %v", err)
+			writeApiError(w, http.StatusInternalServerError, "could not approve proposals")
+			return
+		}
+
+		writeApiJson(w, http.StatusOK, map[string]int{
+			"Applied": applied,
+			"Failed":  failed,
+			"Stale":   stale,
+		})
+	}
+}
+
+// handleApiRollback rolls back a run or a set of updates. Conflicts are part
+// of a successful response, they're bids that were left alone.
+func handleApiRollback(client djv_ads.TJClient) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeMethodNotAllowed(w, http.MethodPost)
+			return
+		}
+
+		rollback := &apiRollback{}
+		if err := json.NewDecoder(r.Body).Decode(rollback); err != nil {
+			writeApiError(w, http.StatusBadRequest, fmt.Sprintf("invalid rollback: %v", err))
+			return
+		}
+
+		if (rollback.RunId == "") == (len(rollback.UpdateIds) == 0) {
+			writeApiError(w, http.StatusBadRequest, "set one of RunId or UpdateIds")
+			return
+		}
+
+		username := currentSession(r).Username
+		var result *djv_ads.RollbackResult
+		var err error
+		if rollback.RunId != "" {
+			result, err = rollbackRun(r.Context(), client, rollback.RunId, username)
+		} else {
+			result, err = rollbackUpdates(r.Context(), client, rollback.UpdateIds, username)
+		}
+
+		if err == ErrKillSwitchEngaged {
+			writeApiError(w, http.StatusConflict, err.Error())
+			return
+		}
+
+		if err != nil {
+			writeApiError(w, http.StatusUnprocessableEntity, fmt.Sprintf("could not roll back: %v", err))
+			return
+		}
+
+		writeApiJson(w, http.StatusOK, result)
+	}
+}
+
+// handleApiKillSwitch returns the kill switch and its latest audit events.
+func handleApiKillSwitch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeMethodNotAllowed(w, http.MethodGet)
+		return
+	}
+
+	limit, _, err := parseLimitOffset(r)
+	if err != nil {
+		writeApiError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	events, err := store.ListAuditEvents(limit)
+	if err != nil {
+		glog.Errorf("Error reading audit events: %v", err)
+		writeApiError(w, http.StatusInternalServerError, "could not read audit events")
+		return
+	}
+
+	writeApiJson(w, http.StatusOK, map[string]interface{}{
+		"KillSwitch": killSwitch.Status(),
+		"Events":     events,
+	})
+}
+
+func handleApiKillSwitchAction(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeMethodNotAllowed(w, http.MethodPost)
+		return
+	}
+
+	// The body is optional, engaging shouldn't wait on getting it right
+	action := &apiKillSwitch{}
+	if err := json.NewDecoder(r.Body).Decode(action); err != nil && err != io.EOF {
+		writeApiError(w, http.StatusBadRequest, fmt.Sprintf("invalid request: %v", err))
+		return
+	}
+
+	username := currentSession(r).Username
+	if strings.HasSuffix(r.URL.Path, "/engage") {
+		if _, err := killSwitch.Engage(username, SOURCE_API, action.Reason); err != nil {
+			writeApiError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+	} else if err := killSwitch.Rearm(username, SOURCE_API, action.Reason); err != nil {
+		writeApiError(w, http.StatusConflict, err.Error())
+		return
+	}
+
+	writeApiJson(w, http.StatusOK, killSwitch.Status())
+}
+
+func parseLimitOffset(r *http.Request) (int, int, error) {
+	query := r.URL.Query()
+	limit, offset := API_DEFAULT_LIMIT, 0
+
+	if limitStr := query.Get("limit"); limitStr != "" {
+		var err error
+		limit, err = strconv.Atoi(limitStr)
+		if err != nil || limit < 1 || limit > API_MAX_LIMIT {
+			return 0, 0, fmt.Errorf("limit must be between 1 and %v", API_MAX_LIMIT)
+		}
+	}
+
+	if offsetStr := query.Get("offset"); offsetStr != "" {
+		var err error
+		offset, err = strconv.Atoi(offsetStr)
+		if err != nil || offset < 0 {
+			return 0, 0, fmt.Errorf("offset must be a non-negative integer")
+		}
+	}
+
+	return limit, offset, nil
+}
+
+func writeApiJson(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(value); err != nil {
+		glog.Errorf("Error writing api response: %v", err)
+	}
+}
+
+func writeApiError(w http.ResponseWriter, status int, message string) {
+	writeApiJson(w, status, &apiError{message})
+}
+
+func writeMethodNotAllowed(w http.ResponseWriter, methods ...string) {
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	writeApiError(w, http.StatusMethodNotAllowed, "method not allowed")
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/emef/djv_ads"
+)
+
+// setupApi points the package at a fresh store, state file and scheduler,
+// returning the state file's path.
+func setupApi(t *testing.T) string {
+	t.Helper()
+
+	oldStore, oldStatePath, oldScheduler := store, *statePath, scheduler
+	t.Cleanup(func() {
+		store, *statePath, scheduler = oldStore, oldStatePath, oldScheduler
+	})
+
+	store = openTestStore(t)
+	*statePath = filepath.Join(t.TempDir(), "state")
+	scheduler = NewScheduler(0, func(ctx context.Context, requested bool) {})
+
+	return *statePath
+}
+
+func serveApi(method, target, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, API_PREFIX+target, strings.NewReader(body))
+	r = r.WithContext(context.WithValue(r.Context(), sessionContextKey{},
+		&UISession{Username: "alice"}))
+
+	w := httptest.NewRecorder()
+	apiRouter(nil).ServeHTTP(w, r)
+	return w
+}
+
+func TestApiSettings(t *testing.T) {
+	path := setupApi(t)
+
+	if w := serveApi(http.MethodGet, "settings", ""); w.Code != http.StatusOK ||
+		!strings.Contains(w.Body.String(), `"Undercut":0.001`) {
+
+		t.Errorf("expected the default settings, got %v %v", w.Code, w.Body)
+	}
+
+	campaigns := `{"Campaigns": {"1": {"Mode": "exclude"}}}`
+	if w := serveApi(http.MethodPut, "settings", campaigns); w.Code != http.StatusOK {
+		t.Fatalf("expected the campaigns to be saved, got %v %v", w.Code, w.Body)
+	}
+
+	tests := []struct {
+		name string
+		body string
+		code int
+	}{
+		{"unknown field", `{"Undercutt": 0.002}`, http.StatusBadRequest},
+		{"not json", `undercut=0.002`, http.StatusBadRequest},
+		{"negative undercut", `{"Undercut": -0.002}`, http.StatusUnprocessableEntity},
+		{"no runs", `{"RunEveryMinutes": 0}`, http.StatusUnprocessableEntity},
+		{"geo undercut by position", `{"TargetPosition": 2, "GeoUndercuts": {"US": 0.002}}`,
+			http.StatusUnprocessableEntity},
+		{"undercut", `{"Undercut": 0.002}`, http.StatusOK},
+	}
+
+	for _, test := range tests {
+		if w := serveApi(http.MethodPut, "settings", test.body); w.Code != test.code {
+			t.Errorf("%v: expected %v, got %v %v", test.name, test.code, w.Code, w.Body)
+		}
+	}
+
+	// Rejected changes weren't saved, and fields left out were kept
+	state, err := readState(path)
+	if err != nil || state.Undercut != 0.002 || state.RunEvery != RUNEVERY_DEFAULT ||
+		state.TargetPosition != 0 || state.Campaigns["1"] == nil {
+
+		t.Errorf("unexpected saved state %+v %v", state, err)
+	}
+
+	if w := serveApi(http.MethodDelete, "settings", ""); w.Code != http.StatusMethodNotAllowed ||
+		w.Header().Get("Allow") != "GET, PUT" {
+
+		t.Errorf("expected delete not to be allowed, got %v %v", w.Code, w.Header())
+	}
+}
+
+func TestApiSettingsUnreadableState(t *testing.T) {
+	path := setupApi(t)
+
+	if err := os.WriteFile(path, []byte(`{"Undercut": 0.0`), 0644); err != nil {
+		t.Fatalf("writing state: %v", err)
+	}
+
+	if w := serveApi(http.MethodGet, "settings", ""); w.Code != http.StatusInternalServerError {
+		t.Errorf("expected a 500 reading a broken state, got %v %v", w.Code, w.Body)
+	}
+
+	if w := serveApi(http.MethodPut, "settings", `{"Undercut": 0.002}`); w.Code !=
+		http.StatusInternalServerError {
+
+		t.Errorf("expected a 500 updating a broken state, got %v %v", w.Code, w.Body)
+	}
+
+	// Left for someone to fix, not replaced by the defaults
+	if contents, _ := os.ReadFile(path); string(contents) != `{"Undercut": 0.0` {
+		t.Errorf("expected the state to be left alone, got %q", contents)
+	}
+}
+
+func TestApiPagination(t *testing.T) {
+	setupApi(t)
+
+	start := time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+	for i := 0; i < 5; i++ {
+		at := start.Add(time.Duration(i) * time.Hour)
+		update := testUpdate("1", strconv.Itoa(i), 0.10)
+		if err := store.AddUpdates([]*djv_ads.BidUpdate{update}, at); err != nil {
+			t.Fatalf("adding update: %v", err)
+		}
+
+		run := &djv_ads.RunResult{RunId: strconv.Itoa(i), StartTime: at, EndTime: at}
+		if err := store.AddRun(run); err != nil {
+			t.Fatalf("adding run: %v", err)
+		}
+	}
+
+	tests := []struct {
+		target   string
+		code     int
+		expected []string
+	}{
+		{"updates", http.StatusOK, []string{"4", "3", "2", "1", "0"}},
+		{"updates?limit=2&offset=1", http.StatusOK, []string{"3", "2"}},
+		{"updates?offset=4", http.StatusOK, []string{"0"}},
+		{"updates?offset=5", http.StatusOK, []string{}},
+		{"updates?bid_id=3", http.StatusOK, []string{"3"}},
+		{"updates?since=" + start.Add(3*time.Hour).Format(time.RFC3339), http.StatusOK,
+			[]string{"4", "3"}},
+		{"updates?limit=0", http.StatusBadRequest, nil},
+		{"updates?limit=501", http.StatusBadRequest, nil},
+		{"updates?offset=-1", http.StatusBadRequest, nil},
+		{"updates?since=yesterday", http.StatusBadRequest, nil},
+		{"runs?limit=2&offset=2", http.StatusOK, []string{"2", "1"}},
+		{"runs?limit=lots", http.StatusBadRequest, nil},
+	}
+
+	for _, test := range tests {
+		w := serveApi(http.MethodGet, test.target, "")
+		if w.Code != test.code {
+			t.Errorf("%v: expected %v, got %v %v", test.target, test.code, w.Code, w.Body)
+			continue
+		}
+
+		if test.expected == nil {
+			continue
+		}
+
+		response := struct {
+			Updates []*StoredUpdate
+			Runs    []*djv_ads.RunResult
+		}{}
+		if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+			t.Errorf("%v: %v", test.target, err)
+			continue
+		}
+
+		got := bidIds(response.Updates)
+		for _, run := range response.Runs {
+			got = append(got, run.RunId)
+		}
+
+		if !equalStrings(got, test.expected) {
+			t.Errorf("%v: expected %v, got %v", test.target, test.expected, got)
+		}
+	}
+}
+
+func TestApiNotFound(t *testing.T) {
+	setupApi(t)
+
+	tests := []struct {
+		method string
+		target string
+		code   int
+	}{
+		{http.MethodGet, "nothing", http.StatusNotFound},
+		{http.MethodGet, "runs/123", http.StatusNotFound},
+		{http.MethodGet, "account_state", http.StatusNotFound},
+		{http.MethodPost, "updates", http.StatusMethodNotAllowed},
+		{http.MethodGet, "schedule", http.StatusOK},
+	}
+
+	for _, test := range tests {
+		if w := serveApi(test.method, test.target, ""); w.Code != test.code {
+			t.Errorf("%v %v: expected %v, got %v", test.method, test.target, test.code, w.Code)
+		}
+	}
+}
+
+func TestUpdateStateConcurrently(t *testing.T) {
+	path := setupApi(t)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(campaignId string) {
+			defer wg.Done()
+
+			_, err := updateState(path, func(state *State) error {
+				if state.Campaigns == nil {
+					state.Campaigns = make(map[string]*CampaignSettings)
+				}
+				state.Campaigns[campaignId] = &CampaignSettings{Mode: CAMPAIGN_EXCLUDE}
+				return nil
+			})
+			if err != nil {
+				t.Errorf("updating state: %v", err)
+			}
+		}(strconv.Itoa(i))
+	}
+	wg.Wait()
+
+	// No change was lost to another writer
+	state, err := readState(path)
+	if err != nil || len(state.Campaigns) != 20 {
+		t.Errorf("expected all 20 campaigns saved, got %v %v", len(state.Campaigns), err)
+	}
+
+	if files, _ := os.ReadDir(filepath.Dir(path)); len(files) != 1 {
+		t.Errorf("expected no temp files left behind, got %v", files)
+	}
+}
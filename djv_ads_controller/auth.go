@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const SESSION_COOKIE = "djv_session"
+const LOGIN_TEMPLATE = "login.template.html"
+
+var (
+	usersPath = flag.String("users_path", "",
+		"File of username:bcrypt-hash lines allowed to log in (htpasswd -B works too)")
+	addUser = flag.String("add_user", "",
+		"Add or reset this user in -users_path, reading the password from stdin, then exit")
+	sessionTTL = flag.Duration("session_ttl", 7*24*time.Hour,
+		"How long a login lasts")
+)
+
+// UISession is a logged in browser.
+type UISession struct {
+	Token     string
+	Username  string
+	CsrfToken string
+	Expires   time.Time
+}
+
+type sessionContextKey struct{}
+
+// Hashed at startup so unknown users take as long to reject as known ones.
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("djv_ads"), bcrypt.DefaultCost)
+
+// requireLogin sends browsers without a valid session to the login page,
+// and answers json requests with a 401.
+func requireLogin(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		session := sessionFromCookie(r)
+		if session == nil {
+			if strings.HasSuffix(r.URL.Path, ".json") {
+				http.Error(w, "login required", http.StatusUnauthorized)
+			} else {
+				http.Redirect(w, r, "/login", http.StatusFound)
+			}
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), sessionContextKey{}, session)
+		handler(w, r.WithContext(ctx))
+	}
+}
+
+// requireCsrf only lets through POSTs carrying the session's csrf token.
+// It must be wrapped by requireLogin.
+func requireCsrf(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		session := currentSession(r)
+		token := r.PostFormValue("csrf_token")
+		if session == nil || subtle.ConstantTimeCompare(
+			[]byte(token), []byte(session.CsrfToken)) != 1 {
+
+			glog.Warningf("Rejected %v %v with a bad csrf token", r.Method, r.URL.Path)
+			http.Error(w, "invalid csrf token", http.StatusForbidden)
+			return
+		}
+
+		handler(w, r)
+	}
+}
+
+func currentSession(r *http.Request) *UISession {
+	session, _ := r.Context().Value(sessionContextKey{}).(*UISession)
+	return session
+}
+
+func sessionFromCookie(r *http.Request) *UISession {
+	cookie, err := r.Cookie(SESSION_COOKIE)
+	if err != nil || cookie.Value == "" {
+		return nil
+	}
+
+	session, err := store.GetSession(cookie.Value)
+	if err != nil {
+		glog.Errorf("Error reading session: %v", err)
+		return nil
+	}
+
+	return session
+}
+
+func handleLogin(w http.ResponseWriter, r *http.Request) {
+	loginError := ""
+	if r.Method == http.MethodPost {
+		username := strings.TrimSpace(r.PostFormValue("username"))
+		if checkPassword(username, r.PostFormValue("password")) {
+			if err := startSession(w, r, username); err != nil {
+				handleError(w, fmt.Sprintf("could not start session: %v", err))
+				return
+			}
+
+			glog.Infof("%v logged in from %v", username, r.RemoteAddr)
+			http.Redirect(w, r, "/", http.StatusFound)
+			return
+		}
+
+		glog.Warningf("Failed login for %q from %v", username, r.RemoteAddr)
+		loginError = "Wrong username or password"
+	}
+
+	loginTemplatePath := path.Join(*templatesDir, LOGIN_TEMPLATE)
+	template, err := template.ParseFiles(loginTemplatePath)
+	if err != nil {
+		handleError(w, fmt.Sprintf("couldn't read template %s: %v",
+			loginTemplatePath, err))
+		return
+	}
+
+	template.Execute(w, struct{ Error string }{loginError})
+}
+
+func handleLogout(w http.ResponseWriter, r *http.Request) {
+	if err := store.DeleteSession(currentSession(r).Token); err != nil {
+		glog.Errorf("Error deleting session: %v", err)
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     SESSION_COOKIE,
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+	})
+	http.Redirect(w, r, "/login", http.StatusFound)
+}
+
+func startSession(w http.ResponseWriter, r *http.Request, username string) error {
+	token, err := randomToken()
+	if err != nil {
+		return err
+	}
+
+	csrfToken, err := randomToken()
+	if err != nil {
+		return err
+	}
+
+	session := &UISession{
+		Token:     token,
+		Username:  username,
+		CsrfToken: csrfToken,
+		Expires:   time.Now().Add(*sessionTTL),
+	}
+
+	if err = store.PutSession(session); err != nil {
+		return err
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     SESSION_COOKIE,
+		Value:    token,
+		Path:     "/",
+		Expires:  session.Expires,
+		HttpOnly: true,
+		// nginx tells us when the browser came in over https
+		Secure:   r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https",
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	return nil
+}
+
+func randomToken() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+func checkPassword(username, password string) bool {
+	users, err := readUsers(*usersPath)
+	if err != nil {
+		glog.Errorf("Error reading users: %v", err)
+		return false
+	}
+
+	hash, ok := users[username]
+	if !ok || username == "" {
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return false
+	}
+
+	return bcrypt.CompareHashAndPassword(hash, []byte(password)) == nil
+}
+
+// readUsers reads username:hash lines, skipping blanks and # comments. It's
+// read on every login so users can be added without a restart.
+func readUsers(path string) (map[string][]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	users := make(map[string][]byte)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			glog.Warningf("Ignoring malformed line in %v", path)
+			continue
+		}
+
+		users[parts[0]] = []byte(parts[1])
+	}
+
+	return users, scanner.Err()
+}
+
+// addUserFromStdin hashes the first line of stdin as username's password,
+// replacing any existing entry.
+func addUserFromStdin(path, username string, stdin io.Reader) error {
+	if path == "" {
+		return errors.New("-users_path is required")
+	}
+
+	if username == "" || strings.ContainsAny(username, ": \t") {
+		return fmt.Errorf("invalid username %q", username)
+	}
+
+	fmt.Fprintf(os.Stderr, "Password for %v: ", username)
+	password, err := bufio.NewReader(stdin).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return err
+	}
+
+	password = strings.TrimRight(password, "\r\n")
+	if len(password) < 8 {
+		return errors.New("password must be at least 8 characters")
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+
+	lines := make([]string, 0)
+	if contents, err := os.ReadFile(path); err == nil {
+		for _, line := range strings.Split(string(contents), "\n") {
+			if line != "" && !strings.HasPrefix(line, username+":") {
+				lines = append(lines, line)
+			}
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	lines = append(lines, username+":"+string(hash))
+	return os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0600)
+}
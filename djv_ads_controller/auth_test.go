@@ -0,0 +1,241 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// setupAuth points the package at a fresh store and a users file holding
+// "alice" with password "correct horse".
+func setupAuth(t *testing.T) {
+	t.Helper()
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("correct horse"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("hashing password: %v", err)
+	}
+
+	path := filepath.Join(t.TempDir(), "users")
+	users := "# comment\n\nalice:" + string(hash) + "\nmalformed\n"
+	if err := os.WriteFile(path, []byte(users), 0600); err != nil {
+		t.Fatalf("writing users: %v", err)
+	}
+
+	oldStore, oldUsersPath, oldTemplatesDir := store, *usersPath, *templatesDir
+	t.Cleanup(func() {
+		store, *usersPath, *templatesDir = oldStore, oldUsersPath, oldTemplatesDir
+	})
+
+	store = openTestStore(t)
+	*usersPath = path
+	*templatesDir = "../templates"
+}
+
+func testSession(t *testing.T, expires time.Time) *UISession {
+	t.Helper()
+
+	session := &UISession{
+		Token:     "token-" + expires.Format(time.RFC3339),
+		Username:  "alice",
+		CsrfToken: "csrf",
+		Expires:   expires,
+	}
+	if err := store.PutSession(session); err != nil {
+		t.Fatalf("saving session: %v", err)
+	}
+
+	return session
+}
+
+func withCookie(r *http.Request, session *UISession) *http.Request {
+	if session != nil {
+		r.AddCookie(&http.Cookie{Name: SESSION_COOKIE, Value: session.Token})
+	}
+	return r
+}
+
+func TestCheckPassword(t *testing.T) {
+	setupAuth(t)
+
+	tests := []struct {
+		username, password string
+		ok                 bool
+	}{
+		{"alice", "correct horse", true},
+		{"alice", "wrong horse", false},
+		{"bob", "correct horse", false},
+		{"", "", false},
+		{"malformed", "", false},
+	}
+
+	for _, test := range tests {
+		if ok := checkPassword(test.username, test.password); ok != test.ok {
+			t.Errorf("%v/%v: expected %v, got %v", test.username, test.password, test.ok, ok)
+		}
+	}
+}
+
+func TestLogin(t *testing.T) {
+	setupAuth(t)
+
+	login := func(password string) *httptest.ResponseRecorder {
+		form := url.Values{"username": {" alice "}, "password": {password}}
+		r := httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		handleLogin(w, r)
+		return w
+	}
+
+	w := login("wrong horse")
+	if w.Code != http.StatusOK || len(w.Result().Cookies()) != 0 ||
+		!strings.Contains(w.Body.String(), "Wrong username or password") {
+
+		t.Errorf("expected the login page again, got %v %v", w.Code, w.Result().Cookies())
+	}
+
+	w = login("correct horse")
+	if w.Code != http.StatusFound || w.Header().Get("Location") != "/" {
+		t.Fatalf("expected a redirect home, got %v %v", w.Code, w.Header())
+	}
+
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != SESSION_COOKIE || !cookies[0].HttpOnly {
+		t.Fatalf("expected an http only session cookie, got %v", cookies)
+	}
+
+	session, err := store.GetSession(cookies[0].Value)
+	if err != nil || session == nil || session.Username != "alice" || session.CsrfToken == "" {
+		t.Errorf("expected a session for alice, got %v %v", session, err)
+	}
+}
+
+func TestRequireLogin(t *testing.T) {
+	setupAuth(t)
+
+	valid := testSession(t, time.Now().Add(time.Hour))
+	expired := testSession(t, time.Now().Add(-time.Hour))
+	unknown := &UISession{Token: "unknown"}
+
+	tests := []struct {
+		name     string
+		path     string
+		session  *UISession
+		code     int
+		location string
+	}{
+		{"no cookie", "/", nil, http.StatusFound, "/login"},
+		{"no cookie json", "/spot.json", nil, http.StatusUnauthorized, ""},
+		{"expired", "/", expired, http.StatusFound, "/login"},
+		{"unknown", "/", unknown, http.StatusFound, "/login"},
+		{"valid", "/", valid, http.StatusOK, ""},
+	}
+
+	for _, test := range tests {
+		var seen *UISession
+		handler := requireLogin(func(w http.ResponseWriter, r *http.Request) {
+			seen = currentSession(r)
+		})
+
+		w := httptest.NewRecorder()
+		handler(w, withCookie(httptest.NewRequest(http.MethodGet, test.path, nil), test.session))
+
+		if w.Code != test.code || w.Header().Get("Location") != test.location {
+			t.Errorf("%v: expected %v %q, got %v %q", test.name, test.code, test.location,
+				w.Code, w.Header().Get("Location"))
+		}
+
+		if (seen != nil) != (test.code == http.StatusOK) {
+			t.Errorf("%v: handler saw session %v", test.name, seen)
+		}
+	}
+}
+
+func TestRequireCsrf(t *testing.T) {
+	setupAuth(t)
+	session := testSession(t, time.Now().Add(time.Hour))
+
+	tests := []struct {
+		name   string
+		method string
+		token  string
+		code   int
+	}{
+		{"get", http.MethodGet, "csrf", http.StatusMethodNotAllowed},
+		{"missing token", http.MethodPost, "", http.StatusForbidden},
+		{"wrong token", http.MethodPost, "other", http.StatusForbidden},
+		{"right token", http.MethodPost, "csrf", http.StatusOK},
+	}
+
+	for _, test := range tests {
+		called := false
+		handler := requireLogin(requireCsrf(func(w http.ResponseWriter, r *http.Request) {
+			called = true
+		}))
+
+		form := url.Values{"csrf_token": {test.token}}
+		r := httptest.NewRequest(test.method, "/update", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+		w := httptest.NewRecorder()
+		handler(w, withCookie(r, session))
+
+		if w.Code != test.code || called != (test.code == http.StatusOK) {
+			t.Errorf("%v: expected %v, got %v (called %v)", test.name, test.code, w.Code, called)
+		}
+	}
+}
+
+func TestRequireApiAuth(t *testing.T) {
+	setupAuth(t)
+	session := testSession(t, time.Now().Add(time.Hour))
+
+	tests := []struct {
+		name     string
+		method   string
+		username string
+		password string
+		session  *UISession
+		csrf     string
+		code     int
+	}{
+		{"nothing", http.MethodGet, "", "", nil, "", http.StatusUnauthorized},
+		{"basic auth", http.MethodPut, "alice", "correct horse", nil, "", http.StatusOK},
+		{"wrong password", http.MethodGet, "alice", "wrong horse", nil, "", http.StatusUnauthorized},
+		{"cookie read", http.MethodGet, "", "", session, "", http.StatusOK},
+		{"cookie write without csrf", http.MethodPut, "", "", session, "", http.StatusForbidden},
+		{"cookie write wrong csrf", http.MethodPut, "", "", session, "other", http.StatusForbidden},
+		{"cookie write", http.MethodPut, "", "", session, "csrf", http.StatusOK},
+	}
+
+	for _, test := range tests {
+		handler := requireApiAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if currentSession(r).Username != "alice" {
+				t.Errorf("%v: expected alice's session, got %v", test.name, currentSession(r))
+			}
+		}))
+
+		r := withCookie(httptest.NewRequest(test.method, API_PREFIX+"settings", nil), test.session)
+		if test.username != "" {
+			r.SetBasicAuth(test.username, test.password)
+		}
+		if test.csrf != "" {
+			r.Header.Set("X-CSRF-Token", test.csrf)
+		}
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+
+		if w.Code != test.code {
+			t.Errorf("%v: expected %v, got %v", test.name, test.code, w.Code)
+		}
+	}
+}
@@ -0,0 +1,607 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"html/template"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emef/djv_ads"
+	"github.com/golang/glog"
+)
+
+const CAMPAIGNS_TEMPLATE = "campaigns.template.html"
+
+const CAMPAIGN_INCLUDE = "include"
+const CAMPAIGN_EXCLUDE = "exclude"
+
+var (
+	pacingMaxAdjustment = flag.Float64("pacing_max_adjustment", 0.2,
+		"Most pacing scales a campaign's bids by, as a fraction")
+	pacingTolerance = flag.Float64("pacing_tolerance", 0.1,
+		"Pacing leaves campaigns spending within this fraction of their budget's pace alone")
+	performanceMinImpressions = flag.Int64("performance_min_impressions", 1000,
+		"Impressions a campaign needs over the last 7 days before its conversions are used to cap bids")
+)
+
+// Debug mode used to run on these, they're seeded as included campaigns the
+// first time the state is loaded without campaign settings.
+var legacyDebugCampaignIds = []string{
+	"1002279041", "1002279031", "1002279011", "1002279001",
+	"1002278921", "1002278911",
+}
+
+// CampaignSettings override the global settings for one campaign.
+type CampaignSettings struct {
+	Name string
+	// "", CAMPAIGN_INCLUDE or CAMPAIGN_EXCLUDE. Debug mode only runs included
+	// campaigns, otherwise everything but excluded ones runs.
+	Mode string
+	// Replaces the global and geo undercuts when set
+	Undercut *float64
+	// Countries the campaign targets in TJ, its bids are priced in each.
+	// Empty means only US.
+	Countries []string
+	// 0 leaves that side unbounded
+	MinBid float64
+	MaxBid float64
+	// Minutes between runs, 0 uses the global RunEvery
+	RunEvery int
+	// Scale bids to spread the daily budget over the day
+	Pacing bool
+	// Cap bids at what these can afford, 0 for no target. ROAS needs what a
+	// conversion is worth.
+	TargetCpa       float64
+	TargetRoas      float64
+	ConversionValue float64
+	// Zone the schedule's hours are in, "" for Pacific
+	Timezone string
+	// Dayparting schedule, campaigns run as above outside of every window
+	Windows []*DaypartWindow
+}
+
+func (settings *CampaignSettings) isDefault() bool {
+	return settings.Mode == "" && settings.Undercut == nil && len(settings.Countries) == 0 &&
+		settings.MinBid == 0 && settings.MaxBid == 0 && settings.RunEvery == 0 &&
+		settings.Timezone == "" && len(settings.Windows) == 0 && !settings.Pacing &&
+		settings.TargetCpa == 0 && settings.TargetRoas == 0 && settings.ConversionValue == 0
+}
+
+func (settings *CampaignSettings) hasPerformanceTarget() bool {
+	return settings.TargetCpa > 0 || settings.TargetRoas > 0
+}
+
+func (settings *CampaignSettings) validate() error {
+	if settings.Mode != "" && settings.Mode != CAMPAIGN_INCLUDE &&
+		settings.Mode != CAMPAIGN_EXCLUDE {
+		return fmt.Errorf("unknown mode %q", settings.Mode)
+	}
+
+	if settings.Undercut != nil && *settings.Undercut < 0 {
+		return fmt.Errorf("undercut must not be negative")
+	}
+
+	for _, countryCode := range settings.Countries {
+		if countryCode == "" || strings.ContainsAny(countryCode, "=, ") {
+			return fmt.Errorf("invalid country code %q", countryCode)
+		}
+	}
+
+	if settings.MinBid < 0 || settings.MaxBid < 0 {
+		return fmt.Errorf("bid limits must not be negative")
+	}
+
+	if settings.MaxBid > 0 && settings.MinBid > settings.MaxBid {
+		return fmt.Errorf("min bid %v is above max bid %v", settings.MinBid, settings.MaxBid)
+	}
+
+	if settings.RunEvery < 0 {
+		return fmt.Errorf("run every must not be negative")
+	}
+
+	if settings.TargetCpa < 0 || settings.TargetRoas < 0 || settings.ConversionValue < 0 {
+		return fmt.Errorf("performance targets must not be negative")
+	}
+
+	if settings.TargetRoas > 0 && settings.ConversionValue == 0 {
+		return fmt.Errorf("target ROAS needs a conversion value")
+	}
+
+	if settings.Timezone != "" {
+		if _, err := time.LoadLocation(settings.Timezone); err != nil {
+			return fmt.Errorf("unknown timezone %q", settings.Timezone)
+		}
+	}
+
+	for _, window := range settings.Windows {
+		if err := window.validate(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// runEvery is how many minutes apart a campaign should be run.
+func (state *State) runEvery(campaignId string) int {
+	if settings, ok := state.Campaigns[campaignId]; ok && settings.RunEvery > 0 {
+		return settings.RunEvery
+	}
+
+	return state.RunEvery
+}
+
+// shortestRunEvery is how often the scheduler needs to wake up so every
+// campaign gets run on time.
+func (state *State) shortestRunEvery() int {
+	shortest := state.RunEvery
+	for _, settings := range state.Campaigns {
+		if settings.Mode != CAMPAIGN_EXCLUDE && settings.RunEvery > 0 &&
+			(shortest <= 0 || settings.RunEvery < shortest) {
+			shortest = settings.RunEvery
+		}
+	}
+
+	return shortest
+}
+
+// automates reports whether runs touch the campaign at all.
+func (state *State) automates(campaignId string) bool {
+	mode := ""
+	if settings, ok := state.Campaigns[campaignId]; ok {
+		mode = settings.Mode
+	}
+
+	if state.DebugEnabled == ENABLED {
+		return mode == CAMPAIGN_INCLUDE
+	}
+
+	return mode != CAMPAIGN_EXCLUDE
+}
+
+func (state *State) includedCampaignIds() []string {
+	campaignIds := make([]string, 0)
+	for campaignId, settings := range state.Campaigns {
+		if settings.Mode == CAMPAIGN_INCLUDE {
+			campaignIds = append(campaignIds, campaignId)
+		}
+	}
+
+	sort.Strings(campaignIds)
+	return campaignIds
+}
+
+// migrateDebugWhitelist moves the old hardcoded debug campaigns into the
+// campaign settings.
+func migrateDebugWhitelist(state *State) bool {
+	if state.Campaigns != nil {
+		return false
+	}
+
+	state.Campaigns = make(map[string]*CampaignSettings)
+	if state.DebugEnabled == ENABLED {
+		for _, campaignId := range legacyDebugCampaignIds {
+			state.Campaigns[campaignId] = &CampaignSettings{Mode: CAMPAIGN_INCLUDE}
+		}
+	}
+
+	return true
+}
+
+// campaignRunTimes remembers when each campaign was last run, so campaigns
+// with a longer RunEvery than the scheduler's can sit runs out.
+type campaignRunTimes struct {
+	mu      sync.Mutex
+	lastRun map[string]time.Time
+}
+
+var campaignRuns = &campaignRunTimes{lastRun: make(map[string]time.Time)}
+
+func (runTimes *campaignRunTimes) record(campaignIds []string, at time.Time) {
+	runTimes.mu.Lock()
+	defer runTimes.mu.Unlock()
+
+	for _, campaignId := range campaignIds {
+		runTimes.lastRun[campaignId] = at
+	}
+}
+
+func (runTimes *campaignRunTimes) get(campaignId string) time.Time {
+	runTimes.mu.Lock()
+	defer runTimes.mu.Unlock()
+
+	return runTimes.lastRun[campaignId]
+}
+
+// notDue lists the campaigns run too recently to be run again. Scheduled
+// runs can come early by the jitter, so that much slack is allowed.
+func (runTimes *campaignRunTimes) notDue(state *State, now time.Time) []string {
+	runTimes.mu.Lock()
+	defer runTimes.mu.Unlock()
+
+	campaignIds := make([]string, 0)
+	for campaignId, lastRun := range runTimes.lastRun {
+		interval := time.Duration(state.runEvery(campaignId)) * time.Minute
+		due := time.Duration(float64(interval)*(1-*runJitter)) - time.Minute
+		if now.Sub(lastRun) < due {
+			campaignIds = append(campaignIds, campaignId)
+		}
+	}
+
+	return campaignIds
+}
+
+// campaignOptions applies the per campaign settings and where each campaign
+// is in its schedule. It returns false when there's nothing to run.
+func campaignOptions(state *State, force bool, plan *daypartPlan) ([]djv_ads.Option, bool) {
+	opts := make([]djv_ads.Option, 0)
+
+	if state.DebugEnabled == ENABLED {
+		campaignIds := state.includedCampaignIds()
+		if len(campaignIds) == 0 {
+			glog.Infof("Debug mode is on but no campaigns are included")
+			return nil, false
+		}
+
+		glog.Infof("Only running included campaigns %v", campaignIds)
+		opts = append(opts, djv_ads.WithCampaignWhitelist(campaignIds...))
+	}
+
+	// Malformed values were rejected when they were saved
+	geoUndercuts, _ := parseCountryAmounts(state.GeoUndercuts)
+
+	excluded := make([]string, 0)
+	for campaignId, settings := range state.Campaigns {
+		if settings.Mode == CAMPAIGN_EXCLUDE {
+			excluded = append(excluded, campaignId)
+			continue
+		}
+
+		if len(settings.Countries) > 0 {
+			opts = append(opts, djv_ads.WithCampaignCountries(campaignId, settings.Countries...))
+		}
+
+		// The window that just ended puts bids back at its baseline first
+		if baseline, ok := plan.reverts[campaignId]; ok {
+			glog.Infof("Reverting campaign %v to its baseline bid %v", campaignId, baseline)
+			opts = append(opts, djv_ads.WithCampaignStrategy(
+				campaignId, djv_ads.NewFixedBidStrategy(baseline)))
+			continue
+		}
+
+		window := plan.windows[campaignId]
+		if window != nil && window.Pause {
+			excluded = append(excluded, campaignId)
+			continue
+		}
+
+		undercut, targetPosition := settings.Undercut, state.TargetPosition
+		minBid, maxBid := settings.MinBid, settings.MaxBid
+		if window != nil {
+			if window.Undercut != nil {
+				undercut = window.Undercut
+			}
+			if window.TargetPosition != nil {
+				targetPosition = *window.TargetPosition
+			}
+			if window.MinBid > 0 || window.MaxBid > 0 {
+				minBid, maxBid = window.MinBid, window.MaxBid
+			}
+		}
+
+		if undercut != nil || targetPosition != state.TargetPosition || settings.Pacing ||
+			settings.hasPerformanceTarget() {
+
+			// The campaign's own undercut replaces the geo ones too
+			countryUndercuts := map[string]float64(nil)
+			if undercut == nil {
+				undercut, countryUndercuts = &state.Undercut, geoUndercuts
+			}
+
+			strategy := newStrategy(targetPosition, *undercut, countryUndercuts)
+			if settings.Pacing {
+				strategy = djv_ads.NewPacingStrategy(strategy, *pacingMaxAdjustment, *pacingTolerance)
+			}
+
+			// Last, so nothing raises bids back over the cap
+			if settings.hasPerformanceTarget() {
+				strategy = djv_ads.NewPerformanceStrategy(strategy, settings.TargetCpa,
+					settings.TargetRoas, settings.ConversionValue, *performanceMinImpressions)
+			}
+			opts = append(opts, djv_ads.WithCampaignStrategy(campaignId, strategy))
+		}
+
+		if minBid > 0 || maxBid > 0 {
+			opts = append(opts, djv_ads.WithCampaignBidLimit(campaignId, minBid, maxBid))
+		}
+	}
+
+	if !force {
+		notDue := make([]string, 0)
+		for _, campaignId := range campaignRuns.notDue(state, time.Now()) {
+			if _, ok := plan.reverts[campaignId]; !ok {
+				notDue = append(notDue, campaignId)
+			}
+		}
+
+		if len(notDue) > 0 {
+			glog.Infof("Skipping %v campaigns that aren't due yet", len(notDue))
+		}
+		excluded = append(excluded, notDue...)
+	}
+
+	opts = append(opts, djv_ads.WithoutCampaigns(excluded...))
+	return opts, true
+}
+
+// newStrategy is the strategy the global settings pick, with a different
+// target position or undercut. Country undercuts only mean something to the
+// undercut strategy, checkGeoUndercuts keeps them away from positions.
+func newStrategy(
+	targetPosition int, undercut float64, countryUndercuts map[string]float64) djv_ads.BidStrategy {
+
+	if targetPosition > 0 {
+		return djv_ads.NewPositionStrategy(targetPosition, undercut)
+	}
+
+	strategy := djv_ads.NewUndercutStrategy(undercut)
+	for countryCode, amount := range countryUndercuts {
+		strategy.CountryAmounts[countryCode] = amount
+	}
+
+	return strategy
+}
+
+// checkGeoUndercuts rejects geo undercuts alongside a target position, global
+// or in a schedule window, which would quietly ignore them.
+func (state *State) checkGeoUndercuts() error {
+	if strings.TrimSpace(state.GeoUndercuts) == "" {
+		return nil
+	}
+
+	if state.TargetPosition > 0 {
+		return fmt.Errorf("geo undercuts can't be used with a target position")
+	}
+
+	for campaignId, settings := range state.Campaigns {
+		for _, window := range settings.Windows {
+			if window.TargetPosition != nil && *window.TargetPosition > 0 &&
+				settings.Undercut == nil && window.Undercut == nil {
+
+				return fmt.Errorf("geo undercuts can't be used with campaign %v's "+
+					"position=%v window", campaignId, *window.TargetPosition)
+			}
+		}
+	}
+
+	return nil
+}
+
+type campaignRow struct {
+	CampaignId string
+	Name       string
+	Status     string
+	Settings   *CampaignSettings
+	LastRun    time.Time
+	// Today's and the recent days', nil when TJ didn't list them
+	Stats       *djv_ads.CampaignStats
+	RecentStats *djv_ads.CampaignStats
+	// The schedule as edited, and the window the campaign is in now
+	Schedule     string
+	ActiveWindow string
+}
+
+func handleCampaigns(client djv_ads.TJClient) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		campaignsTemplatePath := path.Join(*templatesDir, CAMPAIGNS_TEMPLATE)
+		template, err := template.New(CAMPAIGNS_TEMPLATE).Funcs(templateFuncs).ParseFiles(
+			campaignsTemplatePath)
+		if err != nil {
+			handleError(w, fmt.Sprintf("couldn't read template %s: %v",
+				campaignsTemplatePath, err))
+			return
+		}
+
+		state, err := getState(*statePath)
+		if err != nil {
+			handleStateError(w, err)
+			return
+		}
+
+		// Still show the saved settings if TJ can't be reached
+		listError := ""
+		campaignJsons, err := client.GetAllCampaigns(r.Context())
+		if err != nil {
+			glog.Errorf("Error listing campaigns: %v", err)
+			listError = err.Error()
+		}
+
+		now := time.Now()
+		campaignStats, err := client.GetCampaignStats(r.Context(), now, now)
+		if err != nil {
+			glog.Errorf("Error getting campaign stats: %v", err)
+		}
+
+		recentStats, err := client.GetCampaignStats(
+			r.Context(), now.AddDate(0, 0, 1-djv_ads.RecentStatsDays), now)
+		if err != nil {
+			glog.Errorf("Error getting recent campaign stats: %v", err)
+		}
+
+		rows := make([]*campaignRow, 0, len(campaignJsons))
+		seen := make(map[string]bool)
+		for _, campaignJson := range campaignJsons {
+			campaignId := strconv.Itoa(int(campaignJson.CampaignId))
+			seen[campaignId] = true
+			row := newCampaignRow(state, campaignId, campaignJson.Name, campaignJson.Status)
+			row.Stats = campaignStats[campaignId]
+			row.RecentStats = recentStats[campaignId]
+			rows = append(rows, row)
+		}
+
+		for campaignId, settings := range state.Campaigns {
+			if !seen[campaignId] {
+				rows = append(rows, newCampaignRow(state, campaignId, settings.Name, "unknown"))
+			}
+		}
+
+		sort.Slice(rows, func(i, j int) bool {
+			if (rows[i].Status == "active") != (rows[j].Status == "active") {
+				return rows[i].Status == "active"
+			}
+			return rows[i].Name < rows[j].Name
+		})
+
+		context := struct {
+			State     *State
+			Campaigns []*campaignRow
+			Error     string
+			Session   *UISession
+		}{state, rows, listError, currentSession(r)}
+
+		template.Execute(w, context)
+	}
+}
+
+func newCampaignRow(state *State, campaignId, name, status string) *campaignRow {
+	settings, ok := state.Campaigns[campaignId]
+	if !ok {
+		settings = &CampaignSettings{}
+	}
+
+	activeWindow := ""
+	if window := settings.activeWindow(time.Now()); window != nil {
+		activeWindow = window.key()
+	}
+
+	return &campaignRow{
+		CampaignId:   campaignId,
+		Name:         name,
+		Status:       status,
+		Settings:     settings,
+		LastRun:      campaignRuns.get(campaignId),
+		Schedule:     formatWindows(settings.Windows),
+		ActiveWindow: activeWindow,
+	}
+}
+
+// handleCampaignsUpdate saves the settings of every campaign in the form,
+// leaving the rest as they were.
+func handleCampaignsUpdate(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		handleError(w, fmt.Sprintf("could not parse form: %v", err))
+		return
+	}
+
+	campaigns := make(map[string]*CampaignSettings)
+	for _, campaignId := range r.PostForm["campaign_id"] {
+		settings, err := parseCampaignSettings(r, campaignId)
+		if err != nil {
+			handleError(w, fmt.Sprintf("campaign %v: %v", campaignId, err))
+			return
+		}
+
+		campaigns[campaignId] = settings
+	}
+
+	var invalid error
+	_, err := updateState(*statePath, func(state *State) error {
+		if state.Campaigns == nil {
+			state.Campaigns = make(map[string]*CampaignSettings)
+		}
+
+		for campaignId, settings := range campaigns {
+			if settings.isDefault() {
+				delete(state.Campaigns, campaignId)
+			} else {
+				state.Campaigns[campaignId] = settings
+			}
+		}
+
+		invalid = state.checkGeoUndercuts()
+		return invalid
+	})
+	if invalid != nil {
+		handleError(w, invalid.Error())
+		return
+	} else if err != nil {
+		handleStateError(w, err)
+		return
+	}
+
+	glog.Infof("%v updated campaign settings", currentSession(r).Username)
+	scheduler.SettingsChanged()
+	http.Redirect(w, r, "/campaigns", http.StatusFound)
+}
+
+func parseCampaignSettings(r *http.Request, campaignId string) (*CampaignSettings, error) {
+	field := func(name string) string {
+		return strings.TrimSpace(r.PostFormValue(name + "_" + campaignId))
+	}
+
+	settings := &CampaignSettings{
+		Name:     field("name"),
+		Mode:     field("mode"),
+		Timezone: field("timezone"),
+		Pacing:   field("pacing") != "",
+	}
+
+	for _, countryCode := range strings.Split(field("countries"), ",") {
+		if countryCode = strings.ToUpper(strings.TrimSpace(countryCode)); countryCode != "" {
+			settings.Countries = append(settings.Countries, countryCode)
+		}
+	}
+
+	if undercutStr := field("undercut"); undercutStr != "" {
+		undercut, err := strconv.ParseFloat(undercutStr, 64)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse undercut: %v", undercutStr)
+		}
+		settings.Undercut = &undercut
+	}
+
+	amounts := []struct {
+		name  string
+		value *float64
+	}{
+		{"minbid", &settings.MinBid},
+		{"maxbid", &settings.MaxBid},
+		{"targetcpa", &settings.TargetCpa},
+		{"targetroas", &settings.TargetRoas},
+		{"conversionvalue", &settings.ConversionValue},
+	}
+
+	for _, amount := range amounts {
+		if amountStr := field(amount.name); amountStr != "" {
+			parsed, err := strconv.ParseFloat(amountStr, 64)
+			if err != nil {
+				return nil, fmt.Errorf("could not parse %v: %v", amount.name, amountStr)
+			}
+			*amount.value = parsed
+		}
+	}
+
+	if runEveryStr := field("runevery"); runEveryStr != "" {
+		runEvery, err := strconv.Atoi(runEveryStr)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse run every: %v", runEveryStr)
+		}
+		settings.RunEvery = runEvery
+	}
+
+	windows, err := parseWindows(field("schedule"))
+	if err != nil {
+		return nil, fmt.Errorf("could not parse schedule: %v", err)
+	}
+	if len(windows) > 0 {
+		settings.Windows = windows
+	}
+
+	return settings, settings.validate()
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/emef/djv_ads"
+)
+
+func TestCheckGeoUndercuts(t *testing.T) {
+	position := 2
+	undercut := 0.005
+	tests := []struct {
+		name  string
+		state *State
+		ok    bool
+	}{
+		{"no geo undercuts", &State{TargetPosition: 3}, true},
+		{"geo undercuts", &State{GeoUndercuts: "CA=0.002"}, true},
+		{"with a target position", &State{GeoUndercuts: "CA=0.002", TargetPosition: 3}, false},
+		{"with a position window", &State{
+			GeoUndercuts: "CA=0.002",
+			Campaigns: map[string]*CampaignSettings{
+				"1": {Windows: []*DaypartWindow{{TargetPosition: &position}}},
+			},
+		}, false},
+		{"with a campaign undercut", &State{
+			GeoUndercuts: "CA=0.002",
+			Campaigns: map[string]*CampaignSettings{
+				"1": {Undercut: &undercut, Windows: []*DaypartWindow{{TargetPosition: &position}}},
+			},
+		}, true},
+	}
+
+	for _, test := range tests {
+		if err := test.state.checkGeoUndercuts(); (err == nil) != test.ok {
+			t.Errorf("%v: expected ok=%v, got %v", test.name, test.ok, err)
+		}
+	}
+}
+
+func TestNewStrategyKeepsGeoUndercuts(t *testing.T) {
+	strategy, ok := newStrategy(0, 0.001, map[string]float64{"CA": 0.002}).(*djv_ads.UndercutStrategy)
+	if !ok || strategy.CountryAmounts["CA"] != 0.002 {
+		t.Errorf("expected an undercut strategy with the CA undercut, got %+v", strategy)
+	}
+
+	if _, ok := newStrategy(2, 0.001, nil).(*djv_ads.PositionStrategy); !ok {
+		t.Errorf("expected a position strategy")
+	}
+}
+
+func TestParseCampaignCountries(t *testing.T) {
+	form := url.Values{"countries_1": {"us, ca,"}}
+	r := httptest.NewRequest(http.MethodPost, "/campaigns/update", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	settings, err := parseCampaignSettings(r, "1")
+	if err != nil || strings.Join(settings.Countries, ",") != "US,CA" {
+		t.Errorf("expected countries US and CA, got %v %v", settings, err)
+	}
+
+	settings = &CampaignSettings{Countries: []string{"US", "C A"}}
+	if err := settings.validate(); err == nil {
+		t.Errorf("expected an invalid country code to be rejected")
+	}
+}
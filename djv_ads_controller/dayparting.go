@@ -0,0 +1,329 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emef/djv_ads"
+	"github.com/golang/glog"
+)
+
+// DaypartWindow changes how a campaign is run during part of the week. The
+// first window that matches wins.
+type DaypartWindow struct {
+	// Like "mon-fri", "sat,sun" or "daily"
+	Days string
+	// Like "20:00-02:00", in the campaign's time zone
+	Hours string
+	// Leave the campaign alone for the whole window
+	Pause bool
+	// Replace the campaign's undercut or target position when set, position
+	// 0 going back to undercutting the top bid
+	Undercut       *float64
+	TargetPosition *int
+	// Replace the campaign's bid limits when set
+	MinBid float64
+	MaxBid float64
+	// Bids are set to this when the window ends, 0 leaves them be
+	BaselineBid float64
+}
+
+func (window *DaypartWindow) key() string {
+	return window.Days + " " + window.Hours
+}
+
+func (window *DaypartWindow) daypart() (*djv_ads.Daypart, error) {
+	return djv_ads.ParseDaypart(window.Days, window.Hours)
+}
+
+func (window *DaypartWindow) validate() error {
+	if _, err := window.daypart(); err != nil {
+		return fmt.Errorf("window %q: %v", window.key(), err)
+	}
+
+	if window.Undercut != nil && *window.Undercut < 0 {
+		return fmt.Errorf("window %q: undercut must not be negative", window.key())
+	}
+
+	if window.TargetPosition != nil && *window.TargetPosition < 0 {
+		return fmt.Errorf("window %q: position must not be negative", window.key())
+	}
+
+	if window.MinBid < 0 || window.MaxBid < 0 || window.BaselineBid < 0 {
+		return fmt.Errorf("window %q: bids must not be negative", window.key())
+	}
+
+	if window.MaxBid > 0 && window.MinBid > window.MaxBid {
+		return fmt.Errorf("window %q: min bid %v is above max bid %v",
+			window.key(), window.MinBid, window.MaxBid)
+	}
+
+	return nil
+}
+
+func (window *DaypartWindow) String() string {
+	fields := []string{window.Days, window.Hours}
+	if window.Pause {
+		fields = append(fields, "pause")
+	}
+	if window.Undercut != nil {
+		fields = append(fields, fmt.Sprintf("undercut=%v", *window.Undercut))
+	}
+	if window.TargetPosition != nil {
+		fields = append(fields, fmt.Sprintf("position=%v", *window.TargetPosition))
+	}
+	if window.MinBid > 0 {
+		fields = append(fields, fmt.Sprintf("min=%v", window.MinBid))
+	}
+	if window.MaxBid > 0 {
+		fields = append(fields, fmt.Sprintf("max=%v", window.MaxBid))
+	}
+	if window.BaselineBid > 0 {
+		fields = append(fields, fmt.Sprintf("baseline=%v", window.BaselineBid))
+	}
+
+	return strings.Join(fields, " ")
+}
+
+// parseWindows reads one window a line, like
+// "mon-fri 20:00-02:00 undercut=0.002 max=0.5 baseline=0.05" or
+// "sat,sun 00:00-24:00 pause".
+func parseWindows(text string) ([]*DaypartWindow, error) {
+	windows := make([]*DaypartWindow, 0)
+	for _, line := range strings.Split(text, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("expected days and hours, got %q", line)
+		}
+
+		window := &DaypartWindow{Days: fields[0], Hours: fields[1]}
+		for _, field := range fields[2:] {
+			if field == "pause" {
+				window.Pause = true
+				continue
+			}
+
+			parts := strings.SplitN(field, "=", 2)
+			if len(parts) != 2 {
+				return nil, fmt.Errorf("expected name=value, got %q", field)
+			}
+
+			if parts[0] == "position" {
+				position, err := strconv.Atoi(parts[1])
+				if err != nil {
+					return nil, fmt.Errorf("could not parse position: %v", parts[1])
+				}
+				window.TargetPosition = &position
+				continue
+			}
+
+			value, err := strconv.ParseFloat(parts[1], 64)
+			if err != nil {
+				return nil, fmt.Errorf("could not parse %v: %v", parts[0], parts[1])
+			}
+
+			switch parts[0] {
+			case "undercut":
+				window.Undercut = &value
+			case "min":
+				window.MinBid = value
+			case "max":
+				window.MaxBid = value
+			case "baseline":
+				window.BaselineBid = value
+			default:
+				return nil, fmt.Errorf("unknown setting %q", parts[0])
+			}
+		}
+
+		if err := window.validate(); err != nil {
+			return nil, err
+		}
+		windows = append(windows, window)
+	}
+
+	return windows, nil
+}
+
+func formatWindows(windows []*DaypartWindow) string {
+	lines := make([]string, 0, len(windows))
+	for _, window := range windows {
+		lines = append(lines, window.String())
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+func (settings *CampaignSettings) location() *time.Location {
+	if settings.Timezone == "" {
+		return djv_ads.Pacific
+	}
+
+	// Checked when the settings were saved
+	location, err := time.LoadLocation(settings.Timezone)
+	if err != nil {
+		glog.Errorf("Bad timezone %q, using Pacific: %v", settings.Timezone, err)
+		return djv_ads.Pacific
+	}
+
+	return location
+}
+
+// activeWindow is the window the campaign is in at now, nil for none.
+func (settings *CampaignSettings) activeWindow(now time.Time) *DaypartWindow {
+	local := now.In(settings.location())
+	for _, window := range settings.Windows {
+		daypart, err := window.daypart()
+		if err == nil && daypart.Contains(local) {
+			return window
+		}
+	}
+
+	return nil
+}
+
+func (settings *CampaignSettings) windowByKey(key string) *DaypartWindow {
+	for _, window := range settings.Windows {
+		if window.key() == key {
+			return window
+		}
+	}
+
+	return nil
+}
+
+// daypartPlan is where each scheduled campaign stands in its schedule for a
+// run.
+type daypartPlan struct {
+	// The window each campaign is in, missing when it's in none
+	windows map[string]*DaypartWindow
+	// Baselines for the campaigns whose window ended since their last run
+	reverts map[string]float64
+	// Window keys as of the last run, and as of this one
+	previous map[string]string
+	current  map[string]string
+}
+
+func planDayparts(state *State, now time.Time) *daypartPlan {
+	previous, err := store.GetActiveWindows()
+	if err != nil {
+		glog.Errorf("Error reading active windows: %v", err)
+	}
+
+	return newDaypartPlan(state, previous, now)
+}
+
+func newDaypartPlan(state *State, previous map[string]string, now time.Time) *daypartPlan {
+	plan := &daypartPlan{
+		windows:  make(map[string]*DaypartWindow),
+		reverts:  make(map[string]float64),
+		previous: previous,
+		current:  make(map[string]string),
+	}
+
+	for campaignId, settings := range state.Campaigns {
+		if len(settings.Windows) == 0 || !state.automates(campaignId) {
+			continue
+		}
+
+		key := ""
+		if window := settings.activeWindow(now); window != nil {
+			plan.windows[campaignId] = window
+			key = window.key()
+		}
+		plan.current[campaignId] = key
+
+		previousKey := previous[campaignId]
+		if previousKey == "" || previousKey == key {
+			continue
+		}
+
+		// The window may have been edited away since
+		if ended := settings.windowByKey(previousKey); ended != nil && ended.BaselineBid > 0 {
+			plan.reverts[campaignId] = ended.BaselineBid
+		}
+	}
+
+	return plan
+}
+
+// save remembers each campaign's window for the next run. Reverts that
+// didn't happen are kept pending.
+func (plan *daypartPlan) save(result *djv_ads.RunResult) {
+	plan.settle(result)
+	if err := store.PutActiveWindows(plan.current); err != nil {
+		glog.Errorf("Error saving active windows: %v", err)
+	}
+}
+
+// settle keeps a campaign in its previous window until the run has left all
+// of its bids at the baseline. Held back, failed or merely proposed updates
+// don't count.
+func (plan *daypartPlan) settle(result *djv_ads.RunResult) {
+	applied := make(map[string]float64)
+	for _, update := range result.Applied {
+		applied[update.CampaignId+"/"+update.BidId] = update.NewBid
+	}
+
+	for campaignId, baseline := range plan.reverts {
+		var campaign *djv_ads.Campaign
+		if result.AccountState != nil {
+			campaign = result.AccountState.Campaigns[campaignId]
+		}
+
+		reverted := campaign != nil
+		if campaign != nil {
+			for _, bid := range campaign.Bids {
+				amount, ok := applied[campaignId+"/"+bid.BidId]
+				if !ok {
+					amount = bid.BidAmount
+				}
+
+				if math.Abs(amount-baseline) >= 0.0001 {
+					reverted = false
+					break
+				}
+			}
+		}
+
+		if !reverted {
+			plan.current[campaignId] = plan.previous[campaignId]
+		}
+	}
+}
+
+// nextWindowEnd is when the earliest of the windows campaigns are in now
+// ends, zero when none are in one.
+func (state *State) nextWindowEnd(now time.Time) time.Time {
+	var earliest time.Time
+	for campaignId, settings := range state.Campaigns {
+		if len(settings.Windows) == 0 || !state.automates(campaignId) {
+			continue
+		}
+
+		local := now.In(settings.location())
+		window := settings.activeWindow(now)
+		if window == nil {
+			continue
+		}
+
+		// Checked when the settings were saved
+		daypart, err := window.daypart()
+		if err != nil {
+			continue
+		}
+
+		if end := daypart.EndAfter(local); earliest.IsZero() || end.Before(earliest) {
+			earliest = end
+		}
+	}
+
+	return earliest
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/emef/djv_ads"
+)
+
+func TestParseWindows(t *testing.T) {
+	windows, err := parseWindows(`
+mon-fri 20:00-02:00 undercut=0.002 max=0.5 baseline=0.05
+sat,sun 00:00-24:00 pause
+daily 06:00-09:00 position=2`)
+	if err != nil {
+		t.Fatalf("parsing windows: %v", err)
+	}
+
+	if len(windows) != 3 {
+		t.Fatalf("expected 3 windows, got %v", len(windows))
+	}
+
+	evening := windows[0]
+	if evening.Undercut == nil || *evening.Undercut != 0.002 || evening.MaxBid != 0.5 ||
+		evening.BaselineBid != 0.05 || evening.Pause {
+		t.Errorf("evening window is %v", evening)
+	}
+
+	if !windows[1].Pause {
+		t.Errorf("weekend window is %v, expected a pause", windows[1])
+	}
+
+	if windows[2].TargetPosition == nil || *windows[2].TargetPosition != 2 {
+		t.Errorf("morning window is %v, expected position 2", windows[2])
+	}
+
+	// Formatting reads back the same
+	reparsed, err := parseWindows(formatWindows(windows))
+	if err != nil || formatWindows(reparsed) != formatWindows(windows) {
+		t.Errorf("windows didn't survive formatting: %v %q", err, formatWindows(reparsed))
+	}
+
+	for _, bad := range []string{
+		"mon-fri",
+		"funday 20:00-02:00",
+		"daily 20:00",
+		"daily 20:00-02:00 undercut=lots",
+		"daily 20:00-02:00 colour=blue",
+		"daily 20:00-02:00 min=0.5 max=0.1",
+	} {
+		if _, err := parseWindows(bad); err == nil {
+			t.Errorf("expected %q to be rejected", bad)
+		}
+	}
+}
+
+func daypartState(t *testing.T) *State {
+	windows, err := parseWindows("fri-sun 20:00-02:00 undercut=0.002 baseline=0.05")
+	if err != nil {
+		t.Fatalf("parsing windows: %v", err)
+	}
+
+	return &State{
+		Campaigns: map[string]*CampaignSettings{
+			"1": {Windows: windows},
+			"2": {Mode: CAMPAIGN_EXCLUDE, Windows: windows},
+			"3": {},
+		},
+	}
+}
+
+func TestPlanDayparts(t *testing.T) {
+	state := daypartState(t)
+	windowKey := state.Campaigns["1"].Windows[0].key()
+
+	// 2026-10-18 is a Sunday, its window runs into Monday morning
+	sunday := time.Date(2026, 10, 18, 23, 0, 0, 0, djv_ads.Pacific)
+	plan := newDaypartPlan(state, map[string]string{}, sunday)
+	if plan.windows["1"] == nil || plan.current["1"] != windowKey || len(plan.reverts) != 0 {
+		t.Errorf("expected campaign 1 to be in its window: %v %v", plan.current, plan.reverts)
+	}
+
+	if _, ok := plan.current["2"]; ok {
+		t.Errorf("excluded campaign 2 shouldn't be planned")
+	}
+
+	if end := state.nextWindowEnd(sunday); !end.Equal(
+		time.Date(2026, 10, 19, 2, 0, 0, 0, djv_ads.Pacific)) {
+
+		t.Errorf("expected the window to end Monday at 02:00, got %v", end)
+	}
+
+	monday := time.Date(2026, 10, 19, 2, 30, 0, 0, djv_ads.Pacific)
+	plan = newDaypartPlan(state, map[string]string{"1": windowKey}, monday)
+	if plan.windows["1"] != nil || plan.current["1"] != "" || plan.reverts["1"] != 0.05 {
+		t.Errorf("expected campaign 1 to revert to 0.05: %v %v", plan.current, plan.reverts)
+	}
+
+	if end := state.nextWindowEnd(monday); !end.IsZero() {
+		t.Errorf("expected no window to end, got %v", end)
+	}
+}
+
+func TestDaypartRevertsStayPending(t *testing.T) {
+	state := daypartState(t)
+	windowKey := state.Campaigns["1"].Windows[0].key()
+	monday := time.Date(2026, 10, 19, 2, 30, 0, 0, djv_ads.Pacific)
+
+	accountState := &djv_ads.AccountState{
+		Campaigns: map[string]*djv_ads.Campaign{
+			"1": {
+				CampaignId: "1",
+				Bids: map[string]*djv_ads.Bid{
+					"11/US": {BidId: "11", BidAmount: 0.20, CountryCode: "US"},
+					"12/US": {BidId: "12", BidAmount: 0.05, CountryCode: "US"},
+				},
+			},
+		},
+	}
+
+	revert := &djv_ads.BidUpdate{CampaignId: "1", BidId: "11", PreviousBid: 0.20, NewBid: 0.05}
+	results := []struct {
+		name     string
+		result   *djv_ads.RunResult
+		reverted bool
+	}{
+		{"failed run", &djv_ads.RunResult{}, false},
+		{"held back", &djv_ads.RunResult{
+			AccountState: accountState,
+			Skipped:      []*djv_ads.BidUpdate{revert},
+		}, false},
+		{"proposed only", &djv_ads.RunResult{
+			AccountState: accountState,
+			Proposed:     []*djv_ads.BidUpdate{revert},
+		}, false},
+		{"applied", &djv_ads.RunResult{
+			AccountState: accountState,
+			Proposed:     []*djv_ads.BidUpdate{revert},
+			Applied:      []*djv_ads.BidUpdate{revert},
+		}, true},
+	}
+
+	for _, test := range results {
+		plan := newDaypartPlan(state, map[string]string{"1": windowKey}, monday)
+		plan.settle(test.result)
+
+		reverted := plan.current["1"] == ""
+		if reverted != test.reverted {
+			t.Errorf("%v: expected reverted=%v, window is %q", test.name, test.reverted,
+				plan.current["1"])
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
@@ -8,8 +9,14 @@ import (
 	"io"
 	"net/http"
 	"os"
+	"os/signal"
 	"path"
+	"path/filepath"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/emef/djv_ads"
@@ -18,12 +25,19 @@ import (
 
 type State struct {
 	Undercut       float64
+	TargetPosition int
+	GeoUndercuts   string
+	GeoMaxBids     string
 	RunEvery       int
 	DebugEnabled   string
 	Enabled        string
-	StatusBtnClass string
-	StatusText     string
-	LastUpdated    string
+	// Runs only propose updates, which wait for someone to approve them
+	RequireApproval string
+	StatusBtnClass  string
+	StatusText      string
+	LastUpdated     string
+	// Keyed by campaign id
+	Campaigns map[string]*CampaignSettings
 }
 
 const UNDERCUT_DEFAULT = 0.001
@@ -37,6 +51,7 @@ const STATUS_DISABLED_TEXT = "paused"
 const LAST_UPDATED_DEFAULT = "unknown"
 
 const INDEX_TEMPLATE = "index.template.html"
+const SPOT_TEMPLATE = "spot.template.html"
 
 var (
 	readOnly = flag.Bool("readonly", false,
@@ -45,128 +60,537 @@ var (
 		"Path to config file (will create with defaults if missing)")
 	templatesDir = flag.String("templates_dir", "",
 		"Directory containing djv_ads templates")
+	dbPath = flag.String("db_path", "",
+		"Path to the history database (will create if missing)")
 	updatesLogPath = flag.String("updates_path", "",
-		"Path to write update logs to (no logging done if empty)")
+		"Legacy updates log, imported into the database once")
+	runsLogPath = flag.String("runs_path", "",
+		"Legacy run results log, imported into the database once")
 	maxUpdateHistory = flag.Int("max_update_history", 200,
 		"Maximum number of recent updates to show")
+	maxRunHistory = flag.Int("max_run_history", 20,
+		"Maximum number of recent runs to show")
+	updateRetention = flag.Duration("update_retention", 365*24*time.Hour,
+		"Delete bid updates older than this (0 keeps them forever)")
+	maxStoredUpdates = flag.Int("max_stored_updates", 0,
+		"Delete the oldest bid updates beyond this many (0 means no limit)")
+	runRetention = flag.Duration("run_retention", 90*24*time.Hour,
+		"Delete run results older than this (0 keeps them forever)")
+	snapshotRetention = flag.Duration("snapshot_retention", 14*24*time.Hour,
+		"Delete full account snapshots older than this (0 keeps them forever)")
+	spotPriceRetention = flag.Duration("spot_price_retention", 365*24*time.Hour,
+		"Delete spot price history older than this (0 keeps it forever)")
+	runJitter = flag.Float64("run_jitter", 0.1,
+		"Move each scheduled run up to this fraction of the interval earlier or later")
+	proposalRetention = flag.Duration("proposal_retention", 30*24*time.Hour,
+		"Delete decided proposals older than this (0 keeps them forever)")
+	runTimeout = flag.Duration("run_timeout", 10*time.Minute,
+		"Abandon a controller run that takes longer than this")
 )
 
+var store *Store
+var scheduler *Scheduler
+
 func main() {
 	flag.Parse()
 
-	go controllerCron()
+	if *addUser != "" {
+		if err := addUserFromStdin(*usersPath, *addUser, os.Stdin); err != nil {
+			glog.Exitf("Error adding user %v: %v", *addUser, err)
+		}
+		fmt.Fprintf(os.Stderr, "Saved %v to %v\n", *addUser, *usersPath)
+		return
+	}
+
+	if *usersPath == "" {
+		glog.Exitf("-users_path is required")
+	}
+
+	if users, err := readUsers(*usersPath); err != nil || len(users) == 0 {
+		glog.Warningf("No users in %v, nobody can log in until one is added with -add_user",
+			*usersPath)
+	}
+
+	if *dbPath == "" {
+		glog.Exitf("-db_path is required")
+	}
+
+	var err error
+	if guardrails, err = guardrailsFromFlags(); err != nil {
+		glog.Exitf("Invalid guardrails: %v", err)
+	}
+
+	if alerter, err = alerterFromFlags(); err != nil {
+		glog.Exitf("Invalid alerting flags: %v", err)
+	}
+
+	store, err = OpenStore(*dbPath)
+	if err != nil {
+		glog.Exitf("Error opening database %v: %v", *dbPath, err)
+	}
+	defer store.Close()
+
+	if err = store.MigrateLogs(*updatesLogPath, *runsLogPath); err != nil {
+		glog.Exitf("Error importing legacy logs: %v", err)
+	}
+
+	// Stopping the service cancels any run in progress
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if killSwitch, err = NewKillSwitch(); err != nil {
+		glog.Exitf("Error loading kill switch: %v", err)
+	}
+
+	if status := killSwitch.Status(); status.Engaged {
+		glog.Warningf("Kill switch is engaged since %v, bid updates are blocked", status.Since)
+	}
+
+	if *killSwitchFile != "" {
+		go killSwitch.watchFile(ctx, *killSwitchFile, *killSwitchPoll)
+	}
+
+	// One client for every run so the TJ session and rate limiting carry over
+	config := djv_ads.DefaultClientConfig()
+	config.Observer = tjMetrics{}
+	config.OnLoginError = alerter.loginFailed
+	client := killSwitchClient{djv_ads.NewClient(config), killSwitch}
+
+	// Nothing else touches the state yet
+	state, err := getState(*statePath)
+	if err != nil {
+		glog.Exitf("Error reading state: %v", err)
+	}
+
+	if migrateDebugWhitelist(state) {
+		if err := writeState(*statePath, state); err != nil {
+			glog.Exitf("Error saving migrated campaign settings: %v", err)
+		}
+	}
+
+	scheduler = NewScheduler(*runJitter, func(ctx context.Context, requested bool) {
+		runController(ctx, client, requested)
+	})
+	go scheduler.Start(ctx)
+
+	http.HandleFunc("/login", handleLogin)
+	http.HandleFunc("/logout", requireLogin(requireCsrf(handleLogout)))
+	http.HandleFunc("/", requireLogin(handleUI))
+	http.HandleFunc("/update", requireLogin(requireCsrf(handleUpdate)))
+	http.HandleFunc("/run", requireLogin(requireCsrf(handleRunNow)))
+	http.HandleFunc("/campaigns", requireLogin(handleCampaigns(client)))
+	http.HandleFunc("/campaigns/update", requireLogin(requireCsrf(handleCampaignsUpdate)))
+	http.HandleFunc("/proposals", requireLogin(requireCsrf(handleProposals(client))))
+	http.HandleFunc("/rollback", requireLogin(requireCsrf(handleRollback(client))))
+	http.HandleFunc("/killswitch", requireLogin(requireCsrf(handleKillSwitch)))
+	http.HandleFunc("/spot", requireLogin(handleSpot))
+	http.HandleFunc("/spot.json", requireLogin(handleSpotJson))
+	http.Handle(API_PREFIX, requireApiAuth(apiRouter(client)))
+
+	if *metricsAddr != "" {
+		go serveMetrics(ctx, *metricsAddr)
+	}
+
+	server := &http.Server{Addr: ":8081"}
+	go func() {
+		<-ctx.Done()
+		server.Shutdown(context.Background())
+	}()
 
-	http.HandleFunc("/", handleUI)
-	http.HandleFunc("/update", handleUpdate)
-	http.ListenAndServe(":8081", nil)
+	if err := server.ListenAndServe(); err != http.ErrServerClosed {
+		glog.Errorf("Error serving http: %v", err)
+	}
 }
 
-func controllerCron() {
-	for {
-		glog.Infof("Controller cron started")
-		state := getStateOrDefault(*statePath)
+// runController runs every campaign that's due, or every campaign when force
+// is set.
+func runController(ctx context.Context, client djv_ads.TJClient, force bool) {
+	// Engaging the kill switch abandons the run
+	ctx, done, err := killSwitch.guard(ctx)
+	if err != nil {
+		glog.Warningf("Skipping run: %v", err)
+		return
+	}
+	defer done()
 
-		if state.Enabled == ENABLED {
-			glog.Infof("Starting controller cron")
+	state, err := getState(*statePath)
+	if err != nil {
+		glog.Errorf("Skipping run, error reading state: %v", err)
+		return
+	}
 
-			opts := []djv_ads.Option{
-				djv_ads.ReadOnly(*readOnly),
-				djv_ads.UndercutBy(state.Undercut),
-			}
+	requireApproval := state.RequireApproval == ENABLED
+	opts := []djv_ads.Option{
+		djv_ads.ReadOnly(*readOnly || requireApproval),
+		djv_ads.WithRunTimeout(*runTimeout),
+		djv_ads.WithGuardrails(guardrails),
+		djv_ads.WithClient(client),
+	}
 
-			if state.DebugEnabled == ENABLED {
-				glog.Infof("Using static campaign list")
-				opts = append(opts, djv_ads.WithCampaignWhitelist(
-					"1002279041", "1002279031", "1002279011", "1002279001",
-					"1002278921", "1002278911"))
-			}
+	geoUndercuts, err := parseCountryAmounts(state.GeoUndercuts)
+	if err != nil {
+		glog.Errorf("Ignoring malformed geo undercuts: %v", err)
+	}
 
-			controller, err := djv_ads.NewAdsController(opts...)
-			if err != nil {
-				glog.Errorf("Error creating ads controller: %v", err)
-				continue
-			}
+	// Only possible when the state file was edited by hand
+	if err = state.checkGeoUndercuts(); err != nil {
+		glog.Warningf("Ignoring geo undercuts where they don't apply: %v", err)
+	}
 
-			updates := controller.RunOnce()
+	opts = append(opts, djv_ads.WithStrategy(
+		newStrategy(state.TargetPosition, state.Undercut, geoUndercuts)))
 
-			if err = writeUpdatesToLog(*updatesLogPath, updates); err != nil {
-				glog.Errorf("Error writing to updates log file: %v", err)
-			}
+	geoMaxBids, err := parseCountryAmounts(state.GeoMaxBids)
+	if err != nil {
+		glog.Errorf("Ignoring malformed geo max bids: %v", err)
+	}
+
+	for countryCode, maxBid := range geoMaxBids {
+		opts = append(opts, djv_ads.WithCountryBidLimit(countryCode, 0, maxBid))
+	}
+
+	plan := planDayparts(state, time.Now())
+	campaignOpts, ok := campaignOptions(state, force, plan)
+	if !ok {
+		return
+	}
+	opts = append(opts, campaignOpts...)
+
+	controller, err := djv_ads.NewAdsController(opts...)
+	if err != nil {
+		glog.Errorf("Error creating ads controller: %v", err)
+		return
+	}
 
-			state := getStateOrDefault(*statePath)
-			state.LastUpdated = time.Now().In(djv_ads.Pacific).Format(djv_ads.TimeFormat)
-			writeState(*statePath, state)
-		} else {
-			glog.Infof("Controller disabled, skipping run")
+	result := controller.RunOnce(ctx)
+	recordRunMetrics(result)
+	reportGuardrailTrips(result)
+	alerter.recordRun(result)
+	plan.save(result)
+
+	if err = store.AddUpdates(result.Applied, result.EndTime); err != nil {
+		glog.Errorf("Error storing updates: %v", err)
+	}
+
+	if err = store.AddRun(result); err != nil {
+		glog.Errorf("Error storing run result: %v", err)
+	}
+
+	// Dry runs with -readonly don't ask for approval
+	if requireApproval && !*readOnly {
+		storeProposals(result)
+	}
+
+	if result.AccountState != nil {
+		previous, err := store.LatestSnapshot()
+		if err != nil {
+			glog.Errorf("Error reading previous snapshot: %v", err)
+		}
+		alerter.checkCompetitorBids(previous, result.AccountState)
+
+		if err = store.AddSnapshot(result.AccountState); err != nil {
+			glog.Errorf("Error storing account snapshot: %v", err)
+		}
+
+		campaignIds := make([]string, 0, len(result.AccountState.Campaigns))
+		for campaignId := range result.AccountState.Campaigns {
+			campaignIds = append(campaignIds, campaignId)
 		}
+		campaignRuns.record(campaignIds, result.EndTime)
+	}
 
-		glog.Infof("Finished Controller cron")
-		time.Sleep(time.Duration(state.RunEvery) * time.Minute)
+	pruneHistory()
+
+	// Settings may have changed during the run
+	_, err = updateState(*statePath, func(state *State) error {
+		state.LastUpdated = result.EndTime.In(djv_ads.Pacific).Format(djv_ads.TimeFormat)
+		return nil
+	})
+	if err != nil {
+		glog.Errorf("Error saving last updated time: %v", err)
 	}
 }
 
 func handleUI(w http.ResponseWriter, r *http.Request) {
 	indexTemplatePath := path.Join(*templatesDir, INDEX_TEMPLATE)
-	template, err := template.ParseFiles(indexTemplatePath)
+	template, err := template.New(INDEX_TEMPLATE).Funcs(templateFuncs).ParseFiles(
+		indexTemplatePath)
 	if err != nil {
 		handleError(w, fmt.Sprintf("couldn't read template %s: %v",
 			indexTemplatePath, err))
 		return
 	}
 
-	state := getStateOrDefault(*statePath)
-	updates, err := readUpdatesLog(*updatesLogPath)
+	state, err := getState(*statePath)
+	if err != nil {
+		handleStateError(w, err)
+		return
+	}
+
+	updates, err := store.ListUpdates(UpdateQuery{Limit: *maxUpdateHistory})
+	if err != nil {
+		glog.Errorf("Error reading updates :%v", err)
+	}
+
+	runs, err := store.ListRuns(*maxRunHistory, 0)
 	if err != nil {
-		glog.Errorf("Error reading updates log file :%v", err)
+		glog.Errorf("Error reading runs :%v", err)
 	}
 
-	// reverse updates so newest at top
-	for i, j := 0, len(updates)-1; i < j; i, j = i+1, j-1 {
-		updates[i], updates[j] = updates[j], updates[i]
+	proposals, err := store.ListProposals(PROPOSAL_PENDING, 0)
+	if err != nil {
+		glog.Errorf("Error reading proposals :%v", err)
 	}
 
-	if len(updates) > *maxUpdateHistory {
-		updates = updates[:*maxUpdateHistory]
+	auditEvents, err := store.ListAuditEvents(10)
+	if err != nil {
+		glog.Errorf("Error reading audit events :%v", err)
 	}
 
 	context := struct {
-		State   *State
-		Updates []*djv_ads.BidUpdate
-	}{state, updates}
+		State       *State
+		Updates     []*StoredUpdate
+		Runs        []*djv_ads.RunResult
+		Proposals   []*Proposal
+		Session     *UISession
+		Schedule    ScheduleStatus
+		KillSwitch  KillSwitchState
+		AuditEvents []*AuditEvent
+	}{state, updates, runs, proposals, currentSession(r), scheduler.Status(),
+		killSwitch.Status(), auditEvents}
 
 	template.Execute(w, context)
 }
 
-func handleUpdate(w http.ResponseWriter, r *http.Request) {
+func handleSpot(w http.ResponseWriter, r *http.Request) {
+	spotTemplatePath := path.Join(*templatesDir, SPOT_TEMPLATE)
+	template, err := template.New(SPOT_TEMPLATE).Funcs(templateFuncs).ParseFiles(
+		spotTemplatePath)
+	if err != nil {
+		handleError(w, fmt.Sprintf("couldn't read template %s: %v",
+			spotTemplatePath, err))
+		return
+	}
+
+	query, err := parseSpotQuery(r)
+	if err != nil {
+		handleError(w, err.Error())
+		return
+	}
+
+	context := struct {
+		Query   *spotQuery
+		History []*SpotPrice
+		PriceAt *SpotPrice
+	}{Query: query}
+
+	if query.SpotId != "" {
+		context.History, err = store.SpotHistory(
+			query.SpotId, query.CountryCode, query.Since, query.Until)
+		if err != nil {
+			handleError(w, fmt.Sprintf("couldn't read spot history: %v", err))
+			return
+		}
+
+		if !query.At.IsZero() {
+			context.PriceAt, err = store.SpotPriceAt(
+				query.SpotId, query.CountryCode, query.At)
+			if err != nil {
+				handleError(w, fmt.Sprintf("couldn't read spot price: %v", err))
+				return
+			}
+		}
+	}
+
+	template.Execute(w, context)
+}
+
+// handleSpotJson returns the spot's history, or just the price at the
+// requested time when at is set.
+func handleSpotJson(w http.ResponseWriter, r *http.Request) {
+	query, err := parseSpotQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if query.SpotId == "" {
+		http.Error(w, "spot_id is required", http.StatusBadRequest)
+		return
+	}
+
+	var result interface{}
+	if !query.At.IsZero() {
+		result, err = store.SpotPriceAt(query.SpotId, query.CountryCode, query.At)
+	} else {
+		result, err = store.SpotHistory(
+			query.SpotId, query.CountryCode, query.Since, query.Until)
+	}
+
+	if err != nil {
+		glog.Errorf("Error reading spot prices: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+type spotQuery struct {
+	SpotId      string
+	CountryCode string
+	Days        int
+	Since       time.Time
+	Until       time.Time
+	At          time.Time
+	// As entered, for the form
+	AtStr string
+}
+
+// parseSpotQuery reads spot_id, country (default US), days (default 7) or
+// since/until, and at. Times are Pacific in TimeFormat or RFC3339.
+func parseSpotQuery(r *http.Request) (*spotQuery, error) {
 	query := r.URL.Query()
-	undercutStr := query.Get("undercut")
-	runeveryStr := query.Get("runevery")
-	debugEnabledStr := query.Get("debugenabled")
-	enabledStr := query.Get("enabled")
+	spotQuery := &spotQuery{
+		SpotId:      strings.TrimSpace(query.Get("spot_id")),
+		CountryCode: strings.ToUpper(strings.TrimSpace(query.Get("country"))),
+		Days:        7,
+		AtStr:       strings.TrimSpace(query.Get("at")),
+	}
+
+	if spotQuery.CountryCode == "" {
+		spotQuery.CountryCode = djv_ads.DefaultCountryCode
+	}
+
+	if daysStr := query.Get("days"); daysStr != "" {
+		days, err := strconv.Atoi(daysStr)
+		if err != nil || days < 0 {
+			return nil, fmt.Errorf("could not parse days: %v", daysStr)
+		}
+		spotQuery.Days = days
+	}
+
+	if spotQuery.Days > 0 {
+		spotQuery.Since = time.Now().AddDate(0, 0, -spotQuery.Days)
+	}
+
+	times := []struct {
+		name  string
+		value *time.Time
+	}{
+		{"since", &spotQuery.Since},
+		{"until", &spotQuery.Until},
+		{"at", &spotQuery.At},
+	}
+
+	for _, t := range times {
+		timeStr := strings.TrimSpace(query.Get(t.name))
+		if timeStr == "" {
+			continue
+		}
+
+		parsed, err := parseQueryTime(timeStr)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse %v: %v", t.name, timeStr)
+		}
+		*t.value = parsed
+	}
+
+	return spotQuery, nil
+}
+
+func parseQueryTime(timeStr string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, timeStr); err == nil {
+		return t, nil
+	}
+
+	return time.ParseInLocation(djv_ads.TimeFormat, timeStr, djv_ads.Pacific)
+}
+
+func handleUpdate(w http.ResponseWriter, r *http.Request) {
+	undercutStr := r.PostFormValue("undercut")
+	targetPositionStr := r.PostFormValue("targetposition")
+	geoUndercutsStr := r.PostFormValue("geoundercuts")
+	geoMaxBidsStr := r.PostFormValue("geomaxbids")
+	runeveryStr := r.PostFormValue("runevery")
+	debugEnabledStr := r.PostFormValue("debugenabled")
+	enabledStr := r.PostFormValue("enabled")
+	requireApprovalStr := r.PostFormValue("requireapproval")
 
-	state := getStateOrDefault(*statePath)
 	undercut, err := strconv.ParseFloat(undercutStr, 64)
 	if err != nil {
 		handleError(w, fmt.Sprintf("could not parse undercut float: %v", undercutStr))
 		return
 	}
 
+	targetPosition := 0
+	if targetPositionStr != "" {
+		targetPosition, err = strconv.Atoi(targetPositionStr)
+		if err != nil || targetPosition < 0 {
+			handleError(w, fmt.Sprintf("could not parse target position: %v", targetPositionStr))
+			return
+		}
+	}
+
+	if _, err = parseCountryAmounts(geoUndercutsStr); err != nil {
+		handleError(w, fmt.Sprintf("could not parse geo undercuts: %v", err))
+		return
+	}
+
+	if _, err = parseCountryAmounts(geoMaxBidsStr); err != nil {
+		handleError(w, fmt.Sprintf("could not parse geo max bids: %v", err))
+		return
+	}
+
 	runevery, err := strconv.Atoi(runeveryStr)
 	if err != nil {
 		handleError(w, fmt.Sprintf("could not parse runevery integer: %v", runeveryStr))
 		return
 	}
 
-	state.Undercut = undercut
-	state.RunEvery = runevery
+	var invalid error
+	_, err = updateState(*statePath, func(state *State) error {
+		state.Undercut = undercut
+		state.TargetPosition = targetPosition
+		state.GeoUndercuts = geoUndercutsStr
+		state.GeoMaxBids = geoMaxBidsStr
+		state.RunEvery = runevery
+
+		state.setDebugEnabled(debugEnabledStr == "on")
+		state.setEnabled(enabledStr == "on")
+		state.setRequireApproval(requireApprovalStr == "on")
+
+		invalid = state.checkGeoUndercuts()
+		return invalid
+	})
+	if invalid != nil {
+		handleError(w, invalid.Error())
+		return
+	} else if err != nil {
+		handleStateError(w, err)
+		return
+	}
 
-	if debugEnabledStr == "on" {
-		state.DebugEnabled = ENABLED
-	} else {
-		state.DebugEnabled = DISABLED
+	glog.Infof("%v updated settings", currentSession(r).Username)
+	scheduler.SettingsChanged()
+
+	// redirect
+	http.Redirect(w, r, "/", http.StatusFound)
+}
+
+func handleRunNow(w http.ResponseWriter, r *http.Request) {
+	if err := scheduler.RunNow(); err != nil {
+		handleError(w, err.Error())
+		return
 	}
 
-	if enabledStr == "on" {
+	glog.Infof("%v requested a run", currentSession(r).Username)
+	http.Redirect(w, r, "/", http.StatusFound)
+}
+
+func (state *State) setEnabled(enabled bool) {
+	if enabled {
 		state.Enabled = ENABLED
 		state.StatusBtnClass = STATUS_ENABLED_CLASS
 		state.StatusText = STATUS_ENABLED_TEXT
@@ -175,31 +599,121 @@ func handleUpdate(w http.ResponseWriter, r *http.Request) {
 		state.StatusBtnClass = STATUS_DISABLED_CLASS
 		state.StatusText = STATUS_DISABLED_TEXT
 	}
+}
 
-	if err = writeState(*statePath, state); err != nil {
-		handleError(w, fmt.Sprintf("could not update state: %v", err))
-		return
+func (state *State) setRequireApproval(requireApproval bool) {
+	if requireApproval {
+		state.RequireApproval = ENABLED
+	} else {
+		state.RequireApproval = DISABLED
 	}
+}
 
-	// redirect
-	http.Redirect(w, r, r.Referer(), http.StatusFound)
+func (state *State) setDebugEnabled(enabled bool) {
+	if enabled {
+		state.DebugEnabled = ENABLED
+	} else {
+		state.DebugEnabled = DISABLED
+	}
 }
 
 func handleError(w http.ResponseWriter, errorText string) {
 	glog.Errorf("Unexpected error: %v", errorText)
-	fmt.Fprintf(w, errorText)
+	fmt.Fprint(w, errorText)
+}
+
+// handleStateError fails the request rather than carrying on with defaults,
+// which would be saved over the real settings.
+func handleStateError(w http.ResponseWriter, err error) {
+	glog.Errorf("Error reading or writing state: %v", err)
+	http.Error(w, fmt.Sprintf("could not read or save settings: %v", err),
+		http.StatusInternalServerError)
+}
+
+// parseCountryAmounts parses settings like "US=0.002, CA=0.001".
+func parseCountryAmounts(amountsStr string) (map[string]float64, error) {
+	amounts := make(map[string]float64)
+	for _, pair := range strings.Split(amountsStr, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		parts := strings.Split(pair, "=")
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("expected COUNTRY=amount, got %q", pair)
+		}
+
+		countryCode := strings.ToUpper(strings.TrimSpace(parts[0]))
+		amount, err := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+		if countryCode == "" || err != nil {
+			return nil, fmt.Errorf("expected COUNTRY=amount, got %q", pair)
+		}
+
+		amounts[countryCode] = amount
+	}
+
+	return amounts, nil
+}
+
+func formatCountryAmounts(amounts map[string]float64) string {
+	countryCodes := make([]string, 0, len(amounts))
+	for countryCode := range amounts {
+		countryCodes = append(countryCodes, countryCode)
+	}
+	sort.Strings(countryCodes)
+
+	pairs := make([]string, 0, len(countryCodes))
+	for _, countryCode := range countryCodes {
+		pairs = append(pairs, fmt.Sprintf("%v=%v", countryCode, amounts[countryCode]))
+	}
+
+	return strings.Join(pairs, ", ")
+}
+
+// stateLock serializes changes to the state file, which is read, changed and
+// written back whole.
+var stateLock sync.Mutex
+
+// getState reads the state, only falling back to the defaults when there's no
+// state file yet.
+func getState(path string) (*State, error) {
+	state, err := readState(path)
+	if os.IsNotExist(err) {
+		return defaultState(), nil
+	}
+
+	return state, err
 }
 
 func getStateOrDefault(path string) *State {
-	state, err := readState(*statePath)
+	state, err := getState(path)
 	if err != nil {
-		glog.Error("Error reading state: %v", err)
+		glog.Errorf("Error reading state: %v", err)
 		state = defaultState()
 	}
 
 	return state
 }
 
+// updateState applies change to the saved state. Nothing is written if the
+// state can't be read or change fails.
+func updateState(path string, change func(state *State) error) (*State, error) {
+	stateLock.Lock()
+	defer stateLock.Unlock()
+
+	state, err := getState(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = change(state); err != nil {
+		return nil, err
+	}
+
+	return state, writeState(path, state)
+}
+
 func readState(path string) (*State, error) {
 	state := &State{}
 	file, err := os.Open(path)
@@ -216,15 +730,31 @@ func readState(path string) (*State, error) {
 	return state, nil
 }
 
+// writeState writes to a temp file and renames it over the state, so readers
+// never see half a file.
 func writeState(path string, state *State) error {
-	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0755)
+	file, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
 	if err != nil {
 		return err
 	}
-	defer file.Close()
+	defer os.Remove(file.Name())
 
 	encoder := json.NewEncoder(file)
-	return encoder.Encode(state)
+	if err = encoder.Encode(state); err != nil {
+		file.Close()
+		return err
+	}
+
+	if err = file.Chmod(0644); err != nil {
+		file.Close()
+		return err
+	}
+
+	if err = file.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(file.Name(), path)
 }
 
 func readUpdatesLog(path string) ([]*djv_ads.BidUpdate, error) {
@@ -255,26 +785,77 @@ func readUpdatesLog(path string) ([]*djv_ads.BidUpdate, error) {
 	}
 }
 
-func writeUpdatesToLog(path string, updates []*djv_ads.BidUpdate) error {
+func readRunsLog(path string) ([]*djv_ads.RunResult, error) {
 	if path == "" {
-		return nil
+		return nil, nil
 	}
 
-	logsFile, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0755)
+	logsFile, err := os.Open(path)
 	if err != nil {
-		return err
+		return nil, err
 	}
+
 	defer logsFile.Close()
 
-	encoder := json.NewEncoder(logsFile)
+	decoder := json.NewDecoder(logsFile)
 
-	for _, update := range updates {
-		if err = encoder.Encode(update); err != nil {
-			return err
+	runs := make([]*djv_ads.RunResult, 0)
+	for {
+		run := &djv_ads.RunResult{}
+		err = decoder.Decode(run)
+		if err == io.EOF {
+			return runs, nil
+		} else if err != nil {
+			return nil, err
 		}
+
+		runs = append(runs, run)
 	}
+}
+
+func pruneHistory() {
+	pruned, err := store.PruneUpdates(*updateRetention, *maxStoredUpdates)
+	if err != nil {
+		glog.Errorf("Error pruning updates: %v", err)
+	} else if pruned > 0 {
+		glog.Infof("Pruned %v old updates", pruned)
+	}
+
+	pruned, err = store.PruneRuns(*runRetention)
+	if err != nil {
+		glog.Errorf("Error pruning runs: %v", err)
+	} else if pruned > 0 {
+		glog.Infof("Pruned %v old runs", pruned)
+	}
+
+	pruned, err = store.PruneProposals(*proposalRetention)
+	if err != nil {
+		glog.Errorf("Error pruning proposals: %v", err)
+	} else if pruned > 0 {
+		glog.Infof("Pruned %v old proposals", pruned)
+	}
+
+	pruned, err = store.PruneSessions()
+	if err != nil {
+		glog.Errorf("Error pruning sessions: %v", err)
+	}
+
+	pruned, prunedPrices, err := store.PruneSnapshots(*snapshotRetention, *spotPriceRetention)
+	if err != nil {
+		glog.Errorf("Error pruning snapshots: %v", err)
+	} else if pruned > 0 || prunedPrices > 0 {
+		glog.Infof("Pruned %v old snapshots and %v spot prices", pruned, prunedPrices)
+	}
+}
 
-	return nil
+var templateFuncs = template.FuncMap{
+	"pacific": func(t time.Time) string {
+		return t.In(djv_ads.Pacific).Format(djv_ads.TimeFormat)
+	},
+	"seconds": func(d time.Duration) string {
+		return fmt.Sprintf("%.1fs", d.Seconds())
+	},
+	"join": strings.Join,
 }
 
 func defaultState() *State {
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/emef/djv_ads"
+	"github.com/golang/glog"
+)
+
+var (
+	maxBidChange = flag.Float64("max_bid_change", 1.0,
+		"Hold back bid changes bigger than this many dollars (0 for no limit)")
+	maxBidChangePercent = flag.Float64("max_bid_change_percent", 0,
+		"Hold back bid changes bigger than this percentage of the old bid (0 for no limit)")
+	maxUpdatesPerRun = flag.Int("max_updates_per_run", 0,
+		"Apply at most this many bid updates per run (0 for no limit)")
+	maxHourlySpendIncrease = flag.Float64("max_hourly_spend_increase", 0,
+		"Limit the projected hourly spend increase of a run to this many dollars (0 for no limit)")
+	hourlyImpressions = flag.Float64("hourly_impressions", 0,
+		"Estimated impressions an hour per spot, to project spend")
+	spotHourlyImpressions = flag.String("spot_hourly_impressions", "",
+		"Estimated impressions an hour for specific spots, e.g. \"32=5000, 33=800\"")
+	guardrailAction = flag.String("guardrail_action", "partial",
+		"What to do with a run that trips a guardrail: partial only holds back the updates "+
+			"over the limits, refuse applies none of the run's updates until nothing trips")
+)
+
+var guardrails djv_ads.Guardrails
+
+func guardrailsFromFlags() (djv_ads.Guardrails, error) {
+	spotImpressions, err := parseSpotAmounts(*spotHourlyImpressions)
+	if err != nil {
+		return djv_ads.Guardrails{}, fmt.Errorf("-spot_hourly_impressions: %v", err)
+	}
+
+	fromFlags := djv_ads.Guardrails{
+		MaxBidChange:             *maxBidChange,
+		MaxBidChangePercent:      *maxBidChangePercent,
+		MaxUpdatesPerRun:         *maxUpdatesPerRun,
+		MaxHourlySpendIncrease:   *maxHourlySpendIncrease,
+		SpotHourlyImpressions:    spotImpressions,
+		DefaultHourlyImpressions: *hourlyImpressions,
+	}
+
+	switch *guardrailAction {
+	case "refuse":
+		fromFlags.Action = djv_ads.RefuseOnGuardrail
+	case "partial":
+		fromFlags.Action = djv_ads.PartialOnGuardrail
+	default:
+		return fromFlags, fmt.Errorf("-guardrail_action must be refuse or partial, got %q",
+			*guardrailAction)
+	}
+
+	return fromFlags, fromFlags.Validate()
+}
+
+// parseSpotAmounts parses settings like "32=5000, 33=800", keyed by spot id.
+func parseSpotAmounts(amountsStr string) (map[string]float64, error) {
+	amounts := make(map[string]float64)
+	for _, pair := range strings.Split(amountsStr, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		parts := strings.Split(pair, "=")
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("expected SPOT=amount, got %q", pair)
+		}
+
+		// TJ's spot ids are numbers
+		spotId := strings.TrimSpace(parts[0])
+		_, idErr := strconv.ParseUint(spotId, 10, 64)
+		amount, err := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+		if idErr != nil || err != nil || amount < 0 {
+			return nil, fmt.Errorf("expected SPOT=amount, got %q", pair)
+		}
+
+		if _, ok := amounts[spotId]; ok {
+			return nil, fmt.Errorf("spot %v is listed twice", spotId)
+		}
+
+		amounts[spotId] = amount
+	}
+
+	return amounts, nil
+}
+
+// reportGuardrailTrips raises the alarm when a run was held back.
+func reportGuardrailTrips(result *djv_ads.RunResult) {
+	if len(result.GuardrailTrips) == 0 {
+		return
+	}
+
+	reasons := make([]string, 0, len(result.GuardrailTrips))
+	for _, trip := range result.GuardrailTrips {
+		guardrailTrips.WithLabelValues(trip.Guardrail).Inc()
+		reasons = append(reasons, trip.Guardrail+": "+trip.Reason)
+	}
+
+	title := "Guardrails held back some updates"
+	if result.Refused {
+		title = "Guardrails refused a run"
+	}
+
+	glog.Errorf("Run %v: %v", result.RunId, title)
+	alerter.Fire(&Alert{
+		Kind:    ALERT_GUARDRAIL,
+		Key:     ALERT_GUARDRAIL,
+		Title:   title,
+		Message: fmt.Sprintf("Run %v:\n%v", result.RunId, strings.Join(reasons, "\n")),
+	})
+}
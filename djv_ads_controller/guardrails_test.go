@@ -0,0 +1,27 @@
+package main
+
+import "testing"
+
+func TestParseSpotAmounts(t *testing.T) {
+	amounts, err := parseSpotAmounts(" 32=5000, 33 = 800.5,, ")
+	if err != nil || len(amounts) != 2 || amounts["32"] != 5000 || amounts["33"] != 800.5 {
+		t.Errorf("expected spots 32 and 33, got %v %v", amounts, err)
+	}
+
+	if amounts, err = parseSpotAmounts(""); err != nil || len(amounts) != 0 {
+		t.Errorf("expected no spots, got %v %v", amounts, err)
+	}
+
+	for _, bad := range []string{
+		"us=5000",
+		"32",
+		"32=lots",
+		"=5000",
+		"32=-1",
+		"32=5000, 32=800",
+	} {
+		if _, err := parseSpotAmounts(bad); err == nil {
+			t.Errorf("expected %q to be rejected", bad)
+		}
+	}
+}
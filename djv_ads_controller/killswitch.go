@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/emef/djv_ads"
+	"github.com/golang/glog"
+)
+
+const AUDIT_ENGAGE_KILL_SWITCH = "engage_kill_switch"
+const AUDIT_REARM_KILL_SWITCH = "rearm_kill_switch"
+
+const SOURCE_UI = "ui"
+const SOURCE_API = "api"
+const SOURCE_FILE = "file"
+
+var ErrKillSwitchEngaged = errors.New("the kill switch is engaged, bid updates are blocked")
+
+var (
+	killSwitchFile = flag.String("kill_switch_file", "",
+		"Engage the kill switch whenever this file exists, e.g. touch it over ssh")
+	killSwitchPoll = flag.Duration("kill_switch_poll", time.Second,
+		"How often to look for -kill_switch_file")
+)
+
+// KillSwitchState is the saved state of the kill switch.
+type KillSwitchState struct {
+	Engaged bool
+	// When and by whom it was last engaged or re-armed
+	Since    time.Time
+	Username string
+	Source   string
+	Reason   string
+}
+
+// KillSwitch stops every bid update until someone re-arms it. Engaging it
+// cancels the runs and updates in flight.
+type KillSwitch struct {
+	mu    sync.Mutex
+	state KillSwitchState
+	// Cancels for the contexts handed out by guard
+	cancels map[uint64]context.CancelFunc
+	nextId  uint64
+}
+
+var killSwitch *KillSwitch
+
+// NewKillSwitch picks up where the saved kill switch left off, so a restart
+// doesn't re-arm it.
+func NewKillSwitch() (*KillSwitch, error) {
+	state, err := store.GetKillSwitch()
+	if err != nil {
+		return nil, err
+	}
+
+	killSwitchEngaged.Set(boolGauge(state.Engaged))
+	return &KillSwitch{
+		state:   *state,
+		cancels: make(map[uint64]context.CancelFunc),
+	}, nil
+}
+
+func (killSwitch *KillSwitch) Status() KillSwitchState {
+	killSwitch.mu.Lock()
+	defer killSwitch.mu.Unlock()
+
+	return killSwitch.state
+}
+
+// guard returns a context that's cancelled when the kill switch is engaged,
+// or ErrKillSwitchEngaged if it already is. done must be called once the
+// context isn't needed anymore.
+func (killSwitch *KillSwitch) guard(
+	ctx context.Context) (context.Context, context.CancelFunc, error) {
+
+	killSwitch.mu.Lock()
+	defer killSwitch.mu.Unlock()
+
+	if killSwitch.state.Engaged {
+		return nil, nil, ErrKillSwitchEngaged
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	id := killSwitch.nextId
+	killSwitch.nextId++
+	killSwitch.cancels[id] = cancel
+
+	done := func() {
+		killSwitch.mu.Lock()
+		delete(killSwitch.cancels, id)
+		killSwitch.mu.Unlock()
+		cancel()
+	}
+
+	return ctx, done, nil
+}
+
+// Engage blocks bid updates and cancels the ones in flight. It returns false
+// if the kill switch was already engaged.
+func (killSwitch *KillSwitch) Engage(username, source, reason string) (bool, error) {
+	killSwitch.mu.Lock()
+	if killSwitch.state.Engaged {
+		killSwitch.mu.Unlock()
+		return false, nil
+	}
+
+	killSwitch.state = KillSwitchState{
+		Engaged:  true,
+		Since:    time.Now(),
+		Username: username,
+		Source:   source,
+		Reason:   reason,
+	}
+	state := killSwitch.state
+
+	for id, cancel := range killSwitch.cancels {
+		cancel()
+		delete(killSwitch.cancels, id)
+	}
+	killSwitch.mu.Unlock()
+
+	killSwitchEngaged.Set(1)
+	glog.Errorf("Kill switch engaged by %v (%v): %v", username, source, reason)
+	return true, killSwitch.save(&state, AUDIT_ENGAGE_KILL_SWITCH)
+}
+
+// Rearm lets bid updates through again. It refuses while the kill switch
+// file is still there, since it would just engage again.
+func (killSwitch *KillSwitch) Rearm(username, source, reason string) error {
+	if *killSwitchFile != "" {
+		if _, err := os.Stat(*killSwitchFile); err == nil {
+			return fmt.Errorf("remove %v before re-arming", *killSwitchFile)
+		}
+	}
+
+	killSwitch.mu.Lock()
+	if !killSwitch.state.Engaged {
+		killSwitch.mu.Unlock()
+		return errors.New("the kill switch isn't engaged")
+	}
+
+	killSwitch.state = KillSwitchState{
+		Since:    time.Now(),
+		Username: username,
+		Source:   source,
+		Reason:   reason,
+	}
+	state := killSwitch.state
+	killSwitch.mu.Unlock()
+
+	killSwitchEngaged.Set(0)
+	glog.Warningf("Kill switch re-armed by %v (%v): %v", username, source, reason)
+	return killSwitch.save(&state, AUDIT_REARM_KILL_SWITCH)
+}
+
+func (killSwitch *KillSwitch) save(state *KillSwitchState, action string) error {
+	if err := store.PutKillSwitch(state); err != nil {
+		glog.Errorf("Error saving kill switch: %v", err)
+		return err
+	}
+
+	err := store.AddAuditEvent(&AuditEvent{
+		Time:     state.Since,
+		Action:   action,
+		Username: state.Username,
+		Source:   state.Source,
+		Reason:   state.Reason,
+	})
+	if err != nil {
+		glog.Errorf("Error saving audit event: %v", err)
+	}
+
+	return err
+}
+
+// watchFile engages the kill switch whenever path exists.
+func (killSwitch *KillSwitch) watchFile(ctx context.Context, path string, every time.Duration) {
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+
+	for {
+		if _, err := os.Stat(path); err == nil {
+			killSwitch.Engage("", SOURCE_FILE, path+" exists")
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// killSwitchClient refuses bid updates while the kill switch is engaged, and
+// abandons the ones in flight when it's engaged.
+type killSwitchClient struct {
+	djv_ads.TJClient
+	killSwitch *KillSwitch
+}
+
+func (client killSwitchClient) UpdateBid(
+	ctx context.Context, bidId string, newBidAmount float64) error {
+
+	ctx, done, err := client.killSwitch.guard(ctx)
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	return client.TJClient.UpdateBid(ctx, bidId, newBidAmount)
+}
+
+// handleKillSwitch engages or re-arms the kill switch from the UI.
+func handleKillSwitch(w http.ResponseWriter, r *http.Request) {
+	username := currentSession(r).Username
+	reason := r.PostFormValue("reason")
+
+	var err error
+	switch action := r.PostFormValue("action"); action {
+	case "engage":
+		_, err = killSwitch.Engage(username, SOURCE_UI, reason)
+	case "rearm":
+		err = killSwitch.Rearm(username, SOURCE_UI, reason)
+	default:
+		handleError(w, fmt.Sprintf("unknown action %q", action))
+		return
+	}
+
+	if err != nil {
+		handleError(w, fmt.Sprintf("kill switch: %v", err))
+		return
+	}
+
+	http.Redirect(w, r, "/", http.StatusFound)
+}
+
+func boolGauge(value bool) float64 {
+	if value {
+		return 1
+	}
+
+	return 0
+}
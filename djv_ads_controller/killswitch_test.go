@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emef/djv_ads"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// blockingClient holds bid updates until their context is done, or returns
+// right away when it isn't blocking.
+type blockingClient struct {
+	djv_ads.TJClient
+	block   bool
+	started chan struct{}
+}
+
+func (client *blockingClient) UpdateBid(ctx context.Context, bidId string, amount float64) error {
+	if !client.block {
+		return nil
+	}
+
+	close(client.started)
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestKillSwitchEngageRearm(t *testing.T) {
+	setupApi(t)
+	setupKillSwitch(t)
+
+	runCtx, done, err := killSwitch.guard(context.Background())
+	if err != nil {
+		t.Fatalf("expected a re-armed kill switch to let runs through: %v", err)
+	}
+	defer done()
+
+	engaged, err := killSwitch.Engage("alice", SOURCE_UI, "bids look wrong")
+	if err != nil || !engaged {
+		t.Fatalf("expected the kill switch to engage, got %v %v", engaged, err)
+	}
+
+	if runCtx.Err() == nil {
+		t.Errorf("expected the run in flight to be cancelled")
+	}
+
+	if _, _, err = killSwitch.guard(context.Background()); err != ErrKillSwitchEngaged {
+		t.Errorf("expected new runs to be refused, got %v", err)
+	}
+
+	if engaged, err = killSwitch.Engage("bob", SOURCE_API, "again"); err != nil || engaged {
+		t.Errorf("expected engaging twice to do nothing, got %v %v", engaged, err)
+	}
+
+	if status := killSwitch.Status(); status.Username != "alice" || status.Reason != "bids look wrong" {
+		t.Errorf("expected alice's reason to stick, got %+v", status)
+	}
+
+	if got := testutil.ToFloat64(killSwitchEngaged); got != 1 {
+		t.Errorf("expected the engaged gauge at 1, got %v", got)
+	}
+
+	// A restart stays engaged
+	restarted, err := NewKillSwitch()
+	if err != nil || !restarted.Status().Engaged {
+		t.Errorf("expected the kill switch to stay engaged after a restart, got %v", err)
+	}
+
+	if err = killSwitch.Rearm("alice", SOURCE_UI, "fixed"); err != nil {
+		t.Fatalf("re-arming: %v", err)
+	}
+
+	if err = killSwitch.Rearm("alice", SOURCE_UI, "fixed"); err == nil {
+		t.Errorf("expected re-arming twice to be refused")
+	}
+
+	if _, done, err := killSwitch.guard(context.Background()); err != nil {
+		t.Errorf("expected runs to be let through after re-arming, got %v", err)
+	} else {
+		done()
+	}
+
+	events, err := store.ListAuditEvents(0)
+	if err != nil || len(events) != 2 || events[0].Action != AUDIT_REARM_KILL_SWITCH ||
+		events[1].Action != AUDIT_ENGAGE_KILL_SWITCH || events[1].Reason != "bids look wrong" {
+
+		t.Errorf("expected an engage then a rearm audit event, got %v %v", events, err)
+	}
+}
+
+func TestKillSwitchFile(t *testing.T) {
+	setupApi(t)
+	setupKillSwitch(t)
+
+	path := filepath.Join(t.TempDir(), "KILL")
+	oldKillSwitchFile := *killSwitchFile
+	t.Cleanup(func() { *killSwitchFile = oldKillSwitchFile })
+	*killSwitchFile = path
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go killSwitch.watchFile(ctx, path, time.Millisecond)
+
+	if err := os.WriteFile(path, nil, 0644); err != nil {
+		t.Fatalf("creating %v: %v", path, err)
+	}
+
+	for deadline := time.Now().Add(5 * time.Second); !killSwitch.Status().Engaged; {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the file to engage the kill switch")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if status := killSwitch.Status(); status.Source != SOURCE_FILE {
+		t.Errorf("expected the file to be the source, got %+v", status)
+	}
+
+	if err := killSwitch.Rearm("alice", SOURCE_UI, ""); err == nil ||
+		!strings.Contains(err.Error(), "remove") {
+
+		t.Errorf("expected re-arming to be refused while the file exists, got %v", err)
+	}
+
+	cancel()
+	os.Remove(path)
+	if err := killSwitch.Rearm("alice", SOURCE_UI, ""); err != nil {
+		t.Errorf("expected re-arming once the file is gone, got %v", err)
+	}
+}
+
+func TestKillSwitchClient(t *testing.T) {
+	setupApi(t)
+	setupKillSwitch(t)
+
+	blocking := &blockingClient{block: true, started: make(chan struct{})}
+	client := killSwitchClient{blocking, killSwitch}
+
+	updated := make(chan error)
+	go func() {
+		updated <- client.UpdateBid(context.Background(), "11", 0.10)
+	}()
+
+	<-blocking.started
+	if _, err := killSwitch.Engage("alice", SOURCE_UI, ""); err != nil {
+		t.Fatalf("engaging: %v", err)
+	}
+
+	select {
+	case err := <-updated:
+		if err != context.Canceled {
+			t.Errorf("expected the update in flight to be cancelled, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected the update in flight to be abandoned")
+	}
+
+	blocking.block = false
+	if err := client.UpdateBid(context.Background(), "11", 0.10); err != ErrKillSwitchEngaged {
+		t.Errorf("expected updates to be refused, got %v", err)
+	}
+}
+
+func TestApiKillSwitch(t *testing.T) {
+	setupApi(t)
+	setupKillSwitch(t)
+
+	tests := []struct {
+		method string
+		target string
+		body   string
+		code   int
+	}{
+		{http.MethodPost, "kill_switch/rearm", "", http.StatusConflict},
+		{http.MethodGet, "kill_switch/engage", "", http.StatusMethodNotAllowed},
+		{http.MethodPost, "kill_switch/engage", "{", http.StatusBadRequest},
+		{http.MethodPost, "kill_switch/engage", "", http.StatusOK},
+		{http.MethodPost, "kill_switch/engage", `{"Reason": "again"}`, http.StatusOK},
+		{http.MethodGet, "kill_switch", "", http.StatusOK},
+		{http.MethodPost, "kill_switch/rearm", `{"Reason": "fixed"}`, http.StatusOK},
+	}
+
+	for _, test := range tests {
+		w := serveApi(test.method, test.target, test.body)
+		if w.Code != test.code {
+			t.Errorf("%v %v %v: expected %v, got %v %v", test.method, test.target, test.body,
+				test.code, w.Code, w.Body)
+		}
+	}
+
+	if events, _ := store.ListAuditEvents(0); len(events) != 2 || events[1].Username != "alice" {
+		t.Errorf("expected alice's engage and rearm to be audited, got %v", events)
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/emef/djv_ads"
+	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var metricsAddr = flag.String("metrics_addr", "127.0.0.1:8082",
+	"Where to serve /metrics, apart from the UI since it has no login. "+
+		"Keep it on localhost, empty turns it off")
+
+var (
+	runDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "djv_ads_run_duration_seconds",
+		Help:    "How long controller runs take.",
+		Buckets: prometheus.ExponentialBuckets(5, 2, 10),
+	})
+	runsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "djv_ads_runs_total",
+		Help: "Controller runs by result (success, partial, failed).",
+	}, []string{"result"})
+	lastSuccess = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "djv_ads_last_success_timestamp_seconds",
+		Help: "When the last run that got through all campaigns finished.",
+	})
+	campaignsScanned = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "djv_ads_campaigns_scanned",
+		Help: "Campaigns scanned by the last run.",
+	})
+	bidsEvaluated = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "djv_ads_bids_evaluated",
+		Help: "Bids evaluated by the last run.",
+	})
+	updatesProposed = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "djv_ads_updates_proposed_total",
+		Help: "Bid updates proposed by the strategy.",
+	})
+	updatesApplied = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "djv_ads_updates_applied_total",
+		Help: "Bid updates pushed to TJ.",
+	})
+	guardrailTrips = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "djv_ads_guardrail_trips_total",
+		Help: "Guardrails broken by runs, by guardrail.",
+	}, []string{"guardrail"})
+	alertsFired = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "djv_ads_alerts_total",
+		Help: "Alerts sent, after dedup, by kind.",
+	}, []string{"kind"})
+	notifyErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "djv_ads_alert_errors_total",
+		Help: "Alerts a notifier failed to deliver, by notifier.",
+	}, []string{"notifier"})
+	killSwitchEngaged = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "djv_ads_kill_switch_engaged",
+		Help: "1 while the kill switch is blocking bid updates.",
+	})
+
+	tjRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "djv_ads_tj_request_duration_seconds",
+		Help:    "TJ request latency by endpoint and status code (0 for transport errors).",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"endpoint", "code"})
+	tjRequestErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "djv_ads_tj_request_errors_total",
+		Help: "Failed TJ request attempts by endpoint and status code (0 for transport errors).",
+	}, []string{"endpoint", "code"})
+	rateLimitWait = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "djv_ads_tj_rate_limit_wait_seconds",
+		Help:    "Time TJ requests spent waiting on the rate limiter.",
+		Buckets: prometheus.ExponentialBuckets(0.01, 2, 12),
+	})
+
+	bidLabels = []string{"campaign_id", "bid_id", "spot_id", "country"}
+	bidAmount = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "djv_ads_bid_amount",
+		Help: "Our current bid, as of the last run.",
+	}, bidLabels)
+	competitorMaxBid = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "djv_ads_competitor_max_bid",
+		Help: "Highest competing bid on the bid's spot, as of the last run.",
+	}, bidLabels)
+)
+
+func init() {
+	prometheus.MustRegister(
+		runDuration, runsTotal, lastSuccess, campaignsScanned, bidsEvaluated,
+		updatesProposed, updatesApplied, guardrailTrips, alertsFired, notifyErrors,
+		killSwitchEngaged, tjRequestDuration, tjRequestErrors, rateLimitWait, bidAmount,
+		competitorMaxBid)
+}
+
+// tjMetrics records TJ client requests.
+type tjMetrics struct{}
+
+func (tjMetrics) ObserveRequest(endpoint string, statusCode int, latency time.Duration) {
+	code := strconv.Itoa(statusCode)
+	tjRequestDuration.WithLabelValues(endpoint, code).Observe(latency.Seconds())
+	if statusCode < 200 || statusCode >= 300 {
+		tjRequestErrors.WithLabelValues(endpoint, code).Inc()
+	}
+}
+
+func (tjMetrics) ObserveRateLimitWait(wait time.Duration) {
+	rateLimitWait.Observe(wait.Seconds())
+}
+
+func recordRunMetrics(result *djv_ads.RunResult) {
+	runDuration.Observe(result.Duration().Seconds())
+	campaignsScanned.Set(float64(result.CampaignsScanned))
+	bidsEvaluated.Set(float64(result.BidsEvaluated))
+	updatesProposed.Add(float64(len(result.Proposed)))
+	updatesApplied.Add(float64(len(result.Applied)))
+
+	switch {
+	case result.Failed():
+		runsTotal.WithLabelValues("failed").Inc()
+		return
+	case len(result.Errors) > 0:
+		runsTotal.WithLabelValues("partial").Inc()
+	default:
+		runsTotal.WithLabelValues("success").Inc()
+		lastSuccess.Set(float64(result.EndTime.Unix()))
+	}
+
+	if result.AccountState == nil {
+		return
+	}
+
+	// The account state predates this run's updates
+	appliedBids := make(map[string]float64)
+	for _, update := range result.Applied {
+		appliedBids[update.BidId] = update.NewBid
+	}
+
+	// Start over so bids that went away don't keep reporting
+	bidAmount.Reset()
+	competitorMaxBid.Reset()
+	for _, campaign := range result.AccountState.Campaigns {
+		for _, bid := range campaign.Bids {
+			if !bid.IsActive {
+				continue
+			}
+
+			amount, applied := appliedBids[bid.BidId]
+			if !applied {
+				amount = bid.BidAmount
+			}
+
+			labels := []string{campaign.CampaignId, bid.BidId, bid.SpotId, bid.CountryCode}
+			bidAmount.WithLabelValues(labels...).Set(amount)
+			competitorMaxBid.WithLabelValues(labels...).Set(bid.TopCompetitorBid())
+		}
+	}
+}
+
+// serveMetrics serves /metrics on its own listener until ctx is done.
+func serveMetrics(ctx context.Context, addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+
+	server := &http.Server{Addr: addr, Handler: mux}
+	go func() {
+		<-ctx.Done()
+		server.Shutdown(context.Background())
+	}()
+
+	if err := server.ListenAndServe(); err != http.ErrServerClosed {
+		glog.Errorf("Error serving metrics: %v", err)
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/emef/djv_ads"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestRecordRunMetrics(t *testing.T) {
+	start := time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+	applied := &djv_ads.BidUpdate{CampaignId: "1", BidId: "11", PreviousBid: 0.10, NewBid: 0.12}
+	result := &djv_ads.RunResult{
+		StartTime:        start,
+		EndTime:          start.Add(time.Minute),
+		CampaignsScanned: 1,
+		BidsEvaluated:    3,
+		Proposed:         []*djv_ads.BidUpdate{applied, applied},
+		Applied:          []*djv_ads.BidUpdate{applied},
+		AccountState: &djv_ads.AccountState{
+			Campaigns: map[string]*djv_ads.Campaign{
+				"1": {
+					CampaignId: "1",
+					Bids: map[string]*djv_ads.Bid{
+						"11/US": {BidId: "11", SpotId: "37", CountryCode: "US",
+							BidAmount: 0.10, IsActive: true},
+						"12/US": {BidId: "12", SpotId: "38", CountryCode: "US",
+							BidAmount: 0.05, IsActive: true},
+						"13/US": {BidId: "13", SpotId: "39", CountryCode: "US",
+							BidAmount: 0.05},
+					},
+				},
+			},
+		},
+	}
+
+	successes := testutil.ToFloat64(runsTotal.WithLabelValues("success"))
+	proposed := testutil.ToFloat64(updatesProposed)
+	recordRunMetrics(result)
+
+	if got := testutil.ToFloat64(runsTotal.WithLabelValues("success")); got != successes+1 {
+		t.Errorf("expected a successful run to be counted, got %v", got-successes)
+	}
+
+	if got := testutil.ToFloat64(updatesProposed); got != proposed+2 {
+		t.Errorf("expected 2 proposed updates, got %v", got-proposed)
+	}
+
+	if got := testutil.ToFloat64(lastSuccess); got != float64(result.EndTime.Unix()) {
+		t.Errorf("expected the last success at the run's end, got %v", got)
+	}
+
+	if got := testutil.ToFloat64(bidsEvaluated); got != 3 {
+		t.Errorf("expected 3 bids evaluated, got %v", got)
+	}
+
+	// Applied bids report their new amount, inactive ones aren't reported
+	if got := testutil.ToFloat64(bidAmount.WithLabelValues("1", "11", "37", "US")); got != 0.12 {
+		t.Errorf("expected bid 11 at its applied 0.12, got %v", got)
+	}
+
+	if got := testutil.CollectAndCount(bidAmount); got != 2 {
+		t.Errorf("expected 2 active bids reported, got %v", got)
+	}
+
+	// A failed run is counted but leaves the last success and bids alone
+	failures := testutil.ToFloat64(runsTotal.WithLabelValues("failed"))
+	recordRunMetrics(&djv_ads.RunResult{
+		StartTime: start.Add(time.Hour),
+		EndTime:   start.Add(time.Hour + time.Minute),
+		Error:     "TJ login failed",
+	})
+
+	if got := testutil.ToFloat64(runsTotal.WithLabelValues("failed")); got != failures+1 {
+		t.Errorf("expected a failed run to be counted, got %v", got-failures)
+	}
+
+	if got := testutil.ToFloat64(lastSuccess); got != float64(result.EndTime.Unix()) {
+		t.Errorf("expected a failed run not to move the last success, got %v", got)
+	}
+
+	if got := testutil.CollectAndCount(bidAmount); got != 2 {
+		t.Errorf("expected the bids to keep reporting after a failed run, got %v", got)
+	}
+
+	partials := testutil.ToFloat64(runsTotal.WithLabelValues("partial"))
+	recordRunMetrics(&djv_ads.RunResult{
+		StartTime: start.Add(2 * time.Hour),
+		EndTime:   start.Add(2*time.Hour + time.Minute),
+		Errors:    []*djv_ads.BidError{{CampaignId: "1", BidId: "12", Error: "timeout"}},
+	})
+
+	if got := testutil.ToFloat64(runsTotal.WithLabelValues("partial")); got != partials+1 {
+		t.Errorf("expected a partial run to be counted, got %v", got-partials)
+	}
+}
+
+func TestTjMetrics(t *testing.T) {
+	errors := testutil.ToFloat64(tjRequestErrors.WithLabelValues("bids", "500"))
+
+	tjMetrics{}.ObserveRequest("bids", 200, time.Second)
+	tjMetrics{}.ObserveRequest("bids", 500, time.Second)
+
+	if got := testutil.ToFloat64(tjRequestErrors.WithLabelValues("bids", "500")); got != errors+1 {
+		t.Errorf("expected the 500 to be counted as an error, got %v", got-errors)
+	}
+
+	if got := testutil.ToFloat64(tjRequestErrors.WithLabelValues("bids", "200")); got != 0 {
+		t.Errorf("expected the 200 not to be counted as an error, got %v", got)
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/smtp"
+	"strings"
+)
+
+// Notifier delivers an alert somewhere people will see it.
+type Notifier interface {
+	Name() string
+	Notify(ctx context.Context, alert *Alert) error
+}
+
+// webhookNotifier POSTs the alert as JSON.
+type webhookNotifier struct {
+	url string
+}
+
+func (notifier *webhookNotifier) Name() string {
+	return "webhook"
+}
+
+func (notifier *webhookNotifier) Notify(ctx context.Context, alert *Alert) error {
+	return postJson(ctx, notifier.url, alert)
+}
+
+// slackNotifier posts to a Slack incoming webhook, or anything that takes
+// the same format.
+type slackNotifier struct {
+	url string
+}
+
+func (notifier *slackNotifier) Name() string {
+	return "slack"
+}
+
+func (notifier *slackNotifier) Notify(ctx context.Context, alert *Alert) error {
+	return postJson(ctx, notifier.url, map[string]string{
+		"text": fmt.Sprintf("*%v*\n%v", alert.Title, alert.fullMessage()),
+	})
+}
+
+func postJson(ctx context.Context, url string, value interface{}) error {
+	body, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned %v", response.Status)
+	}
+
+	return nil
+}
+
+// smtpNotifier emails the alert. Auth is skipped without a username.
+type smtpNotifier struct {
+	addr     string
+	username string
+	password string
+	from     string
+	to       []string
+}
+
+func (notifier *smtpNotifier) Name() string {
+	return "smtp"
+}
+
+func (notifier *smtpNotifier) Notify(ctx context.Context, alert *Alert) error {
+	var auth smtp.Auth
+	if notifier.username != "" {
+		host, _, err := net.SplitHostPort(notifier.addr)
+		if err != nil {
+			return err
+		}
+		auth = smtp.PlainAuth("", notifier.username, notifier.password, host)
+	}
+
+	message := fmt.Sprintf("From: %v\r\nTo: %v\r\nSubject: [djv_ads] %v\r\n"+
+		"Content-Type: text/plain; charset=utf-8\r\n\r\n%v\r\n",
+		notifier.from, strings.Join(notifier.to, ", "), alert.Title, alert.fullMessage())
+
+	// SendMail doesn't take a context, so give up on it rather than block
+	sent := make(chan error, 1)
+	go func() {
+		sent <- smtp.SendMail(notifier.addr, auth, notifier.from, notifier.to, []byte(message))
+	}()
+
+	select {
+	case err := <-sent:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
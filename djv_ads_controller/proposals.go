@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/emef/djv_ads"
+	"github.com/golang/glog"
+)
+
+// storeProposals keeps a run's proposed updates for approval, superseding
+// the pending proposals for the campaigns it ran.
+func storeProposals(result *djv_ads.RunResult) {
+	if result.AccountState == nil {
+		return
+	}
+
+	campaignIds := make([]string, 0, len(result.AccountState.Campaigns))
+	for campaignId := range result.AccountState.Campaigns {
+		campaignIds = append(campaignIds, campaignId)
+	}
+
+	expired, err := store.AddProposals(result.Proposed, result.RunId, campaignIds, result.EndTime)
+	if err != nil {
+		glog.Errorf("Error storing proposals: %v", err)
+		return
+	}
+
+	glog.Infof("Stored %v proposals for approval, %v older ones expired",
+		len(result.Proposed), expired)
+}
+
+var maxProposalAge = flag.Duration("max_proposal_age", 6*time.Hour,
+	"Approving a proposal older than this expires it instead of applying it (0 for no limit)")
+
+// approveProposals pushes the approved proposals to TJ, returning how many
+// were applied, how many failed, and how many were left alone because they
+// were too old or the live bid had moved since.
+func approveProposals(
+	ctx context.Context,
+	client djv_ads.TJClient,
+	ids []uint64,
+	username string) (int, int, int, error) {
+
+	// Leave them pending rather than fail them all
+	if killSwitch.Status().Engaged {
+		return 0, 0, 0, ErrKillSwitchEngaged
+	}
+
+	// Claimed first so they're only pushed once, each gets its final status
+	// when we know how it went
+	now := time.Now()
+	proposals, err := store.DecideProposals(ids, PROPOSAL_APPLYING, username, now)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+
+	applied := make([]*djv_ads.BidUpdate, 0, len(proposals))
+	liveBids := djv_ads.NewLiveBids(client)
+	failed, stale := 0, 0
+	for _, proposal := range proposals {
+		status, reason := "", ""
+		if *maxProposalAge > 0 && now.Sub(proposal.Created) > *maxProposalAge {
+			status = PROPOSAL_EXPIRED
+			reason = fmt.Sprintf("older than %v", *maxProposalAge)
+		} else {
+			// Prices have moved on if the bid isn't where the proposal saw it
+			_, conflict, err := liveBids.Conflict(
+				ctx, proposal.CampaignId, proposal.BidId, proposal.PreviousBid)
+			if err != nil {
+				status, reason = PROPOSAL_FAILED, err.Error()
+			} else if conflict != "" {
+				status, reason = PROPOSAL_CONFLICT, conflict
+			} else if err := client.UpdateBid(ctx, proposal.BidId, proposal.NewBid); err != nil {
+				status, reason = PROPOSAL_FAILED, err.Error()
+			}
+		}
+
+		if status != "" {
+			glog.Warningf("Not applying proposal %v for bid %v: %v: %v",
+				proposal.Id, proposal.BidId, status, reason)
+			if err := store.SetProposalOutcome(proposal.Id, status, reason); err != nil {
+				glog.Errorf("Error saving proposal %v: %v", proposal.Id, err)
+			}
+
+			if status == PROPOSAL_FAILED {
+				failed++
+			} else {
+				stale++
+			}
+			continue
+		}
+
+		if err := store.SetProposalOutcome(proposal.Id, PROPOSAL_APPLIED, ""); err != nil {
+			glog.Errorf("Error saving proposal %v: %v", proposal.Id, err)
+		}
+
+		liveBids.Set(proposal.CampaignId, proposal.BidId, proposal.NewBid)
+
+		update := proposal.BidUpdate
+		if update.Reason != "" {
+			update.Reason += "; "
+		}
+		update.Reason += "approved by " + username
+		applied = append(applied, update)
+	}
+
+	if err = store.AddUpdates(applied, now); err != nil {
+		glog.Errorf("Error storing approved updates: %v", err)
+	}
+
+	updatesApplied.Add(float64(len(applied)))
+	glog.Infof("%v approved %v proposals, %v failed, %v stale",
+		username, len(applied), failed, stale)
+	return len(applied), failed, stale, nil
+}
+
+func rejectProposals(ids []uint64, username string) (int, error) {
+	proposals, err := store.DecideProposals(ids, PROPOSAL_REJECTED, username, time.Now())
+	if err != nil {
+		return 0, err
+	}
+
+	glog.Infof("%v rejected %v proposals", username, len(proposals))
+	return len(proposals), nil
+}
+
+// handleProposals approves or rejects the checked proposals, or every pending
+// one for the "all" actions.
+func handleProposals(client djv_ads.TJClient) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		action := r.PostFormValue("action")
+
+		var ids []uint64
+		if action == "approve" || action == "reject" {
+			var err error
+			ids, err = parseProposalIds(r.PostForm["proposal_id"])
+			if err != nil {
+				handleError(w, err.Error())
+				return
+			}
+
+			// An empty list would mean all of them
+			if len(ids) == 0 {
+				http.Redirect(w, r, "/", http.StatusFound)
+				return
+			}
+		}
+
+		username := currentSession(r).Username
+		var err error
+		switch action {
+		case "approve", "approve_all":
+			_, _, _, err = approveProposals(r.Context(), client, ids, username)
+		case "reject", "reject_all":
+			_, err = rejectProposals(ids, username)
+		default:
+			handleError(w, fmt.Sprintf("unknown action %q", action))
+			return
+		}
+
+		if err != nil {
+			handleError(w, fmt.Sprintf("could not update proposals: %v", err))
+			return
+		}
+
+		http.Redirect(w, r, "/", http.StatusFound)
+	}
+}
+
+func parseProposalIds(idStrs []string) ([]uint64, error) {
+	ids := make([]uint64, 0, len(idStrs))
+	for _, idStr := range idStrs {
+		id, err := strconv.ParseUint(idStr, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse proposal id: %v", idStr)
+		}
+		ids = append(ids, id)
+	}
+
+	return ids, nil
+}
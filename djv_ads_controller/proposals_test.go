@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/emef/djv_ads"
+)
+
+// stubClient serves live bids and takes updates, failing the bids in fail.
+type stubClient struct {
+	djv_ads.TJClient
+	t *testing.T
+	// Keyed by campaign id, then bid id
+	bids    map[string]map[string]float64
+	fail    map[string]bool
+	updated map[string]float64
+}
+
+func (client *stubClient) GetBidsForCampaign(
+	ctx context.Context, campaignId string) (*djv_ads.BidsResponseJson, error) {
+
+	response := &djv_ads.BidsResponseJson{BidMap: make(map[int32]*djv_ads.BidJson)}
+	for bidId, amount := range client.bids[campaignId] {
+		response.BidMap[int32(len(response.BidMap))] = &djv_ads.BidJson{
+			BidId:     bidId,
+			BidAmount: fmt.Sprintf("%.4f", amount),
+		}
+	}
+
+	return response, nil
+}
+
+func (client *stubClient) UpdateBid(ctx context.Context, bidId string, amount float64) error {
+	// Nothing's marked applied before TJ has it
+	applying, err := store.ListProposals(PROPOSAL_APPLYING, 0)
+	if err != nil || len(applying) == 0 {
+		client.t.Errorf("expected proposals to be applying during updates, got %v %v",
+			applying, err)
+	}
+
+	if client.fail[bidId] {
+		return errors.New("TJ said no")
+	}
+
+	client.updated[bidId] = amount
+	return nil
+}
+
+func proposalStatuses(t *testing.T) map[string]string {
+	t.Helper()
+
+	proposals, err := store.ListProposals("", 0)
+	if err != nil {
+		t.Fatalf("listing proposals: %v", err)
+	}
+
+	statuses := make(map[string]string)
+	for _, proposal := range proposals {
+		statuses[proposal.BidId] = proposal.Status
+	}
+
+	return statuses
+}
+
+func TestApproveProposals(t *testing.T) {
+	setupApi(t)
+	setupKillSwitch(t)
+
+	now := time.Now()
+	old := []*djv_ads.BidUpdate{testUpdate("2", "21", 0.10)}
+	if _, err := store.AddProposals(old, "1", []string{"2"}, now.Add(-2*(*maxProposalAge))); err != nil {
+		t.Fatalf("adding proposals: %v", err)
+	}
+
+	proposed := []*djv_ads.BidUpdate{
+		testUpdate("1", "11", 0.10),
+		testUpdate("1", "12", 0.10),
+		testUpdate("1", "13", 0.10),
+	}
+	if _, err := store.AddProposals(proposed, "2", []string{"1"}, now); err != nil {
+		t.Fatalf("adding proposals: %v", err)
+	}
+
+	client := &stubClient{
+		t: t,
+		bids: map[string]map[string]float64{
+			// testUpdate's proposals were made at 0.05
+			"1": {"11": 0.05, "12": 0.07, "13": 0.05},
+			"2": {"21": 0.05},
+		},
+		fail:    map[string]bool{"13": true},
+		updated: make(map[string]float64),
+	}
+
+	applied, failed, stale, err := approveProposals(context.Background(), client, nil, "alice")
+	if err != nil || applied != 1 || failed != 1 || stale != 2 {
+		t.Errorf("expected 1 applied, 1 failed and 2 stale, got %v %v %v %v",
+			applied, failed, stale, err)
+	}
+
+	expected := map[string]string{
+		"11": PROPOSAL_APPLIED,
+		"12": PROPOSAL_CONFLICT,
+		"13": PROPOSAL_FAILED,
+		"21": PROPOSAL_EXPIRED,
+	}
+	for bidId, status := range proposalStatuses(t) {
+		if status != expected[bidId] {
+			t.Errorf("expected bid %v's proposal to be %v, got %v", bidId, expected[bidId], status)
+		}
+	}
+
+	if len(client.updated) != 1 || client.updated["11"] != 0.10 {
+		t.Errorf("expected only bid 11 pushed to TJ, got %v", client.updated)
+	}
+
+	updates, err := store.ListUpdates(UpdateQuery{})
+	if err != nil || len(updates) != 1 || updates[0].BidId != "11" {
+		t.Errorf("expected the applied update to be stored, got %v %v", updates, err)
+	}
+
+	// Decided proposals aren't applied twice
+	applied, failed, stale, err = approveProposals(context.Background(), client, nil, "alice")
+	if err != nil || applied+failed+stale != 0 {
+		t.Errorf("expected nothing left to approve, got %v %v %v %v", applied, failed, stale, err)
+	}
+}
+
+func TestProposalsExpireAndReject(t *testing.T) {
+	setupApi(t)
+	setupKillSwitch(t)
+
+	now := time.Now()
+	first := []*djv_ads.BidUpdate{testUpdate("1", "11", 0.10), testUpdate("2", "21", 0.10)}
+	if _, err := store.AddProposals(first, "1", []string{"1", "2"}, now); err != nil {
+		t.Fatalf("adding proposals: %v", err)
+	}
+
+	// A later run of campaign 1 supersedes its pending proposals only
+	second := []*djv_ads.BidUpdate{testUpdate("1", "12", 0.10)}
+	expired, err := store.AddProposals(second, "2", []string{"1"}, now.Add(time.Minute))
+	if err != nil || expired != 1 {
+		t.Errorf("expected 1 proposal superseded, got %v %v", expired, err)
+	}
+
+	// The kill switch leaves them pending
+	if _, err = killSwitch.Engage("alice", SOURCE_UI, "testing"); err != nil {
+		t.Fatalf("engaging kill switch: %v", err)
+	}
+
+	client := &stubClient{t: t, updated: make(map[string]float64)}
+	if _, _, _, err = approveProposals(context.Background(), client, nil, "alice"); err !=
+		ErrKillSwitchEngaged {
+
+		t.Errorf("expected approving to be refused, got %v", err)
+	}
+
+	pending, _ := store.ListProposals(PROPOSAL_PENDING, 0)
+	rejectIds := make([]uint64, 0)
+	for _, proposal := range pending {
+		if proposal.BidId == "21" {
+			rejectIds = append(rejectIds, proposal.Id)
+		}
+	}
+
+	if rejected, err := rejectProposals(rejectIds, "alice"); err != nil || rejected != 1 {
+		t.Errorf("expected 1 proposal rejected, got %v %v", rejected, err)
+	}
+
+	expected := map[string]string{
+		"11": PROPOSAL_EXPIRED,
+		"12": PROPOSAL_PENDING,
+		"21": PROPOSAL_REJECTED,
+	}
+	for bidId, status := range proposalStatuses(t) {
+		if status != expected[bidId] {
+			t.Errorf("expected bid %v's proposal to be %v, got %v", bidId, expected[bidId], status)
+		}
+	}
+
+	if len(client.updated) != 0 {
+		t.Errorf("expected nothing pushed to TJ, got %v", client.updated)
+	}
+}
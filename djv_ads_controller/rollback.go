@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"html/template"
+	"net/http"
+	"path"
+	"strconv"
+	"time"
+
+	"github.com/emef/djv_ads"
+	"github.com/golang/glog"
+)
+
+const ROLLBACK_TEMPLATE = "rollback.template.html"
+
+// rollbackRun puts back the bids a run changed, including its approved
+// proposals.
+func rollbackRun(
+	ctx context.Context,
+	client djv_ads.TJClient,
+	runId string,
+	username string) (*djv_ads.RollbackResult, error) {
+
+	if killSwitch.Status().Engaged {
+		return nil, ErrKillSwitchEngaged
+	}
+
+	run, err := store.GetRun(runId)
+	if err != nil {
+		return nil, err
+	}
+
+	if run == nil {
+		return nil, fmt.Errorf("no run %q", runId)
+	}
+
+	updates, err := store.ListUpdates(UpdateQuery{RunId: runId, Since: run.StartTime})
+	if err != nil {
+		return nil, err
+	}
+
+	return rollbackStored(ctx, client, updates, username), nil
+}
+
+func rollbackUpdates(
+	ctx context.Context,
+	client djv_ads.TJClient,
+	ids []uint64,
+	username string) (*djv_ads.RollbackResult, error) {
+
+	if killSwitch.Status().Engaged {
+		return nil, ErrKillSwitchEngaged
+	}
+
+	updates, err := store.GetUpdates(ids)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(updates) < len(ids) {
+		return nil, fmt.Errorf("found %v of %v updates", len(updates), len(ids))
+	}
+
+	return rollbackStored(ctx, client, updates, username), nil
+}
+
+// rollbackStored rolls back the updates, newest first, and records the
+// rollbacks as updates of their own.
+func rollbackStored(
+	ctx context.Context,
+	client djv_ads.TJClient,
+	stored []*StoredUpdate,
+	username string) *djv_ads.RollbackResult {
+
+	updates := make([]*djv_ads.BidUpdate, 0, len(stored))
+	for _, update := range stored {
+		updates = append(updates, update.BidUpdate)
+	}
+
+	result := djv_ads.RollbackUpdates(ctx, client, updates)
+	for _, update := range result.RolledBack {
+		update.Reason += " by " + username
+	}
+
+	if err := store.AddUpdates(result.RolledBack, time.Now()); err != nil {
+		glog.Errorf("Error storing rollback updates: %v", err)
+	}
+
+	updatesApplied.Add(float64(len(result.RolledBack)))
+	glog.Infof("%v rolled back %v of %v updates, %v conflicts, %v errors",
+		username, len(result.RolledBack), len(updates), len(result.Conflicts),
+		len(result.Errors))
+	return result
+}
+
+// handleRollback rolls back the run in run_id, or the checked update_ids, and
+// shows what happened.
+func handleRollback(client djv_ads.TJClient) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rollbackTemplatePath := path.Join(*templatesDir, ROLLBACK_TEMPLATE)
+		template, err := template.New(ROLLBACK_TEMPLATE).Funcs(templateFuncs).ParseFiles(
+			rollbackTemplatePath)
+		if err != nil {
+			handleError(w, fmt.Sprintf("couldn't read template %s: %v",
+				rollbackTemplatePath, err))
+			return
+		}
+
+		username := currentSession(r).Username
+		runId := r.PostFormValue("run_id")
+
+		var result *djv_ads.RollbackResult
+		if runId != "" {
+			result, err = rollbackRun(r.Context(), client, runId, username)
+		} else {
+			var ids []uint64
+			ids, err = parseUpdateIds(r.PostForm["update_id"])
+			if err != nil {
+				handleError(w, err.Error())
+				return
+			}
+
+			if len(ids) == 0 {
+				http.Redirect(w, r, "/", http.StatusFound)
+				return
+			}
+
+			result, err = rollbackUpdates(r.Context(), client, ids, username)
+		}
+
+		if err != nil {
+			handleError(w, fmt.Sprintf("could not roll back: %v", err))
+			return
+		}
+
+		context := struct {
+			RunId  string
+			Result *djv_ads.RollbackResult
+		}{runId, result}
+
+		template.Execute(w, context)
+	}
+}
+
+func parseUpdateIds(idStrs []string) ([]uint64, error) {
+	ids := make([]uint64, 0, len(idStrs))
+	for _, idStr := range idStrs {
+		id, err := strconv.ParseUint(idStr, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse update id: %v", idStr)
+		}
+		ids = append(ids, id)
+	}
+
+	return ids, nil
+}
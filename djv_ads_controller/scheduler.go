@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/emef/djv_ads"
+	"github.com/golang/glog"
+)
+
+var ErrRunInProgress = errors.New("a run is already in progress")
+
+// Scheduler runs the controller every RunEvery minutes while it's enabled,
+// give or take the jitter. Settings changes take effect right away, and runs
+// can be requested at any time. Runs never overlap.
+type Scheduler struct {
+	// requested is set for runs asked for with RunNow
+	run func(ctx context.Context, requested bool)
+	// Fraction of the interval runs are moved earlier or later by
+	jitter float64
+
+	runNow          chan struct{}
+	settingsChanged chan struct{}
+
+	mu           sync.Mutex
+	runningSince time.Time
+	lastRunEnd   time.Time
+	nextRun      time.Time
+	// Drawn once per run so recomputing the schedule doesn't move it around
+	jitterOffset float64
+}
+
+type ScheduleStatus struct {
+	Running      bool
+	RunningSince time.Time
+	LastRunEnd   time.Time
+	// Zero while automatic runs are disabled
+	NextRun time.Time
+}
+
+func NewScheduler(jitter float64, run func(ctx context.Context, requested bool)) *Scheduler {
+	return &Scheduler{
+		run:    run,
+		jitter: jitter,
+		// Buffered so requests made while the loop is busy aren't lost
+		runNow:          make(chan struct{}, 1),
+		settingsChanged: make(chan struct{}, 1),
+	}
+}
+
+func (scheduler *Scheduler) Start(ctx context.Context) {
+	for {
+		state := getStateOrDefault(*statePath)
+
+		var timer *time.Timer
+		var fire <-chan time.Time
+		runEvery := state.shortestRunEvery()
+		if state.Enabled == ENABLED && runEvery > 0 {
+			nextRun := scheduler.scheduleNext(runEvery, state.nextWindowEnd(time.Now()))
+			glog.Infof("Next run at %v",
+				nextRun.In(djv_ads.Pacific).Format(djv_ads.TimeFormat))
+			timer = time.NewTimer(time.Until(nextRun))
+			fire = timer.C
+		} else {
+			scheduler.scheduleNext(0, time.Time{})
+			glog.Infof("Controller disabled, waiting for settings change or run request")
+		}
+
+		select {
+		case <-fire:
+			scheduler.runOnce(ctx, false)
+		case <-scheduler.runNow:
+			scheduler.runOnce(ctx, true)
+		case <-scheduler.settingsChanged:
+			glog.Infof("Settings changed, rescheduling")
+		case <-ctx.Done():
+			glog.Infof("Scheduler stopped")
+			return
+		}
+
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
+
+// RunNow starts a run as soon as possible, whether or not automatic runs are
+// enabled.
+func (scheduler *Scheduler) RunNow() error {
+	if killSwitch.Status().Engaged {
+		return ErrKillSwitchEngaged
+	}
+
+	scheduler.mu.Lock()
+	defer scheduler.mu.Unlock()
+
+	if !scheduler.runningSince.IsZero() {
+		return ErrRunInProgress
+	}
+
+	select {
+	case scheduler.runNow <- struct{}{}:
+	default:
+		// One is already queued
+	}
+
+	return nil
+}
+
+// SettingsChanged makes the scheduler pick up a new interval or enabled flag
+// immediately rather than after the current wait.
+func (scheduler *Scheduler) SettingsChanged() {
+	select {
+	case scheduler.settingsChanged <- struct{}{}:
+	default:
+	}
+}
+
+func (scheduler *Scheduler) Status() ScheduleStatus {
+	scheduler.mu.Lock()
+	defer scheduler.mu.Unlock()
+
+	return ScheduleStatus{
+		Running:      !scheduler.runningSince.IsZero(),
+		RunningSince: scheduler.runningSince,
+		LastRunEnd:   scheduler.lastRunEnd,
+		NextRun:      scheduler.nextRun,
+	}
+}
+
+// scheduleNext works out when the next automatic run is due, 0 minutes
+// meaning there won't be one. The first run is due right away, and a
+// dayparting window ending sooner than the interval brings the run forward
+// so its campaigns change over on time.
+func (scheduler *Scheduler) scheduleNext(runEveryMinutes int, windowEnd time.Time) time.Time {
+	scheduler.mu.Lock()
+	defer scheduler.mu.Unlock()
+
+	if runEveryMinutes <= 0 {
+		scheduler.nextRun = time.Time{}
+		return scheduler.nextRun
+	}
+
+	if scheduler.lastRunEnd.IsZero() {
+		scheduler.nextRun = time.Now()
+		return scheduler.nextRun
+	}
+
+	interval := time.Duration(runEveryMinutes) * time.Minute
+	jittered := time.Duration(float64(interval) * (1 + scheduler.jitterOffset))
+	scheduler.nextRun = scheduler.lastRunEnd.Add(jittered)
+	if !windowEnd.IsZero() && windowEnd.Before(scheduler.nextRun) {
+		scheduler.nextRun = windowEnd
+	}
+
+	return scheduler.nextRun
+}
+
+func (scheduler *Scheduler) runOnce(ctx context.Context, requested bool) {
+	scheduler.mu.Lock()
+	scheduler.runningSince = time.Now()
+	scheduler.nextRun = time.Time{}
+	scheduler.mu.Unlock()
+
+	glog.Infof("Starting run (requested=%v)", requested)
+	scheduler.run(ctx, requested)
+	glog.Infof("Finished run")
+
+	scheduler.mu.Lock()
+	scheduler.runningSince = time.Time{}
+	scheduler.lastRunEnd = time.Now()
+	scheduler.jitterOffset = (rand.Float64()*2 - 1) * scheduler.jitter
+	scheduler.mu.Unlock()
+}
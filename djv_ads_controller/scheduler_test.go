@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// setupKillSwitch gives the package a fresh, re-armed kill switch.
+func setupKillSwitch(t *testing.T) {
+	t.Helper()
+
+	oldKillSwitch := killSwitch
+	t.Cleanup(func() { killSwitch = oldKillSwitch })
+
+	var err error
+	if killSwitch, err = NewKillSwitch(); err != nil {
+		t.Fatalf("loading kill switch: %v", err)
+	}
+}
+
+func TestScheduleNext(t *testing.T) {
+	scheduler := NewScheduler(0, nil)
+
+	if next := scheduler.scheduleNext(0, time.Time{}); !next.IsZero() {
+		t.Errorf("expected no run while disabled, got %v", next)
+	}
+
+	if next := scheduler.scheduleNext(15, time.Time{}); time.Since(next) > time.Second {
+		t.Errorf("expected the first run right away, got %v", next)
+	}
+
+	lastRunEnd := time.Now().Add(-5 * time.Minute)
+	scheduler.lastRunEnd = lastRunEnd
+	if next := scheduler.scheduleNext(15, time.Time{}); !next.Equal(lastRunEnd.Add(15 * time.Minute)) {
+		t.Errorf("expected a run 15 minutes after the last, got %v", next)
+	}
+
+	windowEnd := lastRunEnd.Add(10 * time.Minute)
+	if next := scheduler.scheduleNext(15, windowEnd); !next.Equal(windowEnd) {
+		t.Errorf("expected the run brought forward to the window end, got %v", next)
+	}
+
+	if next := scheduler.scheduleNext(15, lastRunEnd.Add(time.Hour)); !next.Equal(
+		lastRunEnd.Add(15 * time.Minute)) {
+
+		t.Errorf("expected a later window end not to delay the run, got %v", next)
+	}
+
+	scheduler.jitterOffset = -0.1
+	if next := scheduler.scheduleNext(10, time.Time{}); !next.Equal(lastRunEnd.Add(9 * time.Minute)) {
+		t.Errorf("expected the jitter to move the run a minute earlier, got %v", next)
+	}
+
+	if status := scheduler.Status(); !status.NextRun.Equal(lastRunEnd.Add(9 * time.Minute)) {
+		t.Errorf("expected the status to show the next run, got %v", status.NextRun)
+	}
+}
+
+func TestSchedulerWakeups(t *testing.T) {
+	setupApi(t)
+	setupKillSwitch(t)
+
+	runs := make(chan bool)
+	release := make(chan struct{})
+	scheduler := NewScheduler(0, func(ctx context.Context, requested bool) {
+		runs <- requested
+		<-release
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		scheduler.Start(ctx)
+		close(stopped)
+	}()
+
+	expectRun := func(name string, requested bool) {
+		t.Helper()
+
+		select {
+		case got := <-runs:
+			if got != requested {
+				t.Errorf("%v: expected requested=%v, got %v", name, requested, got)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%v: expected a run", name)
+		}
+	}
+
+	finishRun := func() {
+		t.Helper()
+
+		release <- struct{}{}
+		for deadline := time.Now().Add(5 * time.Second); scheduler.Status().Running; {
+			if time.Now().After(deadline) {
+				t.Fatalf("expected the run to finish")
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	// Enabling runs the first one right away
+	_, err := updateState(*statePath, func(state *State) error {
+		state.setEnabled(true)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("enabling: %v", err)
+	}
+	scheduler.SettingsChanged()
+	expectRun("enabled", false)
+
+	if status := scheduler.Status(); !status.Running {
+		t.Errorf("expected the status to show the run")
+	}
+
+	if err = scheduler.RunNow(); err != ErrRunInProgress {
+		t.Errorf("expected a request during a run to be refused, got %v", err)
+	}
+	finishRun()
+
+	// Requests don't wait for the interval
+	if err = scheduler.RunNow(); err != nil {
+		t.Fatalf("requesting a run: %v", err)
+	}
+	expectRun("requested", true)
+	finishRun()
+
+	// And then waits out the interval
+	select {
+	case <-runs:
+		t.Errorf("expected no run before the interval is up")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	status := scheduler.Status()
+	if status.Running || status.LastRunEnd.IsZero() ||
+		!status.NextRun.Equal(status.LastRunEnd.Add(RUNEVERY_DEFAULT*time.Minute)) {
+
+		t.Errorf("expected the next run an interval after the last, got %+v", status)
+	}
+
+	if _, err = killSwitch.Engage("alice", SOURCE_UI, "testing"); err != nil {
+		t.Fatalf("engaging kill switch: %v", err)
+	}
+
+	if err = scheduler.RunNow(); err != ErrKillSwitchEngaged {
+		t.Errorf("expected requests to be refused with the kill switch engaged, got %v", err)
+	}
+
+	cancel()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected the scheduler to stop")
+	}
+}
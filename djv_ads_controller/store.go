@@ -0,0 +1,1170 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/emef/djv_ads"
+	"github.com/golang/glog"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	updatesBucket           = []byte("updates")
+	updatesByTimeBucket     = []byte("updates_by_time")
+	updatesByCampaignBucket = []byte("updates_by_campaign")
+	updatesByBidBucket      = []byte("updates_by_bid")
+	runsBucket              = []byte("runs")
+	snapshotsBucket         = []byte("snapshots")
+	spotPricesBucket        = []byte("spot_prices")
+	sessionsBucket          = []byte("sessions")
+	proposalsBucket         = []byte("proposals")
+	auditBucket             = []byte("audit")
+	metaBucket              = []byte("meta")
+)
+
+var killSwitchKey = []byte("kill_switch")
+var activeWindowsKey = []byte("active_windows")
+
+// Store keeps controller history in a bbolt file. Updates are keyed by a
+// sequence number, with index buckets mapping campaign, bid and time (newest
+// last) back to it.
+type Store struct {
+	db *bolt.DB
+}
+
+type StoredUpdate struct {
+	*djv_ads.BidUpdate
+	Id   uint64
+	Time time.Time
+}
+
+// SpotPrice is what a spot looked like in one country when a snapshot was
+// taken. TopBid may be ours, TopCompetitorBid never is.
+type SpotPrice struct {
+	Time             time.Time
+	SpotId           string
+	CountryCode      string
+	TopBid           float64
+	TopCompetitorBid float64
+	OurBid           float64
+	Placements       int
+}
+
+// AuditEvent records who did something that matters after the fact.
+type AuditEvent struct {
+	Time     time.Time
+	Action   string
+	Username string
+	// Where it came from, the ui, api or kill switch file
+	Source string
+	Reason string
+}
+
+const PROPOSAL_PENDING = "pending"
+const PROPOSAL_APPLYING = "applying" // approved, being pushed to TJ
+const PROPOSAL_APPLIED = "applied"
+const PROPOSAL_FAILED = "failed"
+const PROPOSAL_REJECTED = "rejected"
+const PROPOSAL_EXPIRED = "expired"
+const PROPOSAL_CONFLICT = "conflict"
+
+// Proposal is a bid update waiting for, or past, a human decision.
+type Proposal struct {
+	*djv_ads.BidUpdate
+	Id        uint64
+	Status    string
+	Created   time.Time
+	DecidedAt time.Time
+	// Username, or the run that superseded it
+	DecidedBy string
+	Error     string
+}
+
+type UpdateQuery struct {
+	CampaignId string
+	BidId      string
+	RunId      string
+	// Zero values leave the range open
+	Since  time.Time
+	Until  time.Time
+	Limit  int
+	Offset int
+}
+
+func OpenStore(path string) (*Store, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		buckets := [][]byte{
+			updatesBucket, updatesByTimeBucket, updatesByCampaignBucket,
+			updatesByBidBucket, runsBucket, snapshotsBucket, spotPricesBucket,
+			sessionsBucket, proposalsBucket, auditBucket, metaBucket,
+		}
+
+		for _, bucket := range buckets {
+			if _, err := tx.CreateBucketIfNotExists(bucket); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &Store{db}, nil
+}
+
+func (store *Store) Close() error {
+	return store.db.Close()
+}
+
+func (store *Store) AddUpdates(updates []*djv_ads.BidUpdate, at time.Time) error {
+	if len(updates) == 0 {
+		return nil
+	}
+
+	return store.db.Update(func(tx *bolt.Tx) error {
+		for _, update := range updates {
+			if err := putUpdate(tx, update, at); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+func putUpdate(tx *bolt.Tx, update *djv_ads.BidUpdate, at time.Time) error {
+	bucket := tx.Bucket(updatesBucket)
+	id, err := bucket.NextSequence()
+	if err != nil {
+		return err
+	}
+
+	stored := &StoredUpdate{BidUpdate: update, Id: id, Time: at}
+	value, err := json.Marshal(stored)
+	if err != nil {
+		return err
+	}
+
+	if err = bucket.Put(uint64Key(id), value); err != nil {
+		return err
+	}
+
+	return putUpdateIndexes(tx, stored)
+}
+
+func putUpdateIndexes(tx *bolt.Tx, stored *StoredUpdate) error {
+	timeKey := timeSeqKey(stored.Time, stored.Id)
+	if err := tx.Bucket(updatesByTimeBucket).Put(timeKey, nil); err != nil {
+		return err
+	}
+
+	campaignKey := append(indexPrefix(stored.CampaignId), timeKey...)
+	if err := tx.Bucket(updatesByCampaignBucket).Put(campaignKey, nil); err != nil {
+		return err
+	}
+
+	bidKey := append(indexPrefix(stored.BidId), timeKey...)
+	return tx.Bucket(updatesByBidBucket).Put(bidKey, nil)
+}
+
+func deleteUpdate(tx *bolt.Tx, stored *StoredUpdate) error {
+	timeKey := timeSeqKey(stored.Time, stored.Id)
+	deletes := []struct {
+		bucket []byte
+		key    []byte
+	}{
+		{updatesBucket, uint64Key(stored.Id)},
+		{updatesByTimeBucket, timeKey},
+		{updatesByCampaignBucket, append(indexPrefix(stored.CampaignId), timeKey...)},
+		{updatesByBidBucket, append(indexPrefix(stored.BidId), timeKey...)},
+	}
+
+	for _, d := range deletes {
+		if err := tx.Bucket(d.bucket).Delete(d.key); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ListUpdates returns matching updates, newest first.
+func (store *Store) ListUpdates(query UpdateQuery) ([]*StoredUpdate, error) {
+	updates := make([]*StoredUpdate, 0)
+	err := store.db.View(func(tx *bolt.Tx) error {
+		// Walk the most selective index available
+		indexBucket := tx.Bucket(updatesByTimeBucket)
+		var prefix []byte
+		if query.BidId != "" {
+			indexBucket = tx.Bucket(updatesByBidBucket)
+			prefix = indexPrefix(query.BidId)
+		} else if query.CampaignId != "" {
+			indexBucket = tx.Bucket(updatesByCampaignBucket)
+			prefix = indexPrefix(query.CampaignId)
+		}
+
+		until := query.Until
+		if until.IsZero() {
+			until = time.Unix(0, math.MaxInt64)
+		}
+
+		lower := append(append([]byte{}, prefix...), timeSeqKey(query.Since, 0)...)
+		upper := append(append([]byte{}, prefix...), timeSeqKey(until, math.MaxUint64)...)
+
+		skipped := 0
+		cursor := indexBucket.Cursor()
+		for key := seekLast(cursor, upper); key != nil && bytes.Compare(key, lower) >= 0; key, _ = cursor.Prev() {
+			stored, err := getUpdate(tx, seqFromIndexKey(key))
+			if err != nil {
+				return err
+			}
+
+			if stored == nil || !query.matches(stored) {
+				continue
+			}
+
+			if skipped < query.Offset {
+				skipped++
+				continue
+			}
+
+			updates = append(updates, stored)
+			if query.Limit > 0 && len(updates) >= query.Limit {
+				break
+			}
+		}
+
+		return nil
+	})
+
+	return updates, err
+}
+
+func (query UpdateQuery) matches(stored *StoredUpdate) bool {
+	if query.CampaignId != "" && stored.CampaignId != query.CampaignId {
+		return false
+	}
+
+	if query.BidId != "" && stored.BidId != query.BidId {
+		return false
+	}
+
+	if query.RunId != "" && stored.RunId != query.RunId {
+		return false
+	}
+
+	return true
+}
+
+// GetUpdates returns the updates with the given ids, newest first. Unknown
+// ids are skipped.
+func (store *Store) GetUpdates(ids []uint64) ([]*StoredUpdate, error) {
+	updates := make([]*StoredUpdate, 0, len(ids))
+	err := store.db.View(func(tx *bolt.Tx) error {
+		for _, id := range ids {
+			stored, err := getUpdate(tx, id)
+			if err != nil {
+				return err
+			}
+
+			if stored != nil {
+				updates = append(updates, stored)
+			}
+		}
+
+		return nil
+	})
+
+	sort.Slice(updates, func(i, j int) bool {
+		if !updates[i].Time.Equal(updates[j].Time) {
+			return updates[i].Time.After(updates[j].Time)
+		}
+		return updates[i].Id > updates[j].Id
+	})
+
+	return updates, err
+}
+
+func getUpdate(tx *bolt.Tx, id uint64) (*StoredUpdate, error) {
+	value := tx.Bucket(updatesBucket).Get(uint64Key(id))
+	if value == nil {
+		return nil, nil
+	}
+
+	stored := &StoredUpdate{}
+	if err := json.Unmarshal(value, stored); err != nil {
+		return nil, err
+	}
+
+	return stored, nil
+}
+
+// PruneUpdates drops updates older than retention and, past that, the oldest
+// updates beyond maxUpdates. Zero disables either limit.
+func (store *Store) PruneUpdates(retention time.Duration, maxUpdates int) (int, error) {
+	pruned := 0
+	err := store.db.Update(func(tx *bolt.Tx) error {
+		total := tx.Bucket(updatesBucket).Stats().KeyN
+		cutoff := time.Time{}
+		if retention > 0 {
+			cutoff = time.Now().Add(-retention)
+		}
+
+		cursor := tx.Bucket(updatesByTimeBucket).Cursor()
+		for key, _ := cursor.First(); key != nil; key, _ = cursor.First() {
+			tooOld := retention > 0 && timeFromIndexKey(key).Before(cutoff)
+			tooMany := maxUpdates > 0 && total-pruned > maxUpdates
+			if !tooOld && !tooMany {
+				break
+			}
+
+			stored, err := getUpdate(tx, seqFromIndexKey(key))
+			if err != nil {
+				return err
+			}
+
+			if stored == nil {
+				// Dangling index entry
+				if err := cursor.Delete(); err != nil {
+					return err
+				}
+				continue
+			}
+
+			if err := deleteUpdate(tx, stored); err != nil {
+				return err
+			}
+			pruned++
+		}
+
+		return nil
+	})
+
+	return pruned, err
+}
+
+func (store *Store) AddRun(run *djv_ads.RunResult) error {
+	value, err := json.Marshal(run)
+	if err != nil {
+		return err
+	}
+
+	return store.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(runsBucket).Put(runKey(run.StartTime), value)
+	})
+}
+
+// ListRuns returns runs newest first.
+func (store *Store) ListRuns(limit, offset int) ([]*djv_ads.RunResult, error) {
+	runs := make([]*djv_ads.RunResult, 0)
+	err := store.db.View(func(tx *bolt.Tx) error {
+		skipped := 0
+		cursor := tx.Bucket(runsBucket).Cursor()
+		for key, value := cursor.Last(); key != nil; key, value = cursor.Prev() {
+			if skipped < offset {
+				skipped++
+				continue
+			}
+
+			run := &djv_ads.RunResult{}
+			if err := json.Unmarshal(value, run); err != nil {
+				return err
+			}
+
+			runs = append(runs, run)
+			if limit > 0 && len(runs) >= limit {
+				break
+			}
+		}
+
+		return nil
+	})
+
+	return runs, err
+}
+
+// GetRun returns the run with the given RunId, nil if there's none.
+func (store *Store) GetRun(runId string) (*djv_ads.RunResult, error) {
+	nanos, err := strconv.ParseInt(runId, 10, 64)
+	if err != nil {
+		return nil, nil
+	}
+
+	var run *djv_ads.RunResult
+	err = store.db.View(func(tx *bolt.Tx) error {
+		value := tx.Bucket(runsBucket).Get(runKey(time.Unix(0, nanos)))
+		if value == nil {
+			return nil
+		}
+
+		run = &djv_ads.RunResult{}
+		return json.Unmarshal(value, run)
+	})
+
+	return run, err
+}
+
+func (store *Store) PruneRuns(retention time.Duration) (int, error) {
+	if retention <= 0 {
+		return 0, nil
+	}
+
+	pruned := 0
+	cutoff := runKey(time.Now().Add(-retention))
+	err := store.db.Update(func(tx *bolt.Tx) error {
+		cursor := tx.Bucket(runsBucket).Cursor()
+		for key, _ := cursor.First(); key != nil && bytes.Compare(key, cutoff) < 0; key, _ = cursor.First() {
+			if err := cursor.Delete(); err != nil {
+				return err
+			}
+			pruned++
+		}
+
+		return nil
+	})
+
+	return pruned, err
+}
+
+// AddSnapshot stores the account state under its timestamp and indexes the
+// price of every spot it saw placements for.
+func (store *Store) AddSnapshot(accountState *djv_ads.AccountState) error {
+	value, err := json.Marshal(accountState)
+	if err != nil {
+		return err
+	}
+
+	return store.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.Bucket(snapshotsBucket).Put(runKey(accountState.Timestamp), value); err != nil {
+			return err
+		}
+
+		for _, price := range spotPrices(accountState) {
+			value, err := json.Marshal(price)
+			if err != nil {
+				return err
+			}
+
+			key := append(spotPrefix(price.SpotId, price.CountryCode), runKey(price.Time)...)
+			if err := tx.Bucket(spotPricesBucket).Put(key, value); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// spotPrices collapses the bids in a snapshot to one price per spot and
+// country, since several of our campaigns can bid on the same spot.
+func spotPrices(accountState *djv_ads.AccountState) []*SpotPrice {
+	bidsBySpot := make(map[string][]*djv_ads.Bid)
+	for _, campaign := range accountState.Campaigns {
+		for _, bid := range campaign.Bids {
+			if len(bid.Placements) == 0 {
+				continue
+			}
+
+			key := string(spotPrefix(bid.SpotId, bid.CountryCode))
+			bidsBySpot[key] = append(bidsBySpot[key], bid)
+		}
+	}
+
+	prices := make([]*SpotPrice, 0, len(bidsBySpot))
+	for _, bids := range bidsBySpot {
+		// Every bid on the spot sees the same placement list
+		placements := bids[0].Placements
+		price := &SpotPrice{
+			Time:        accountState.Timestamp,
+			SpotId:      bids[0].SpotId,
+			CountryCode: bids[0].CountryCode,
+			TopBid:      placements[0].Bid,
+			Placements:  len(placements),
+		}
+
+		ours := make([]float64, 0, len(bids))
+		for _, bid := range bids {
+			ours = append(ours, bid.BidAmount)
+			if bid.BidAmount > price.OurBid {
+				price.OurBid = bid.BidAmount
+			}
+		}
+
+		for _, placement := range placements {
+			if !claimOwnBid(ours, placement.Bid) {
+				price.TopCompetitorBid = placement.Bid
+				break
+			}
+		}
+
+		prices = append(prices, price)
+	}
+
+	return prices
+}
+
+// claimOwnBid removes the first of our bids matching amount, reporting
+// whether there was one.
+func claimOwnBid(ours []float64, amount float64) bool {
+	for i, bid := range ours {
+		if math.Abs(bid-amount) < 0.0001 {
+			ours[i] = -1
+			return true
+		}
+	}
+
+	return false
+}
+
+// SpotHistory returns a spot's prices in a country between since and until,
+// oldest first. Zero values leave the range open.
+func (store *Store) SpotHistory(
+	spotId, countryCode string, since, until time.Time) ([]*SpotPrice, error) {
+
+	if until.IsZero() {
+		until = time.Unix(0, math.MaxInt64)
+	}
+
+	prefix := spotPrefix(spotId, countryCode)
+	lower := append(append([]byte{}, prefix...), timeKey(since)...)
+	upper := append(append([]byte{}, prefix...), timeKey(until)...)
+
+	prices := make([]*SpotPrice, 0)
+	err := store.db.View(func(tx *bolt.Tx) error {
+		cursor := tx.Bucket(spotPricesBucket).Cursor()
+		for key, value := cursor.Seek(lower); key != nil && bytes.Compare(key, upper) <= 0; key, value = cursor.Next() {
+			price := &SpotPrice{}
+			if err := json.Unmarshal(value, price); err != nil {
+				return err
+			}
+
+			prices = append(prices, price)
+		}
+
+		return nil
+	})
+
+	return prices, err
+}
+
+// SpotPriceAt returns the latest price seen for a spot at or before at, nil
+// if there's none.
+func (store *Store) SpotPriceAt(
+	spotId, countryCode string, at time.Time) (*SpotPrice, error) {
+
+	prefix := spotPrefix(spotId, countryCode)
+	upper := append(append([]byte{}, prefix...), timeKey(at)...)
+
+	var price *SpotPrice
+	err := store.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(spotPricesBucket)
+		key := seekLast(bucket.Cursor(), upper)
+		if key == nil || !bytes.HasPrefix(key, prefix) {
+			return nil
+		}
+
+		price = &SpotPrice{}
+		return json.Unmarshal(bucket.Get(key), price)
+	})
+
+	return price, err
+}
+
+// LatestSnapshot returns the most recent account state, nil if there's none.
+func (store *Store) LatestSnapshot() (*djv_ads.AccountState, error) {
+	var accountState *djv_ads.AccountState
+	err := store.db.View(func(tx *bolt.Tx) error {
+		_, value := tx.Bucket(snapshotsBucket).Cursor().Last()
+		if value == nil {
+			return nil
+		}
+
+		accountState = &djv_ads.AccountState{}
+		return json.Unmarshal(value, accountState)
+	})
+
+	return accountState, err
+}
+
+// PruneSnapshots drops full snapshots older than snapshotRetention and spot
+// prices older than priceRetention, returning how many of each went. The
+// prices are much smaller, so they're usually worth keeping longer. Zero keeps
+// either forever.
+func (store *Store) PruneSnapshots(
+	snapshotRetention, priceRetention time.Duration) (int, int, error) {
+
+	pruned, prunedPrices := 0, 0
+	err := store.db.Update(func(tx *bolt.Tx) error {
+		if snapshotRetention > 0 {
+			cutoff := runKey(time.Now().Add(-snapshotRetention))
+			cursor := tx.Bucket(snapshotsBucket).Cursor()
+			for key, _ := cursor.First(); key != nil && bytes.Compare(key, cutoff) < 0; key, _ = cursor.First() {
+				if err := cursor.Delete(); err != nil {
+					return err
+				}
+				pruned++
+			}
+		}
+
+		if priceRetention <= 0 {
+			return nil
+		}
+
+		// Prices are grouped by spot, so the whole bucket has to be walked
+		cutoff := time.Now().Add(-priceRetention)
+		bucket := tx.Bucket(spotPricesBucket)
+		expired := make([][]byte, 0)
+		err := bucket.ForEach(func(key, _ []byte) error {
+			at := time.Unix(0, int64(binary.BigEndian.Uint64(key[len(key)-8:])))
+			if at.Before(cutoff) {
+				expired = append(expired, append([]byte{}, key...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, key := range expired {
+			if err := bucket.Delete(key); err != nil {
+				return err
+			}
+			prunedPrices++
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return pruned, prunedPrices, nil
+}
+
+func (store *Store) PutSession(session *UISession) error {
+	value, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+
+	return store.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(sessionsBucket).Put([]byte(session.Token), value)
+	})
+}
+
+// GetSession returns the session for token, nil if it doesn't exist or has
+// expired.
+func (store *Store) GetSession(token string) (*UISession, error) {
+	var session *UISession
+	err := store.db.View(func(tx *bolt.Tx) error {
+		value := tx.Bucket(sessionsBucket).Get([]byte(token))
+		if value == nil {
+			return nil
+		}
+
+		session = &UISession{}
+		return json.Unmarshal(value, session)
+	})
+
+	if err != nil || session == nil || time.Now().After(session.Expires) {
+		return nil, err
+	}
+
+	return session, nil
+}
+
+func (store *Store) DeleteSession(token string) error {
+	return store.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(sessionsBucket).Delete([]byte(token))
+	})
+}
+
+func (store *Store) PruneSessions() (int, error) {
+	pruned := 0
+	now := time.Now()
+	err := store.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(sessionsBucket)
+		expired := make([][]byte, 0)
+		err := bucket.ForEach(func(key, value []byte) error {
+			session := &UISession{}
+			if err := json.Unmarshal(value, session); err != nil || now.After(session.Expires) {
+				expired = append(expired, append([]byte{}, key...))
+			}
+			return nil
+		})
+
+		if err != nil {
+			return err
+		}
+
+		for _, key := range expired {
+			if err := bucket.Delete(key); err != nil {
+				return err
+			}
+			pruned++
+		}
+
+		return nil
+	})
+
+	return pruned, err
+}
+
+// AddProposals stores a run's proposals as pending, expiring the pending
+// proposals for every campaign the run looked at.
+func (store *Store) AddProposals(
+	updates []*djv_ads.BidUpdate, runId string, campaignIds []string, at time.Time) (int, error) {
+
+	superseded := make(map[string]bool)
+	for _, campaignId := range campaignIds {
+		superseded[campaignId] = true
+	}
+
+	expired := 0
+	err := store.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(proposalsBucket)
+		err := updateProposals(bucket, func(proposal *Proposal) bool {
+			if proposal.Status != PROPOSAL_PENDING || !superseded[proposal.CampaignId] {
+				return false
+			}
+
+			proposal.Status = PROPOSAL_EXPIRED
+			proposal.DecidedAt = at
+			proposal.DecidedBy = "run " + runId
+			expired++
+			return true
+		})
+
+		if err != nil {
+			return err
+		}
+
+		for _, update := range updates {
+			id, err := bucket.NextSequence()
+			if err != nil {
+				return err
+			}
+
+			if err = putProposal(bucket, &Proposal{
+				BidUpdate: update,
+				Id:        id,
+				Status:    PROPOSAL_PENDING,
+				Created:   at,
+			}); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+
+	return expired, err
+}
+
+// ListProposals returns proposals newest first, all of them when status is
+// empty.
+func (store *Store) ListProposals(status string, limit int) ([]*Proposal, error) {
+	proposals := make([]*Proposal, 0)
+	err := store.db.View(func(tx *bolt.Tx) error {
+		cursor := tx.Bucket(proposalsBucket).Cursor()
+		for key, value := cursor.Last(); key != nil; key, value = cursor.Prev() {
+			proposal := &Proposal{}
+			if err := json.Unmarshal(value, proposal); err != nil {
+				return err
+			}
+
+			if status != "" && proposal.Status != status {
+				continue
+			}
+
+			proposals = append(proposals, proposal)
+			if limit > 0 && len(proposals) >= limit {
+				break
+			}
+		}
+
+		return nil
+	})
+
+	return proposals, err
+}
+
+// DecideProposals moves the given pending proposals, or all of them when ids
+// is empty, to status and returns the ones it moved. Proposals that were
+// already decided are left alone, so each is only ever applied once.
+func (store *Store) DecideProposals(
+	ids []uint64, status, decidedBy string, at time.Time) ([]*Proposal, error) {
+
+	wanted := make(map[uint64]bool)
+	for _, id := range ids {
+		wanted[id] = true
+	}
+
+	decided := make([]*Proposal, 0)
+	err := store.db.Update(func(tx *bolt.Tx) error {
+		return updateProposals(tx.Bucket(proposalsBucket), func(proposal *Proposal) bool {
+			if proposal.Status != PROPOSAL_PENDING || (len(ids) > 0 && !wanted[proposal.Id]) {
+				return false
+			}
+
+			proposal.Status = status
+			proposal.DecidedAt = at
+			proposal.DecidedBy = decidedBy
+			decided = append(decided, proposal)
+			return true
+		})
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return decided, nil
+}
+
+// SetProposalOutcome sets how an approved proposal turned out, and why when
+// it wasn't applied.
+func (store *Store) SetProposalOutcome(id uint64, status, reason string) error {
+	return store.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(proposalsBucket)
+		value := bucket.Get(uint64Key(id))
+		if value == nil {
+			return nil
+		}
+
+		proposal := &Proposal{}
+		if err := json.Unmarshal(value, proposal); err != nil {
+			return err
+		}
+
+		proposal.Status = status
+		proposal.Error = reason
+		return putProposal(bucket, proposal)
+	})
+}
+
+// PruneProposals drops decided proposals older than retention.
+func (store *Store) PruneProposals(retention time.Duration) (int, error) {
+	if retention <= 0 {
+		return 0, nil
+	}
+
+	pruned := 0
+	cutoff := time.Now().Add(-retention)
+	err := store.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(proposalsBucket)
+		old := make([][]byte, 0)
+		err := bucket.ForEach(func(key, value []byte) error {
+			proposal := &Proposal{}
+			if err := json.Unmarshal(value, proposal); err != nil {
+				return err
+			}
+
+			if proposal.Status != PROPOSAL_PENDING && proposal.Created.Before(cutoff) {
+				old = append(old, append([]byte{}, key...))
+			}
+			return nil
+		})
+
+		if err != nil {
+			return err
+		}
+
+		for _, key := range old {
+			if err := bucket.Delete(key); err != nil {
+				return err
+			}
+			pruned++
+		}
+
+		return nil
+	})
+
+	return pruned, err
+}
+
+// AddAuditEvent appends to the audit trail, which is never pruned.
+func (store *Store) AddAuditEvent(event *AuditEvent) error {
+	value, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	return store.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(auditBucket)
+		id, err := bucket.NextSequence()
+		if err != nil {
+			return err
+		}
+
+		return bucket.Put(uint64Key(id), value)
+	})
+}
+
+// ListAuditEvents returns the latest events, newest first. 0 means no limit.
+func (store *Store) ListAuditEvents(limit int) ([]*AuditEvent, error) {
+	events := make([]*AuditEvent, 0)
+	err := store.db.View(func(tx *bolt.Tx) error {
+		cursor := tx.Bucket(auditBucket).Cursor()
+		for key, value := cursor.Last(); key != nil; key, value = cursor.Prev() {
+			event := &AuditEvent{}
+			if err := json.Unmarshal(value, event); err != nil {
+				return err
+			}
+
+			events = append(events, event)
+			if limit > 0 && len(events) >= limit {
+				break
+			}
+		}
+
+		return nil
+	})
+
+	return events, err
+}
+
+func (store *Store) PutKillSwitch(state *KillSwitchState) error {
+	value, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	return store.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(metaBucket).Put(killSwitchKey, value)
+	})
+}
+
+// GetKillSwitch returns the saved kill switch, disengaged if there isn't one.
+func (store *Store) GetKillSwitch() (*KillSwitchState, error) {
+	state := &KillSwitchState{}
+	err := store.db.View(func(tx *bolt.Tx) error {
+		value := tx.Bucket(metaBucket).Get(killSwitchKey)
+		if value == nil {
+			return nil
+		}
+
+		return json.Unmarshal(value, state)
+	})
+
+	return state, err
+}
+
+// PutActiveWindows saves the daypart window each scheduled campaign is in,
+// keyed by campaign id.
+func (store *Store) PutActiveWindows(windows map[string]string) error {
+	value, err := json.Marshal(windows)
+	if err != nil {
+		return err
+	}
+
+	return store.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(metaBucket).Put(activeWindowsKey, value)
+	})
+}
+
+func (store *Store) GetActiveWindows() (map[string]string, error) {
+	windows := make(map[string]string)
+	err := store.db.View(func(tx *bolt.Tx) error {
+		value := tx.Bucket(metaBucket).Get(activeWindowsKey)
+		if value == nil {
+			return nil
+		}
+
+		return json.Unmarshal(value, &windows)
+	})
+
+	return windows, err
+}
+
+// updateProposals saves the proposals change reports as changed.
+func updateProposals(bucket *bolt.Bucket, change func(proposal *Proposal) bool) error {
+	changed := make([]*Proposal, 0)
+	err := bucket.ForEach(func(_, value []byte) error {
+		proposal := &Proposal{}
+		if err := json.Unmarshal(value, proposal); err != nil {
+			return err
+		}
+
+		if change(proposal) {
+			changed = append(changed, proposal)
+		}
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	for _, proposal := range changed {
+		if err := putProposal(bucket, proposal); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func putProposal(bucket *bolt.Bucket, proposal *Proposal) error {
+	value, err := json.Marshal(proposal)
+	if err != nil {
+		return err
+	}
+
+	return bucket.Put(uint64Key(proposal.Id), value)
+}
+
+// MigrateLogs imports the updates and runs JSONL files written by older
+// versions. Each file is only imported once, and is left in place.
+func (store *Store) MigrateLogs(updatesPath, runsPath string) error {
+	if err := store.migrateUpdatesLog(updatesPath); err != nil {
+		return err
+	}
+
+	return store.migrateRunsLog(runsPath)
+}
+
+func (store *Store) migrateUpdatesLog(path string) error {
+	if migrated, err := store.alreadyMigrated("updates_log", path); err != nil || migrated {
+		return err
+	}
+
+	updates, err := readUpdatesLog(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	err = store.db.Update(func(tx *bolt.Tx) error {
+		for _, update := range updates {
+			at, err := time.ParseInLocation(djv_ads.TimeFormat, update.Timestamp, djv_ads.Pacific)
+			if err != nil {
+				glog.Warningf("Unparseable timestamp %q in updates log", update.Timestamp)
+			}
+
+			if err := putUpdate(tx, update, at); err != nil {
+				return err
+			}
+		}
+
+		return tx.Bucket(metaBucket).Put([]byte("updates_log"), []byte(path))
+	})
+
+	if err != nil {
+		return err
+	}
+
+	glog.Infof("Imported %v updates from %v", len(updates), path)
+	return nil
+}
+
+func (store *Store) migrateRunsLog(path string) error {
+	if migrated, err := store.alreadyMigrated("runs_log", path); err != nil || migrated {
+		return err
+	}
+
+	runs, err := readRunsLog(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	for _, run := range runs {
+		if err := store.AddRun(run); err != nil {
+			return err
+		}
+	}
+
+	glog.Infof("Imported %v runs from %v", len(runs), path)
+
+	return store.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(metaBucket).Put([]byte("runs_log"), []byte(path))
+	})
+}
+
+func (store *Store) alreadyMigrated(name, path string) (bool, error) {
+	if path == "" {
+		return true, nil
+	}
+
+	migrated := false
+	err := store.db.View(func(tx *bolt.Tx) error {
+		migrated = string(tx.Bucket(metaBucket).Get([]byte(name))) == path
+		return nil
+	})
+
+	return migrated, err
+}
+
+func uint64Key(n uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, n)
+	return key
+}
+
+// timeSeqKey sorts by time, then by sequence for updates in the same instant.
+func timeSeqKey(t time.Time, seq uint64) []byte {
+	nanos := uint64(0)
+	if !t.IsZero() && t.UnixNano() > 0 {
+		nanos = uint64(t.UnixNano())
+	}
+
+	return append(uint64Key(nanos), uint64Key(seq)...)
+}
+
+func runKey(startTime time.Time) []byte {
+	return uint64Key(uint64(startTime.UnixNano()))
+}
+
+// timeKey is runKey clamped to the range of UnixNano, for open ended queries.
+func timeKey(t time.Time) []byte {
+	if t.IsZero() || t.UnixNano() <= 0 {
+		return uint64Key(0)
+	}
+
+	return runKey(t)
+}
+
+func spotPrefix(spotId, countryCode string) []byte {
+	return indexPrefix(spotId + "/" + countryCode)
+}
+
+// Index keys are prefix, 0 byte, then the time/seq key.
+func indexPrefix(id string) []byte {
+	return append([]byte(id), 0)
+}
+
+func seqFromIndexKey(key []byte) uint64 {
+	return binary.BigEndian.Uint64(key[len(key)-8:])
+}
+
+func timeFromIndexKey(key []byte) time.Time {
+	return time.Unix(0, int64(binary.BigEndian.Uint64(key[len(key)-16:len(key)-8])))
+}
+
+// seekLast positions the cursor on the last key <= upper.
+func seekLast(cursor *bolt.Cursor, upper []byte) []byte {
+	key, _ := cursor.Seek(upper)
+	if key == nil {
+		key, _ = cursor.Last()
+	} else if bytes.Compare(key, upper) > 0 {
+		key, _ = cursor.Prev()
+	}
+
+	return key
+}
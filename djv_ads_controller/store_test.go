@@ -0,0 +1,371 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/emef/djv_ads"
+)
+
+func openTestStore(t *testing.T) *Store {
+	t.Helper()
+
+	store, err := OpenStore(filepath.Join(t.TempDir(), "history.db"))
+	if err != nil {
+		t.Fatalf("opening store: %v", err)
+	}
+	t.Cleanup(func() { store.Close() })
+
+	return store
+}
+
+func testUpdate(campaignId, bidId string, newBid float64) *djv_ads.BidUpdate {
+	return &djv_ads.BidUpdate{
+		RunId:       "1",
+		CampaignId:  campaignId,
+		BidId:       bidId,
+		CountryCode: djv_ads.DefaultCountryCode,
+		PreviousBid: 0.05,
+		NewBid:      newBid,
+	}
+}
+
+func bidIds(updates []*StoredUpdate) []string {
+	ids := make([]string, 0, len(updates))
+	for _, update := range updates {
+		ids = append(ids, update.BidId)
+	}
+
+	return ids
+}
+
+func TestStoreListUpdates(t *testing.T) {
+	store := openTestStore(t)
+
+	start := time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+	for i, update := range []*djv_ads.BidUpdate{
+		testUpdate("1", "11", 0.10),
+		testUpdate("1", "12", 0.11),
+		testUpdate("2", "21", 0.12),
+		testUpdate("1", "11", 0.13),
+	} {
+		at := start.Add(time.Duration(i) * time.Hour)
+		if err := store.AddUpdates([]*djv_ads.BidUpdate{update}, at); err != nil {
+			t.Fatalf("adding update: %v", err)
+		}
+	}
+
+	tests := []struct {
+		name     string
+		query    UpdateQuery
+		expected []string
+	}{
+		{"everything newest first", UpdateQuery{}, []string{"11", "21", "12", "11"}},
+		{"by campaign", UpdateQuery{CampaignId: "1"}, []string{"11", "12", "11"}},
+		{"by bid", UpdateQuery{BidId: "11"}, []string{"11", "11"}},
+		{"since", UpdateQuery{Since: start.Add(2 * time.Hour)}, []string{"11", "21"}},
+		{"until", UpdateQuery{Until: start.Add(time.Hour)}, []string{"12", "11"}},
+		{"page", UpdateQuery{Limit: 2, Offset: 1}, []string{"21", "12"}},
+		{"campaign page", UpdateQuery{CampaignId: "1", Limit: 1, Offset: 1}, []string{"12"}},
+	}
+
+	for _, test := range tests {
+		updates, err := store.ListUpdates(test.query)
+		if err != nil {
+			t.Errorf("%v: %v", test.name, err)
+			continue
+		}
+
+		if got := bidIds(updates); !equalStrings(got, test.expected) {
+			t.Errorf("%v: expected %v, got %v", test.name, test.expected, got)
+		}
+	}
+
+	updates, err := store.GetUpdates([]uint64{1, 4, 99})
+	if err != nil || !equalStrings(bidIds(updates), []string{"11", "11"}) ||
+		updates[0].NewBid != 0.13 {
+
+		t.Errorf("expected updates 4 and 1, got %v %v", updates, err)
+	}
+}
+
+func TestStorePruneUpdates(t *testing.T) {
+	store := openTestStore(t)
+
+	now := time.Now()
+	for i, age := range []time.Duration{72 * time.Hour, 48 * time.Hour, time.Hour, 0} {
+		update := testUpdate("1", strconv.Itoa(i), 0.10)
+		if err := store.AddUpdates([]*djv_ads.BidUpdate{update}, now.Add(-age)); err != nil {
+			t.Fatalf("adding update: %v", err)
+		}
+	}
+
+	pruned, err := store.PruneUpdates(60*time.Hour, 0)
+	if err != nil || pruned != 1 {
+		t.Errorf("expected 1 update past retention, pruned %v %v", pruned, err)
+	}
+
+	pruned, err = store.PruneUpdates(0, 2)
+	if err != nil || pruned != 1 {
+		t.Errorf("expected 1 update over the max, pruned %v %v", pruned, err)
+	}
+
+	// The indexes go with them
+	for _, query := range []UpdateQuery{{}, {CampaignId: "1"}, {BidId: "1"}} {
+		updates, err := store.ListUpdates(query)
+		if err != nil {
+			t.Fatalf("listing updates: %v", err)
+		}
+
+		expected := []string{"3", "2"}
+		if query.BidId != "" {
+			expected = []string{}
+		}
+
+		if got := bidIds(updates); !equalStrings(got, expected) {
+			t.Errorf("%+v: expected %v after pruning, got %v", query, expected, got)
+		}
+	}
+}
+
+func TestStoreRuns(t *testing.T) {
+	store := openTestStore(t)
+
+	now := time.Now()
+	for _, age := range []time.Duration{48 * time.Hour, 2 * time.Hour, time.Hour} {
+		start := now.Add(-age)
+		run := &djv_ads.RunResult{
+			RunId:     strconv.FormatInt(start.UnixNano(), 10),
+			StartTime: start,
+			EndTime:   start.Add(time.Minute),
+		}
+		if err := store.AddRun(run); err != nil {
+			t.Fatalf("adding run: %v", err)
+		}
+	}
+
+	runs, err := store.ListRuns(2, 0)
+	if err != nil || len(runs) != 2 || !runs[0].StartTime.After(runs[1].StartTime) {
+		t.Fatalf("expected the 2 newest runs, newest first: %v %v", runs, err)
+	}
+
+	run, err := store.GetRun(runs[1].RunId)
+	if err != nil || run == nil || !run.StartTime.Equal(runs[1].StartTime) {
+		t.Errorf("expected to get run %v, got %v %v", runs[1].RunId, run, err)
+	}
+
+	if run, err = store.GetRun("not a run"); err != nil || run != nil {
+		t.Errorf("expected no run, got %v %v", run, err)
+	}
+
+	pruned, err := store.PruneRuns(24 * time.Hour)
+	if err != nil || pruned != 1 {
+		t.Errorf("expected 1 old run pruned, got %v %v", pruned, err)
+	}
+}
+
+func testSnapshot(at time.Time, ourBids ...float64) *djv_ads.AccountState {
+	placements := []*djv_ads.Placement{
+		{Position: 1, Bid: 0.30},
+		{Position: 2, Bid: 0.20},
+		{Position: 3, Bid: 0.20},
+		{Position: 4, Bid: 0.10},
+	}
+
+	// Two of our campaigns on the same spot see the same placements
+	campaigns := make(map[string]*djv_ads.Campaign)
+	for i, amount := range ourBids {
+		campaignId := strconv.Itoa(i + 1)
+		campaigns[campaignId] = &djv_ads.Campaign{
+			CampaignId: campaignId,
+			Bids: map[string]*djv_ads.Bid{
+				"11/US": {BidId: "11", SpotId: "37", CountryCode: "US",
+					BidAmount: amount, Placements: placements},
+			},
+		}
+	}
+
+	return &djv_ads.AccountState{Timestamp: at, Campaigns: campaigns}
+}
+
+func TestStoreSpotPrices(t *testing.T) {
+	store := openTestStore(t)
+
+	start := time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+	for i, ourBids := range [][]float64{{0.30}, {0.20, 0.30}, {0.20, 0.10}} {
+		snapshot := testSnapshot(start.Add(time.Duration(i)*time.Hour), ourBids...)
+		if err := store.AddSnapshot(snapshot); err != nil {
+			t.Fatalf("adding snapshot: %v", err)
+		}
+	}
+
+	history, err := store.SpotHistory("37", "US", time.Time{}, time.Time{})
+	if err != nil || len(history) != 3 {
+		t.Fatalf("expected 3 prices for the spot, got %v %v", history, err)
+	}
+
+	// Only one of the tied 0.20 placements is ours
+	expected := []struct{ topCompetitor, ours float64 }{{0.20, 0.30}, {0.20, 0.30}, {0.30, 0.20}}
+	for i, price := range history {
+		if price.TopBid != 0.30 || price.Placements != 4 ||
+			price.TopCompetitorBid != expected[i].topCompetitor || price.OurBid != expected[i].ours {
+
+			t.Errorf("price %v is %+v, expected %+v", i, price, expected[i])
+		}
+	}
+
+	history, _ = store.SpotHistory("37", "US", start.Add(time.Hour), start.Add(time.Hour))
+	if len(history) != 1 || !history[0].Time.Equal(start.Add(time.Hour)) {
+		t.Errorf("expected just the second price, got %v", history)
+	}
+
+	if history, _ = store.SpotHistory("37", "CA", time.Time{}, time.Time{}); len(history) != 0 {
+		t.Errorf("expected no prices in CA, got %v", history)
+	}
+
+	price, err := store.SpotPriceAt("37", "US", start.Add(90*time.Minute))
+	if err != nil || price == nil || !price.Time.Equal(start.Add(time.Hour)) {
+		t.Errorf("expected the price from the second snapshot, got %v %v", price, err)
+	}
+
+	if price, err = store.SpotPriceAt("37", "US", start.Add(-time.Minute)); err != nil || price != nil {
+		t.Errorf("expected no price before the first snapshot, got %v %v", price, err)
+	}
+
+	latest, err := store.LatestSnapshot()
+	if err != nil || latest == nil || !latest.Timestamp.Equal(start.Add(2*time.Hour)) {
+		t.Errorf("expected the last snapshot, got %v %v", latest, err)
+	}
+}
+
+func TestStorePruneSnapshots(t *testing.T) {
+	store := openTestStore(t)
+
+	now := time.Now()
+	for _, age := range []time.Duration{72 * time.Hour, 48 * time.Hour, time.Hour} {
+		if err := store.AddSnapshot(testSnapshot(now.Add(-age), 0.20)); err != nil {
+			t.Fatalf("adding snapshot: %v", err)
+		}
+	}
+
+	pruned, prunedPrices, err := store.PruneSnapshots(24*time.Hour, 60*time.Hour)
+	if err != nil || pruned != 2 || prunedPrices != 1 {
+		t.Errorf("expected 2 snapshots and 1 price pruned, got %v %v %v",
+			pruned, prunedPrices, err)
+	}
+
+	if history, _ := store.SpotHistory("37", "US", time.Time{}, time.Time{}); len(history) != 2 {
+		t.Errorf("expected 2 prices left, got %v", len(history))
+	}
+
+	latest, _ := store.LatestSnapshot()
+	if latest == nil || !latest.Timestamp.Equal(now.Add(-time.Hour)) {
+		t.Errorf("expected the newest snapshot to be kept, got %v", latest)
+	}
+
+	// Zero keeps everything
+	pruned, prunedPrices, err = store.PruneSnapshots(0, 0)
+	if err != nil || pruned != 0 || prunedPrices != 0 {
+		t.Errorf("expected nothing pruned, got %v %v %v", pruned, prunedPrices, err)
+	}
+}
+
+func writeJsonLines(t *testing.T, path string, values ...interface{}) {
+	t.Helper()
+
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatalf("creating %v: %v", path, err)
+	}
+	defer file.Close()
+
+	encoder := json.NewEncoder(file)
+	for _, value := range values {
+		if err := encoder.Encode(value); err != nil {
+			t.Fatalf("writing %v: %v", path, err)
+		}
+	}
+}
+
+func TestStoreMigrateLogs(t *testing.T) {
+	store := openTestStore(t)
+	dir := t.TempDir()
+
+	update := testUpdate("1", "11", 0.10)
+	update.Timestamp = "2026-10-01 9:15am"
+	updatesPath := filepath.Join(dir, "updates.log")
+	writeJsonLines(t, updatesPath, update, testUpdate("1", "12", 0.11))
+
+	start := time.Date(2026, 10, 1, 16, 0, 0, 0, time.UTC)
+	runsPath := filepath.Join(dir, "runs.log")
+	writeJsonLines(t, runsPath, &djv_ads.RunResult{
+		RunId:     strconv.FormatInt(start.UnixNano(), 10),
+		StartTime: start,
+	})
+
+	if err := store.MigrateLogs(updatesPath, runsPath); err != nil {
+		t.Fatalf("migrating logs: %v", err)
+	}
+
+	// Importing again is a no-op
+	if err := store.MigrateLogs(updatesPath, runsPath); err != nil {
+		t.Fatalf("migrating logs again: %v", err)
+	}
+
+	updates, err := store.ListUpdates(UpdateQuery{BidId: "11"})
+	if err != nil || len(updates) != 1 {
+		t.Fatalf("expected the imported update, got %v %v", updates, err)
+	}
+
+	at := time.Date(2026, 10, 1, 9, 15, 0, 0, djv_ads.Pacific)
+	if !updates[0].Time.Equal(at) {
+		t.Errorf("expected the update at its logged time %v, got %v", at, updates[0].Time)
+	}
+
+	if updates, _ = store.ListUpdates(UpdateQuery{}); len(updates) != 2 {
+		t.Errorf("expected 2 updates imported once, got %v", len(updates))
+	}
+
+	if runs, _ := store.ListRuns(0, 0); len(runs) != 1 {
+		t.Errorf("expected 1 run imported once, got %v", len(runs))
+	}
+}
+
+func TestStoreMigrateRunsWithoutUpdatesLog(t *testing.T) {
+	store := openTestStore(t)
+	dir := t.TempDir()
+
+	start := time.Date(2026, 10, 1, 16, 0, 0, 0, time.UTC)
+	runsPath := filepath.Join(dir, "runs.log")
+	writeJsonLines(t, runsPath, &djv_ads.RunResult{
+		RunId:     strconv.FormatInt(start.UnixNano(), 10),
+		StartTime: start,
+	})
+
+	err := store.MigrateLogs(filepath.Join(dir, "missing.log"), runsPath)
+	if err != nil {
+		t.Fatalf("migrating logs: %v", err)
+	}
+
+	if runs, _ := store.ListRuns(0, 0); len(runs) != 1 {
+		t.Errorf("expected the runs log to be imported, got %v runs", len(runs))
+	}
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,235 @@
+package djv_ads
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/golang/glog"
+)
+
+const (
+	GuardrailBidChange        = "bid_change"
+	GuardrailBidChangePercent = "bid_change_percent"
+	GuardrailUpdatesPerRun    = "updates_per_run"
+	GuardrailHourlySpend      = "hourly_spend"
+)
+
+type GuardrailAction int
+
+const (
+	// Apply none of the run's updates.
+	RefuseOnGuardrail GuardrailAction = iota
+	// Hold back only the updates that break a limit.
+	PartialOnGuardrail
+)
+
+// Guardrails cap how much a single run is allowed to change, to keep a bad
+// scrape or setting from going live. Zero values turn a limit off.
+type Guardrails struct {
+	// Largest change to one bid, in dollars
+	MaxBidChange float64
+	// Largest change to one bid, as a percentage of its previous amount
+	MaxBidChangePercent float64
+	MaxUpdatesPerRun    int
+	// Largest projected increase in hourly spend across the run, in dollars.
+	// Only increases count, cheaper bids don't make room for more.
+	MaxHourlySpendIncrease float64
+	// Estimated impressions an hour by spot id, used to project spend from
+	// the CPM bids. Spots that aren't listed use DefaultHourlyImpressions.
+	SpotHourlyImpressions    map[string]float64
+	DefaultHourlyImpressions float64
+	Action                   GuardrailAction
+}
+
+// GuardrailTrip records a limit a run broke.
+type GuardrailTrip struct {
+	Guardrail string
+	// Empty for limits on the whole run
+	BidId  string
+	Reason string
+}
+
+func WithGuardrails(guardrails Guardrails) Option {
+	return func(controller *AdsController) error {
+		if err := guardrails.Validate(); err != nil {
+			return err
+		}
+
+		controller.guardrails = &guardrails
+		return nil
+	}
+}
+
+func (guardrails *Guardrails) Validate() error {
+	if guardrails.MaxBidChange < 0 || guardrails.MaxBidChangePercent < 0 ||
+		guardrails.MaxUpdatesPerRun < 0 || guardrails.MaxHourlySpendIncrease < 0 ||
+		guardrails.DefaultHourlyImpressions < 0 {
+		return errors.New("Guardrails must not be negative")
+	}
+
+	for spotId, impressions := range guardrails.SpotHourlyImpressions {
+		if impressions < 0 {
+			return fmt.Errorf("Hourly impressions for spot %v must not be negative", spotId)
+		}
+	}
+
+	if guardrails.MaxHourlySpendIncrease > 0 && guardrails.DefaultHourlyImpressions == 0 &&
+		len(guardrails.SpotHourlyImpressions) == 0 {
+		return errors.New("Hourly spend guardrail needs hourly impression estimates")
+	}
+
+	return nil
+}
+
+// hourlySpendIncrease projects how much more a bid would spend an hour, bids
+// being CPM.
+func (guardrails *Guardrails) hourlySpendIncrease(update *BidUpdate) float64 {
+	increase := update.NewBid - update.PreviousBid
+	if increase <= 0 {
+		return 0
+	}
+
+	impressions, ok := guardrails.SpotHourlyImpressions[update.SpotId]
+	if !ok {
+		impressions = guardrails.DefaultHourlyImpressions
+	}
+
+	return increase * impressions / 1000
+}
+
+func (guardrails *Guardrails) checkBid(update *BidUpdate) *GuardrailTrip {
+	change := update.NewBid - update.PreviousBid
+	if change < 0 {
+		change = -change
+	}
+
+	if guardrails.MaxBidChange > 0 && change > guardrails.MaxBidChange {
+		return &GuardrailTrip{
+			Guardrail: GuardrailBidChange,
+			BidId:     update.BidId,
+			Reason: fmt.Sprintf("change %.4f -> %.4f is over the max change of %.4f",
+				update.PreviousBid, update.NewBid, guardrails.MaxBidChange),
+		}
+	}
+
+	// A percentage of nothing is meaningless, MaxBidChange covers those
+	if guardrails.MaxBidChangePercent > 0 && update.PreviousBid > 0 {
+		percent := change / update.PreviousBid * 100
+		if percent > guardrails.MaxBidChangePercent {
+			return &GuardrailTrip{
+				Guardrail: GuardrailBidChangePercent,
+				BidId:     update.BidId,
+				Reason: fmt.Sprintf("change %.4f -> %.4f is %.0f%%, over the max of %.0f%%",
+					update.PreviousBid, update.NewBid, percent,
+					guardrails.MaxBidChangePercent),
+			}
+		}
+	}
+
+	return nil
+}
+
+// enforceGuardrails moves the proposed updates that can't be applied to the
+// skipped ones and records why.
+func (controller *AdsController) enforceGuardrails(result *RunResult) {
+	guardrails := controller.guardrails
+	if guardrails == nil || len(result.Proposed) == 0 {
+		return
+	}
+
+	trips := make([]*GuardrailTrip, 0)
+	held := make(map[*BidUpdate]string)
+
+	allowed := make([]*BidUpdate, 0, len(result.Proposed))
+	for _, update := range result.Proposed {
+		if trip := guardrails.checkBid(update); trip != nil {
+			trips = append(trips, trip)
+			held[update] = trip.Reason
+			continue
+		}
+
+		allowed = append(allowed, update)
+	}
+
+	// Cuts in spend first, then the cheapest increases, so a partial run
+	// gets as many updates in as the run limits allow
+	sort.SliceStable(allowed, func(i, j int) bool {
+		iSpend := guardrails.hourlySpendIncrease(allowed[i])
+		jSpend := guardrails.hourlySpendIncrease(allowed[j])
+		if iSpend != jSpend {
+			return iSpend < jSpend
+		}
+		return allowed[i].NewBid-allowed[i].PreviousBid <
+			allowed[j].NewBid-allowed[j].PreviousBid
+	})
+
+	kept, overCount, overSpend := 0, 0, 0
+	spend := 0.0
+	for _, update := range allowed {
+		if guardrails.MaxUpdatesPerRun > 0 && kept >= guardrails.MaxUpdatesPerRun {
+			overCount++
+			held[update] = fmt.Sprintf("over the max of %v updates per run",
+				guardrails.MaxUpdatesPerRun)
+			continue
+		}
+
+		increase := guardrails.hourlySpendIncrease(update)
+		if guardrails.MaxHourlySpendIncrease > 0 &&
+			spend+increase > guardrails.MaxHourlySpendIncrease {
+
+			overSpend++
+			held[update] = fmt.Sprintf("projected hourly spend increase over $%.2f",
+				guardrails.MaxHourlySpendIncrease)
+			continue
+		}
+
+		kept++
+		spend += increase
+	}
+
+	if overCount > 0 {
+		trips = append(trips, &GuardrailTrip{
+			Guardrail: GuardrailUpdatesPerRun,
+			Reason: fmt.Sprintf("%v updates proposed, the max is %v per run",
+				len(allowed), guardrails.MaxUpdatesPerRun),
+		})
+	}
+
+	if overSpend > 0 {
+		trips = append(trips, &GuardrailTrip{
+			Guardrail: GuardrailHourlySpend,
+			Reason: fmt.Sprintf("%v updates would take the projected hourly spend "+
+				"increase over $%.2f", overSpend, guardrails.MaxHourlySpendIncrease),
+		})
+	}
+
+	if len(trips) == 0 {
+		return
+	}
+
+	for _, trip := range trips {
+		glog.Warningf("Guardrail %v tripped: bidId=%v %v", trip.Guardrail, trip.BidId, trip.Reason)
+	}
+	result.GuardrailTrips = trips
+
+	proposed := make([]*BidUpdate, 0, len(result.Proposed))
+	for _, update := range result.Proposed {
+		reason, ok := held[update]
+		if !ok && guardrails.Action == PartialOnGuardrail {
+			proposed = append(proposed, update)
+			continue
+		}
+
+		if !ok {
+			reason = "run refused by guardrails"
+		}
+
+		update.Skipped = true
+		update.Reason = "held: " + reason
+		result.Skipped = append(result.Skipped, update)
+	}
+
+	result.Proposed = proposed
+	result.Refused = guardrails.Action == RefuseOnGuardrail
+}
@@ -0,0 +1,145 @@
+package djv_ads
+
+import (
+	"fmt"
+	"strings"
+)
+
+// BidLimit bounds the bids the controller is allowed to set. A zero MinBid or
+// MaxBid leaves that side unbounded.
+type BidLimit struct {
+	MinBid float64
+	MaxBid float64
+}
+
+type LimitAction int
+
+const (
+	// Move the new bid to the nearest allowed value.
+	ClampToLimit LimitAction = iota
+	// Leave the bid as it is.
+	SkipOnLimit
+)
+
+func WithCampaignBidLimit(campaignId string, minBid, maxBid float64) Option {
+	return func(controller *AdsController) error {
+		limit, err := newBidLimit(minBid, maxBid)
+		if err != nil {
+			return err
+		}
+
+		controller.campaignLimits[campaignId] = limit
+		return nil
+	}
+}
+
+func WithCountryBidLimit(countryCode string, minBid, maxBid float64) Option {
+	return func(controller *AdsController) error {
+		limit, err := newBidLimit(minBid, maxBid)
+		if err != nil {
+			return err
+		}
+
+		controller.countryLimits[strings.ToUpper(countryCode)] = limit
+		return nil
+	}
+}
+
+func WithSpotBidLimit(campaignId, spotId string, minBid, maxBid float64) Option {
+	return func(controller *AdsController) error {
+		limit, err := newBidLimit(minBid, maxBid)
+		if err != nil {
+			return err
+		}
+
+		controller.spotLimits[spotLimitKey(campaignId, spotId)] = limit
+		return nil
+	}
+}
+
+func OnLimitExceeded(action LimitAction) Option {
+	return func(controller *AdsController) error {
+		controller.limitAction = action
+		return nil
+	}
+}
+
+func newBidLimit(minBid, maxBid float64) (*BidLimit, error) {
+	if minBid < 0 || maxBid < 0 {
+		return nil, fmt.Errorf("Bid limits must not be negative: min=%v max=%v",
+			minBid, maxBid)
+	}
+
+	if maxBid > 0 && minBid > maxBid {
+		return nil, fmt.Errorf("Min bid %v is above max bid %v", minBid, maxBid)
+	}
+
+	return &BidLimit{MinBid: minBid, MaxBid: maxBid}, nil
+}
+
+func spotLimitKey(campaignId, spotId string) string {
+	return campaignId + "/" + spotId
+}
+
+// effectiveLimit merges the campaign, country and spot limits for a bid, the
+// more specific limit taking precedence for each side it sets.
+func (controller *AdsController) effectiveLimit(
+	campaignId, countryCode, spotId string) BidLimit {
+
+	limit := BidLimit{}
+	overrides := []*BidLimit{
+		controller.campaignLimits[campaignId],
+		controller.countryLimits[countryCode],
+		controller.spotLimits[spotLimitKey(campaignId, spotId)],
+	}
+
+	for _, override := range overrides {
+		if override == nil {
+			continue
+		}
+
+		if override.MinBid > 0 {
+			limit.MinBid = override.MinBid
+		}
+
+		if override.MaxBid > 0 {
+			limit.MaxBid = override.MaxBid
+		}
+	}
+
+	return limit
+}
+
+// enforceLimits clamps or skips an update that falls outside its bid limit,
+// recording the reason on the update.
+func (controller *AdsController) enforceLimits(update *BidUpdate) {
+	limit := controller.effectiveLimit(
+		update.CampaignId, update.CountryCode, update.SpotId)
+
+	var bound float64
+	var reason string
+	if limit.MaxBid > 0 && update.NewBid > limit.MaxBid {
+		bound = limit.MaxBid
+		reason = fmt.Sprintf("bid %.4f above max bid %.4f", update.NewBid, limit.MaxBid)
+	} else if limit.MinBid > 0 && update.NewBid < limit.MinBid {
+		bound = limit.MinBid
+		reason = fmt.Sprintf("bid %.4f below min bid %.4f", update.NewBid, limit.MinBid)
+	} else {
+		return
+	}
+
+	if controller.limitAction == SkipOnLimit {
+		update.Skipped = true
+		update.Reason = "skipped: " + reason
+		return
+	}
+
+	update.NewBid = bound
+	update.Reason = "clamped: " + reason
+
+	// Clamping may bring us right back to where we already are
+	bidDelta := update.NewBid - update.PreviousBid
+	if bidDelta > -0.0001 && bidDelta < 0.0001 {
+		update.Skipped = true
+	}
+}
@@ -0,0 +1,164 @@
+package djv_ads
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// RollbackConflict is an update that wasn't rolled back because the live bid
+// no longer matches what it set.
+type RollbackConflict struct {
+	Update *BidUpdate
+	// 0 when the bid couldn't be found
+	LiveBid float64
+	Reason  string
+}
+
+type RollbackResult struct {
+	// The updates that put the previous bids back
+	RolledBack []*BidUpdate
+	Conflicts  []*RollbackConflict
+	Errors     []*BidError
+}
+
+// RollbackUpdates sets each update's bid back to its PreviousBid, as long as
+// the live bid is still the NewBid it set. Updates should be newest first so
+// several changes to one bid unwind in order.
+func RollbackUpdates(
+	ctx context.Context, client TJClient, updates []*BidUpdate) *RollbackResult {
+
+	result := &RollbackResult{}
+	liveBids := NewLiveBids(client)
+
+	for _, update := range updates {
+		liveBid, conflict, err := liveBids.Conflict(
+			ctx, update.CampaignId, update.BidId, update.NewBid)
+		if err != nil {
+			glog.Errorf("Error getting bids for campaign %v: %v", update.CampaignId, err)
+			result.Errors = append(result.Errors, &BidError{
+				CampaignId: update.CampaignId,
+				Operation:  OpGetBids,
+				Error:      err.Error(),
+			})
+			continue
+		}
+
+		if conflict != "" {
+			result.Conflicts = append(result.Conflicts, &RollbackConflict{
+				Update:  update,
+				LiveBid: liveBid,
+				Reason:  conflict,
+			})
+			continue
+		}
+
+		if err := client.UpdateBid(ctx, update.BidId, update.PreviousBid); err != nil {
+			glog.Errorf("Error rolling back bid %v: %v", update.BidId, err)
+			result.Errors = append(result.Errors, &BidError{
+				CampaignId:  update.CampaignId,
+				BidId:       update.BidId,
+				SpotId:      update.SpotId,
+				CountryCode: update.CountryCode,
+				Operation:   OpUpdateBid,
+				Error:       err.Error(),
+			})
+			continue
+		}
+
+		liveBids.Set(update.CampaignId, update.BidId, update.PreviousBid)
+
+		reason := "rollback"
+		if update.RunId != "" {
+			reason += " of run " + update.RunId
+		}
+
+		// No RunId, rolling back the run again shouldn't pick these up
+		result.RolledBack = append(result.RolledBack, &BidUpdate{
+			CampaignId:  update.CampaignId,
+			BidId:       update.BidId,
+			SpotId:      update.SpotId,
+			CountryCode: update.CountryCode,
+			PreviousBid: update.NewBid,
+			NewBid:      update.PreviousBid,
+			Timestamp:   time.Now().In(Pacific).Format(TimeFormat),
+			Reason:      reason,
+		})
+	}
+
+	return result
+}
+
+// LiveBids looks up bids as they are on TJ right now, fetching each campaign's
+// bids the first time one of them is asked for.
+type LiveBids struct {
+	client TJClient
+	// By campaign then bid id
+	campaigns map[string]map[string]float64
+}
+
+func NewLiveBids(client TJClient) *LiveBids {
+	return &LiveBids{
+		client:    client,
+		campaigns: make(map[string]map[string]float64),
+	}
+}
+
+// Conflict returns the live bid and why it isn't the expected amount, or an
+// empty reason when it is. The live bid is 0 when the bid couldn't be found.
+func (liveBids *LiveBids) Conflict(
+	ctx context.Context, campaignId, bidId string, expected float64) (float64, string, error) {
+
+	campaignBids, ok := liveBids.campaigns[campaignId]
+	if !ok {
+		var err error
+		campaignBids, err = getLiveBids(ctx, liveBids.client, campaignId)
+		if err != nil {
+			return 0, "", err
+		}
+		liveBids.campaigns[campaignId] = campaignBids
+	}
+
+	liveBid, ok := campaignBids[bidId]
+	if !ok {
+		return 0, "bid no longer exists", nil
+	}
+
+	if math.Abs(liveBid-expected) >= 0.0001 {
+		return liveBid, fmt.Sprintf("live bid %.4f is no longer %.4f", liveBid, expected), nil
+	}
+
+	return liveBid, "", nil
+}
+
+// Set records a bid we just changed, so later lookups see it.
+func (liveBids *LiveBids) Set(campaignId, bidId string, amount float64) {
+	if campaignBids, ok := liveBids.campaigns[campaignId]; ok {
+		campaignBids[bidId] = amount
+	}
+}
+
+func getLiveBids(
+	ctx context.Context, client TJClient, campaignId string) (map[string]float64, error) {
+
+	bidsJson, err := client.GetBidsForCampaign(ctx, campaignId)
+	if err != nil {
+		return nil, err
+	}
+
+	bids := make(map[string]float64)
+	for _, bidJson := range bidsJson.BidMap {
+		amount, err := strconv.ParseFloat(bidJson.BidAmount, 64)
+		if err != nil {
+			glog.Errorf("Error parsing bidAmount: %s", bidJson.BidAmount)
+			continue
+		}
+		bids[bidJson.BidId] = amount
+	}
+
+	return bids, nil
+}
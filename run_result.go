@@ -0,0 +1,69 @@
+package djv_ads
+
+import (
+	"strconv"
+	"time"
+)
+
+const (
+	OpGetBids       = "get_bids"
+	OpGetStats      = "get_stats"
+	OpParseBid      = "parse_bid"
+	OpPlacementList = "placement_list"
+	OpUpdateBid     = "update_bid"
+)
+
+// RunResult describes everything a single RunOnce call looked at and did.
+type RunResult struct {
+	RunId            string
+	StartTime        time.Time
+	EndTime          time.Time
+	ReadOnly         bool
+	CampaignsScanned int
+	BidsEvaluated    int
+	// Updates the strategy wanted and that passed the bid limits and guardrails
+	Proposed []*BidUpdate
+	// Proposed updates that TJ accepted
+	Applied []*BidUpdate
+	// Updates dropped by the bid limits or guardrails, with their Reason
+	Skipped []*BidUpdate
+	Errors  []*BidError
+	// Limits the run broke, and whether that stopped all its updates
+	GuardrailTrips []*GuardrailTrip
+	Refused        bool
+	// Set when the run failed before it could evaluate any bids
+	Error string
+	// What the run saw, kept out of the serialized result to keep it small
+	AccountState *AccountState `json:"-"`
+}
+
+// BidError records a failed TJ call for a single campaign or bid.
+type BidError struct {
+	CampaignId  string
+	BidId       string
+	SpotId      string
+	CountryCode string
+	Operation   string
+	Error       string
+}
+
+func newRunResult(startTime time.Time, readOnly bool) *RunResult {
+	return &RunResult{
+		RunId:          strconv.FormatInt(startTime.UnixNano(), 10),
+		StartTime:      startTime,
+		ReadOnly:       readOnly,
+		Proposed:       make([]*BidUpdate, 0),
+		Applied:        make([]*BidUpdate, 0),
+		Skipped:        make([]*BidUpdate, 0),
+		Errors:         make([]*BidError, 0),
+		GuardrailTrips: make([]*GuardrailTrip, 0),
+	}
+}
+
+func (result *RunResult) Duration() time.Duration {
+	return result.EndTime.Sub(result.StartTime)
+}
+
+func (result *RunResult) Failed() bool {
+	return result.Error != ""
+}
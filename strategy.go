@@ -0,0 +1,571 @@
+package djv_ads
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"time"
+)
+
+// BidStrategy decides which bids should change given the latest account
+// state. Implementations only propose updates, the controller applies them.
+type BidStrategy interface {
+	CalculateNewBids(accountState *AccountState) []*BidUpdate
+}
+
+// IdealBidder is a strategy that can say what it would bid, even when the
+// current bid is close enough that it proposes nothing. It's false when the
+// strategy would leave the bid alone whatever it is.
+type IdealBidder interface {
+	IdealBid(campaign *Campaign, bid *Bid) (float64, bool)
+}
+
+// UndercutStrategy bids just below the current top bid for each spot.
+// CountryAmounts overrides Amount for bids in specific countries.
+type UndercutStrategy struct {
+	Amount         float64
+	CountryAmounts map[string]float64
+}
+
+func NewUndercutStrategy(amount float64) *UndercutStrategy {
+	return &UndercutStrategy{
+		Amount:         amount,
+		CountryAmounts: make(map[string]float64),
+	}
+}
+
+func (strategy *UndercutStrategy) amountFor(countryCode string) float64 {
+	if amount, ok := strategy.CountryAmounts[countryCode]; ok {
+		return amount
+	}
+
+	return strategy.Amount
+}
+
+func (strategy *UndercutStrategy) CalculateNewBids(
+	accountState *AccountState) []*BidUpdate {
+
+	updates := make([]*BidUpdate, 0)
+	for _, campaign := range accountState.Campaigns {
+		for _, bid := range campaign.Bids {
+			idealBid, ok := strategy.IdealBid(campaign, bid)
+			if !ok {
+				continue
+			}
+
+			// If our current bid is close enough to ideal, we don't update
+			bidDelta := idealBid - bid.BidAmount
+			if bidDelta >= 0 && bidDelta < 0.001 {
+				continue
+			}
+
+			updates = append(updates, newBidUpdate(campaign, bid, idealBid))
+		}
+	}
+
+	return updates
+}
+
+func (strategy *UndercutStrategy) IdealBid(campaign *Campaign, bid *Bid) (float64, bool) {
+	// Policy: no updates to spots with no current max bid
+	if bid.CurrentMaxTrafficBid == 0 {
+		return 0, false
+	}
+
+	return bid.CurrentMaxTrafficBid - strategy.amountFor(bid.CountryCode), true
+}
+
+func newBidUpdate(campaign *Campaign, bid *Bid, newBid float64) *BidUpdate {
+	return &BidUpdate{
+		CampaignId:  campaign.CampaignId,
+		BidId:       bid.BidId,
+		SpotId:      bid.SpotId,
+		CountryCode: bid.CountryCode,
+		PreviousBid: bid.BidAmount,
+		NewBid:      newBid,
+		Timestamp:   time.Now().In(Pacific).Format(TimeFormat),
+	}
+}
+
+// CampaignStrategy hands each campaign's bids to the strategy set up for it,
+// or to Default.
+type CampaignStrategy struct {
+	Default   BidStrategy
+	Campaigns map[string]BidStrategy
+}
+
+func (strategy *CampaignStrategy) CalculateNewBids(
+	accountState *AccountState) []*BidUpdate {
+
+	// Split the state up so each strategy only sees its own campaigns
+	states := make(map[BidStrategy]*AccountState)
+	for campaignId, campaign := range accountState.Campaigns {
+		campaignStrategy, ok := strategy.Campaigns[campaignId]
+		if !ok {
+			campaignStrategy = strategy.Default
+		}
+
+		state, ok := states[campaignStrategy]
+		if !ok {
+			state = &AccountState{
+				Timestamp: accountState.Timestamp,
+				Campaigns: make(map[string]*Campaign),
+			}
+			states[campaignStrategy] = state
+		}
+
+		state.Campaigns[campaignId] = campaign
+	}
+
+	updates := make([]*BidUpdate, 0)
+	for campaignStrategy, state := range states {
+		updates = append(updates, campaignStrategy.CalculateNewBids(state)...)
+	}
+
+	return updates
+}
+
+func (strategy *CampaignStrategy) IdealBid(campaign *Campaign, bid *Bid) (float64, bool) {
+	campaignStrategy, ok := strategy.Campaigns[campaign.CampaignId]
+	if !ok {
+		campaignStrategy = strategy.Default
+	}
+
+	if idealBidder, ok := campaignStrategy.(IdealBidder); ok {
+		return idealBidder.IdealBid(campaign, bid)
+	}
+
+	return 0, false
+}
+
+// FixedBidStrategy sets every bid to the same amount, whatever the
+// competition. It's how scheduled campaigns return to a baseline.
+type FixedBidStrategy struct {
+	Amount float64
+}
+
+func NewFixedBidStrategy(amount float64) *FixedBidStrategy {
+	return &FixedBidStrategy{Amount: amount}
+}
+
+func (strategy *FixedBidStrategy) CalculateNewBids(
+	accountState *AccountState) []*BidUpdate {
+
+	updates := make([]*BidUpdate, 0)
+	for _, campaign := range accountState.Campaigns {
+		for _, bid := range campaign.Bids {
+			bidDelta := strategy.Amount - bid.BidAmount
+			if bidDelta > -0.0001 && bidDelta < 0.0001 {
+				continue
+			}
+
+			updates = append(updates, newBidUpdate(campaign, bid, strategy.Amount))
+		}
+	}
+
+	return updates
+}
+
+func (strategy *FixedBidStrategy) IdealBid(campaign *Campaign, bid *Bid) (float64, bool) {
+	return strategy.Amount, true
+}
+
+// PositionStrategy bids the cheapest amount that still lands the bid at the
+// target position of the spot's ranked placement list.
+type PositionStrategy struct {
+	Position  int
+	Increment float64
+}
+
+func NewPositionStrategy(position int, increment float64) *PositionStrategy {
+	return &PositionStrategy{Position: position, Increment: increment}
+}
+
+func (strategy *PositionStrategy) CalculateNewBids(
+	accountState *AccountState) []*BidUpdate {
+
+	updates := make([]*BidUpdate, 0)
+	for _, campaign := range accountState.Campaigns {
+		for _, bid := range campaign.Bids {
+			idealBid, ok := strategy.IdealBid(campaign, bid)
+			if !ok {
+				continue
+			}
+
+			// If our current bid is close enough to ideal, we don't update
+			bidDelta := idealBid - bid.BidAmount
+			if bidDelta >= 0 && bidDelta < 0.001 {
+				continue
+			}
+
+			updates = append(updates, newBidUpdate(campaign, bid, idealBid))
+		}
+	}
+
+	return updates
+}
+
+func (strategy *PositionStrategy) IdealBid(campaign *Campaign, bid *Bid) (float64, bool) {
+	competitors := competingPlacements(bid)
+
+	// Policy: no updates to spots with no competition
+	if len(competitors) == 0 || strategy.Position < 1 {
+		return 0, false
+	}
+
+	var idealBid float64
+	if len(competitors) >= strategy.Position {
+		// Just beat whoever currently holds the target position
+		idealBid = competitors[strategy.Position-1].Bid + strategy.Increment
+	} else {
+		// Fewer competitors than positions, sitting under the lowest is enough
+		idealBid = competitors[len(competitors)-1].Bid - strategy.Increment
+	}
+
+	return idealBid, idealBid > 0
+}
+
+// PacingStrategy spreads each campaign's daily budget over the day by
+// scaling the bids another strategy picks. Campaigns spending faster than the
+// clock bid lower, ones spending slower bid higher, but no higher than the top
+// competitor. Bids are paced from the wrapped strategy's ideal, so they're
+// paced even when it's happy with them, without compounding run after run.
+// Campaigns without a budget or stats are left to the wrapped strategy.
+type PacingStrategy struct {
+	Strategy BidStrategy
+	// Most a bid is scaled by either way, like 0.2 for 20%
+	MaxAdjustment float64
+	// Spend within this fraction of the day's pace counts as on pace
+	Tolerance float64
+	// Where the budget's day starts
+	Location *time.Location
+}
+
+func NewPacingStrategy(
+	strategy BidStrategy, maxAdjustment, tolerance float64) *PacingStrategy {
+
+	return &PacingStrategy{
+		Strategy:      strategy,
+		MaxAdjustment: maxAdjustment,
+		Tolerance:     tolerance,
+		Location:      Pacific,
+	}
+}
+
+func (strategy *PacingStrategy) CalculateNewBids(
+	accountState *AccountState) []*BidUpdate {
+
+	updates := strategy.Strategy.CalculateNewBids(accountState)
+	proposed := proposedByBid(updates)
+
+	now := time.Now()
+	for _, campaign := range accountState.Campaigns {
+		factor, reason := strategy.paceFactor(campaign.Stats, now)
+		if factor == 1 {
+			continue
+		}
+
+		for _, bid := range campaign.Bids {
+			key := updateKey(campaign.CampaignId, bid.BidId, bid.CountryCode)
+			update, ok := proposed[key]
+
+			idealBid := 0.0
+			if ok {
+				idealBid = update.NewBid
+			} else if idealBidder, isIdealBidder := strategy.Strategy.(IdealBidder); isIdealBidder {
+				// The strategy is happy with the current bid, but it may
+				// still need pacing. Scaling the current bid instead would
+				// compound run after run.
+				if idealBid, ok = idealBidder.IdealBid(campaign, bid); !ok {
+					continue
+				}
+			} else {
+				continue
+			}
+
+			newBid := idealBid * factor
+			if factor > 1 {
+				// Catching up never outbids the competition. The spot's top
+				// bid can be our own, so go by the top competitor instead.
+				newBid = math.Min(newBid, math.Max(idealBid, bid.TopCompetitorBid()))
+			}
+
+			if bidDelta := newBid - bid.BidAmount; bidDelta > -0.0001 && bidDelta < 0.0001 {
+				// Already paced, or pacing cancels out the strategy's change
+				delete(proposed, key)
+				continue
+			}
+
+			if update == nil {
+				update = newBidUpdate(campaign, bid, newBid)
+				proposed[key] = update
+			}
+
+			update.NewBid = newBid
+			update.Reason = reason
+		}
+	}
+
+	return withSkipped(updates, proposed)
+}
+
+// paceFactor is what the campaign's bids get multiplied by, and why.
+func (strategy *PacingStrategy) paceFactor(
+	stats *CampaignStats, now time.Time) (float64, string) {
+
+	if stats == nil || stats.DailyBudget <= 0 || stats.DailyBudgetLeft <= 0 {
+		// No budget to pace, or nothing left of it to save
+		return 1, ""
+	}
+
+	location := strategy.Location
+	if location == nil {
+		location = Pacific
+	}
+
+	now = now.In(location)
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, location)
+	nextMidnight := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, location)
+
+	// Too early in the day for the spend to say much
+	elapsed := float64(now.Sub(midnight)) / float64(nextMidnight.Sub(midnight))
+	if elapsed < 1.0/48 {
+		return 1, ""
+	}
+
+	spend := stats.DailySpend()
+	pace := spend / (stats.DailyBudget * elapsed)
+	if pace > 1-strategy.Tolerance && pace < 1+strategy.Tolerance {
+		return 1, ""
+	}
+
+	factor := 1 + strategy.MaxAdjustment
+	if pace > 0 {
+		factor = math.Min(math.Max(1/pace, 1-strategy.MaxAdjustment), 1+strategy.MaxAdjustment)
+	}
+
+	return factor, fmt.Sprintf("paced: spent %.2f of %.2f with %.0f%% of the day gone",
+		spend, stats.DailyBudget, elapsed*100)
+}
+
+// PerformanceStrategy caps the bids another strategy picks at what a target
+// cost per conversion can afford, assuming we pay what we bid. TJ only reports
+// stats by campaign, so every spot goes by its campaign's conversion rate over
+// the last RecentStatsDays days. Campaigns that haven't converted are treated
+// as having converted once, so the more they're shown without converting the
+// lower their cap goes.
+type PerformanceStrategy struct {
+	Strategy BidStrategy
+	// Most to pay for a conversion, 0 for no target
+	TargetCpa float64
+	// Least revenue to make per dollar spent, worth ConversionValue a
+	// conversion. 0 for no target.
+	TargetRoas      float64
+	ConversionValue float64
+	// Fewer impressions than this aren't enough to go by
+	MinImpressions int64
+}
+
+func NewPerformanceStrategy(
+	strategy BidStrategy, targetCpa, targetRoas, conversionValue float64,
+	minImpressions int64) *PerformanceStrategy {
+
+	return &PerformanceStrategy{
+		Strategy:        strategy,
+		TargetCpa:       targetCpa,
+		TargetRoas:      targetRoas,
+		ConversionValue: conversionValue,
+		MinImpressions:  minImpressions,
+	}
+}
+
+// maxCpa is the most a conversion can cost under both targets, 0 without one,
+// and which target it comes from.
+func (strategy *PerformanceStrategy) maxCpa() (float64, string) {
+	maxCpa, target := strategy.TargetCpa, fmt.Sprintf("%.2f CPA", strategy.TargetCpa)
+	if strategy.TargetRoas > 0 && strategy.ConversionValue > 0 {
+		roasCpa := strategy.ConversionValue / strategy.TargetRoas
+		if maxCpa <= 0 || roasCpa < maxCpa {
+			maxCpa, target = roasCpa, fmt.Sprintf("%.2f ROAS", strategy.TargetRoas)
+		}
+	}
+
+	return maxCpa, target
+}
+
+func (strategy *PerformanceStrategy) CalculateNewBids(
+	accountState *AccountState) []*BidUpdate {
+
+	updates := strategy.Strategy.CalculateNewBids(accountState)
+	proposed := proposedByBid(updates)
+
+	for _, campaign := range accountState.Campaigns {
+		maxBid, reason, ok := strategy.maxBid(campaign)
+		if !ok {
+			continue
+		}
+
+		for _, bid := range campaign.Bids {
+			key := updateKey(campaign.CampaignId, bid.BidId, bid.CountryCode)
+			update, ok := proposed[key]
+			if !ok {
+				// Stop chasing spots we're already paying too much for
+				if !bid.IsActive || bid.BidAmount <= maxBid+0.0001 {
+					continue
+				}
+				update = newBidUpdate(campaign, bid, maxBid)
+			} else if update.NewBid <= maxBid {
+				continue
+			}
+
+			if bidDelta := maxBid - bid.BidAmount; bidDelta > -0.0001 && bidDelta < 0.0001 {
+				delete(proposed, key)
+				continue
+			}
+
+			update.NewBid = maxBid
+			update.Reason = reason
+			proposed[key] = update
+		}
+	}
+
+	return withSkipped(updates, proposed)
+}
+
+func (strategy *PerformanceStrategy) IdealBid(campaign *Campaign, bid *Bid) (float64, bool) {
+	idealBidder, ok := strategy.Strategy.(IdealBidder)
+	if !ok {
+		return 0, false
+	}
+
+	idealBid, ok := idealBidder.IdealBid(campaign, bid)
+	if maxBid, _, capped := strategy.maxBid(campaign); ok && capped {
+		idealBid = math.Min(idealBid, maxBid)
+	}
+
+	return idealBid, ok
+}
+
+// maxBid is the CPM bid the targets can afford on the campaign's spots. It's
+// false without a target or enough impressions to go by.
+func (strategy *PerformanceStrategy) maxBid(campaign *Campaign) (float64, string, bool) {
+	maxCpa, target := strategy.maxCpa()
+	if maxCpa <= 0 || campaign.RecentStats == nil {
+		return 0, "", false
+	}
+
+	minImpressions := strategy.MinImpressions
+	if minImpressions < 1 {
+		minImpressions = 1
+	}
+
+	stats := &campaign.RecentStats.Stats
+	if stats.Impressions < minImpressions {
+		return 0, "", false
+	}
+
+	conversions := stats.Conversions
+	if conversions < 1 {
+		conversions = 1
+	}
+
+	maxBid := maxCpa * float64(conversions) / float64(stats.Impressions) * 1000
+	return maxBid, fmt.Sprintf("capped for a %v: %v conversions in %v campaign impressions",
+		target, stats.Conversions, stats.Impressions), true
+}
+
+func updateKey(campaignId, bidId, countryCode string) string {
+	return campaignId + "/" + bidKey(bidId, countryCode)
+}
+
+// proposedByBid indexes the updates that weren't skipped by updateKey.
+func proposedByBid(updates []*BidUpdate) map[string]*BidUpdate {
+	proposed := make(map[string]*BidUpdate)
+	for _, update := range updates {
+		if !update.Skipped {
+			proposed[updateKey(update.CampaignId, update.BidId, update.CountryCode)] = update
+		}
+	}
+
+	return proposed
+}
+
+// withSkipped puts a wrapped strategy's skipped updates back with the
+// proposed ones.
+func withSkipped(updates []*BidUpdate, proposed map[string]*BidUpdate) []*BidUpdate {
+	merged := make([]*BidUpdate, 0, len(updates))
+	for _, update := range updates {
+		if update.Skipped {
+			merged = append(merged, update)
+		}
+	}
+
+	for _, update := range proposed {
+		merged = append(merged, update)
+	}
+
+	sortUpdates(merged)
+	return merged
+}
+
+// sortUpdates orders updates by campaign, bid and country, so runs over the
+// same account state propose, and apply, the same updates in the same order.
+func sortUpdates(updates []*BidUpdate) {
+	sort.SliceStable(updates, func(i, j int) bool {
+		return updateKey(updates[i].CampaignId, updates[i].BidId, updates[i].CountryCode) <
+			updateKey(updates[j].CampaignId, updates[j].BidId, updates[j].CountryCode)
+	})
+}
+
+// TopCompetitorBid is the highest bid on the spot that isn't ours, 0 when
+// nobody else is bidding.
+func (bid *Bid) TopCompetitorBid() float64 {
+	competitors := competingPlacements(bid)
+	if len(competitors) == 0 {
+		return 0
+	}
+
+	return competitors[0].Bid
+}
+
+// competingPlacements drops our own entry from the spot's placement list.
+// Nothing says TJ's rows carry our bid id, so a row that does is taken as ours
+// but usually it's the first one matching our current bid.
+func competingPlacements(bid *Bid) []*Placement {
+	self := -1
+	for i, placement := range bid.Placements {
+		if placement.identifies(bid.BidId) {
+			self = i
+			break
+		}
+	}
+
+	if self < 0 {
+		for i, placement := range bid.Placements {
+			bidDelta := placement.Bid - bid.BidAmount
+			if bidDelta > -0.0001 && bidDelta < 0.0001 {
+				self = i
+				break
+			}
+		}
+	}
+
+	competitors := make([]*Placement, 0, len(bid.Placements))
+	for i, placement := range bid.Placements {
+		if i != self {
+			competitors = append(competitors, placement)
+		}
+	}
+
+	return competitors
+}
+
+func (placement *Placement) identifies(bidId string) bool {
+	for _, identifier := range placement.Identifiers {
+		if identifier == bidId {
+			return true
+		}
+	}
+
+	return false
+}
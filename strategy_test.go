@@ -0,0 +1,146 @@
+package djv_ads
+
+import (
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCompetingPlacements(t *testing.T) {
+	tests := []struct {
+		name       string
+		placements []*Placement
+		expected   []float64
+	}{
+		{
+			"our row matched by amount",
+			[]*Placement{
+				{Position: 1, Bid: 0.12, Identifiers: []string{"1", "competitor-1"}},
+				{Position: 2, Bid: 0.10, Identifiers: []string{"2", "someone"}},
+				{Position: 3, Bid: 0.05, Identifiers: []string{"3", "competitor-2"}},
+			},
+			[]float64{0.12, 0.05},
+		},
+		{
+			// Only one of the tied rows is ours
+			"tied with a competitor",
+			[]*Placement{
+				{Position: 1, Bid: 0.10, Identifiers: []string{"1", "competitor-1"}},
+				{Position: 2, Bid: 0.10, Identifiers: []string{"2", "competitor-2"}},
+			},
+			[]float64{0.10},
+		},
+		{
+			"our row carries the bid id",
+			[]*Placement{
+				{Position: 1, Bid: 0.10, Identifiers: []string{"1", "competitor-1"}},
+				{Position: 2, Bid: 0.10, Identifiers: []string{"2", "2001"}},
+				{Position: 3, Bid: 0.05, Identifiers: []string{"3", "competitor-2"}},
+			},
+			[]float64{0.10, 0.05},
+		},
+		{
+			"our bid isn't listed",
+			[]*Placement{
+				{Position: 1, Bid: 0.20, Identifiers: []string{"1", "competitor-1"}},
+			},
+			[]float64{0.20},
+		},
+	}
+
+	for _, test := range tests {
+		bid := &Bid{BidId: "2001", BidAmount: 0.10, Placements: test.placements}
+		competitors := competingPlacements(bid)
+		if len(competitors) != len(test.expected) {
+			t.Errorf("%v: expected %v competitors, got %v", test.name,
+				len(test.expected), len(competitors))
+			continue
+		}
+
+		for i, competitor := range competitors {
+			if math.Abs(competitor.Bid-test.expected[i]) > 0.00001 {
+				t.Errorf("%v: competitor %v bids %v, expected %v", test.name, i,
+					competitor.Bid, test.expected[i])
+			}
+		}
+	}
+}
+
+func TestUpdatesAreSorted(t *testing.T) {
+	campaigns := make(map[string]*Campaign)
+	for _, campaignId := range []string{"3", "1", "2"} {
+		campaign := &Campaign{CampaignId: campaignId, Bids: make(map[string]*Bid)}
+		for _, bidId := range []string{"13", "11", "12"} {
+			campaign.Bids[bidKey(bidId, DefaultCountryCode)] = &Bid{
+				BidId:                bidId,
+				CountryCode:          DefaultCountryCode,
+				BidAmount:            0.05,
+				IsActive:             true,
+				CurrentMaxTrafficBid: 0.10,
+			}
+		}
+		campaigns[campaignId] = campaign
+	}
+
+	controller, err := NewAdsController(UndercutBy(0.001))
+	if err != nil {
+		t.Fatalf("creating controller: %v", err)
+	}
+
+	updates := controller.calculateNewBids(&AccountState{Campaigns: campaigns})
+	if len(updates) != 9 {
+		t.Fatalf("expected 9 updates, got %v", len(updates))
+	}
+
+	for i := 1; i < len(updates); i++ {
+		previous, update := updates[i-1], updates[i]
+		if previous.CampaignId > update.CampaignId ||
+			previous.CampaignId == update.CampaignId && previous.BidId > update.BidId {
+
+			t.Errorf("update %v/%v came after %v/%v", update.CampaignId, update.BidId,
+				previous.CampaignId, previous.BidId)
+		}
+	}
+}
+
+func TestPacingFromIdealBid(t *testing.T) {
+	// Pace against a day that's half gone, whenever this runs
+	utcNow := time.Now().UTC()
+	sinceMidnight := utcNow.Sub(utcNow.Truncate(24 * time.Hour))
+	pacing := NewPacingStrategy(NewUndercutStrategy(0.001), 0.2, 0.1)
+	pacing.Location = time.FixedZone("midday", int((12*time.Hour-sinceMidnight)/time.Second))
+
+	// Spending 80 of 100 by midday is too fast, so bids go down by the most
+	// pacing allows
+	bid := &Bid{BidId: "11", SpotId: "37", CountryCode: DefaultCountryCode, BidAmount: 0.10,
+		IsActive: true, CurrentMaxTrafficBid: 0.101}
+	accountState := &AccountState{
+		Campaigns: map[string]*Campaign{
+			"1": {
+				CampaignId: "1",
+				Bids:       map[string]*Bid{bidKey("11", DefaultCountryCode): bid},
+				Stats:      &CampaignStats{DailyBudget: 100, DailyBudgetLeft: 20},
+			},
+		},
+	}
+
+	if updates := pacing.Strategy.CalculateNewBids(accountState); len(updates) != 0 {
+		t.Fatalf("expected the bid to start at its ideal, got %v updates", len(updates))
+	}
+
+	updates := pacing.CalculateNewBids(accountState)
+	if len(updates) != 1 || math.Abs(updates[0].NewBid-0.08) > 0.0001 ||
+		updates[0].PreviousBid != 0.10 || !strings.HasPrefix(updates[0].Reason, "paced") {
+
+		t.Fatalf("expected the bid at its ideal to be paced down to 0.08, got %+v", updates)
+	}
+
+	// Once paced it stays put rather than being paced again
+	bid.BidAmount = updates[0].NewBid
+	for run := 0; run < 3; run++ {
+		if updates = pacing.CalculateNewBids(accountState); len(updates) != 0 {
+			t.Errorf("run %v: expected the paced bid to be left alone, got %+v", run, updates[0])
+		}
+	}
+}
@@ -0,0 +1,450 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"strings"
+	"time"
+
+	. "github.com/emef/djv_ads"
+	"github.com/emef/djv_ads/tj_fake"
+)
+
+// Runs the controller end to end against an in-process fake TJ server and
+// checks the bids it ends up setting.
+func main() {
+	flag.Parse()
+
+	server := tj_fake.NewServer()
+	defer server.Close()
+
+	server.AddCampaign(&tj_fake.Campaign{
+		CampaignId: 1001,
+		Name:       "fake campaign",
+		Status:     "active",
+		Bids: []*tj_fake.Bid{
+			{BidId: "2001", SpotId: "32", Amount: 0.05, IsActive: true},
+			{BidId: "2002", SpotId: "33", Amount: 0.20, IsActive: true},
+			{BidId: "2003", SpotId: "34", Amount: 0.10, IsActive: true, IsPaused: true},
+		},
+		DailyBudget:     100,
+		DailyBudgetLeft: 40,
+		Cost:            60,
+		Impressions:     12000,
+		Clicks:          300,
+		Conversions:     6,
+	})
+	server.AddCampaign(&tj_fake.Campaign{
+		CampaignId: 1002,
+		Name:       "paused campaign",
+		Status:     "paused",
+	})
+
+	server.SetCompetitorBids("32", DefaultCountryCode, 0.10, 0.08)
+	server.SetCompetitorBids("33", DefaultCountryCode, 0.12)
+	server.SetCompetitorBids("34", DefaultCountryCode, 0.50)
+
+	// Transient failures should be retried away
+	server.FailNext("/api/campaigns.json", 503)
+	server.FailNext("/campaign/viewbids/placementlist/", 502)
+	server.FailNext("/api/bids/2001/set.json", 429, 500)
+
+	client := NewClient(server.Config())
+	controller, err := NewAdsController(
+		WithClient(client),
+		UndercutBy(0.001))
+	if err != nil {
+		fail("creating controller: %v", err)
+	}
+
+	result := controller.RunOnce(context.Background())
+	if result.Failed() || len(result.Errors) > 0 {
+		fail("run had errors: %v %v", result.Error, result.Errors)
+	}
+
+	for _, update := range result.Applied {
+		fmt.Printf("campaign=%v bid=%v %v -> %v\n",
+			update.CampaignId, update.BidId, update.PreviousBid, update.NewBid)
+	}
+
+	// Spot 32 is below the top bid and moves up under it. On spot 33 we hold
+	// the top bid ourselves so we step down by the undercut. Spot 34 is paused.
+	expected := map[string]float64{"2001": 0.099, "2002": 0.199, "2003": 0.10}
+	for bidId, expectedAmount := range expected {
+		amount, _ := server.BidAmount(bidId)
+		if math.Abs(amount-expectedAmount) > 0.00001 {
+			fail("bid %v is %v, expected %v", bidId, amount, expectedAmount)
+		}
+	}
+
+	if len(server.BidSets()) != 2 {
+		fail("expected 2 bid sets, got %v", len(server.BidSets()))
+	}
+
+	// Budgets and spend come from the members campaign list
+	stats := result.AccountState.Campaigns["1001"].Stats
+	if stats == nil || stats.DailyBudget != 100 || stats.DailySpend() != 60 ||
+		stats.Clicks != 300 || stats.Conversions != 6 {
+		fail("campaign 1001 stats are %+v", stats)
+	}
+
+	// The next run reuses the session, logging in again once it expires.
+	server.SetCompetitorBids("32", DefaultCountryCode, 0.11)
+	controller.RunOnce(context.Background())
+	if server.Logins() != 1 {
+		fail("expected session reuse, got %v logins", server.Logins())
+	}
+
+	server.ExpireSessions()
+	controller.RunOnce(context.Background())
+	if server.Logins() != 2 {
+		fail("expected a single re-login, got %v logins", server.Logins())
+	}
+
+	if amount, _ := server.BidAmount("2001"); math.Abs(amount-0.109) > 0.00001 {
+		fail("bid 2001 is %v after re-login, expected 0.109", amount)
+	}
+
+	// Excluded campaigns are left alone, and campaigns can have their own
+	// strategy.
+	server.AddCampaign(&tj_fake.Campaign{
+		CampaignId: 1003,
+		Name:       "second campaign",
+		Status:     "active",
+		Bids: []*tj_fake.Bid{
+			{BidId: "2004", SpotId: "35", Amount: 0.05, IsActive: true},
+		},
+		Cost:        5,
+		Impressions: 100000,
+		Clicks:      250,
+		Conversions: 2,
+	})
+	server.SetCompetitorBids("35", DefaultCountryCode, 0.30)
+	server.SetCompetitorBids("32", DefaultCountryCode, 0.12)
+
+	controller, err = NewAdsController(
+		WithClient(client),
+		UndercutBy(0.001),
+		WithoutCampaigns("1001"),
+		WithCampaignStrategy("1003", NewUndercutStrategy(0.005)))
+	if err != nil {
+		fail("creating controller: %v", err)
+	}
+
+	result = controller.RunOnce(context.Background())
+	if result.Failed() || result.CampaignsScanned != 1 {
+		fail("expected only campaign 1003 to run: %v %v", result.Error, result.CampaignsScanned)
+	}
+
+	if amount, _ := server.BidAmount("2004"); math.Abs(amount-0.295) > 0.00001 {
+		fail("bid 2004 is %v, expected 0.295", amount)
+	}
+
+	if amount, _ := server.BidAmount("2001"); math.Abs(amount-0.109) > 0.00001 {
+		fail("excluded bid 2001 changed to %v", amount)
+	}
+
+	// A glitched $50 top bid trips the guardrails. Refusing holds back the
+	// whole run, a partial run still applies the sane ones.
+	server.SetCompetitorBids("35", DefaultCountryCode, 50.0)
+	guardrails := Guardrails{MaxBidChange: 1.0}
+
+	controller, err = NewAdsController(
+		WithClient(client),
+		UndercutBy(0.001),
+		WithGuardrails(guardrails))
+	if err != nil {
+		fail("creating controller: %v", err)
+	}
+
+	result = controller.RunOnce(context.Background())
+	if !result.Refused || len(result.GuardrailTrips) != 1 || len(result.Applied) != 0 {
+		fail("expected the run to be refused: %v %v", result.GuardrailTrips, result.Applied)
+	}
+
+	guardrails.Action = PartialOnGuardrail
+	controller, err = NewAdsController(
+		WithClient(client),
+		UndercutBy(0.001),
+		WithGuardrails(guardrails))
+	if err != nil {
+		fail("creating controller: %v", err)
+	}
+
+	result = controller.RunOnce(context.Background())
+	if result.Refused || len(result.Applied) == 0 {
+		fail("expected the updates within the guardrails to apply: %v", result.GuardrailTrips)
+	}
+
+	if amount, _ := server.BidAmount("2004"); math.Abs(amount-0.295) > 0.00001 {
+		fail("bid 2004 is %v, expected the guardrails to hold it at 0.295", amount)
+	}
+
+	if amount, _ := server.BidAmount("2001"); math.Abs(amount-0.119) > 0.00001 {
+		fail("bid 2001 is %v, expected 0.119", amount)
+	}
+
+	// The end of a dayparting window puts bids back at its baseline
+	controller, err = NewAdsController(
+		WithClient(client),
+		UndercutBy(0.001),
+		WithCampaignStrategy("1003", NewFixedBidStrategy(0.05)))
+	if err != nil {
+		fail("creating controller: %v", err)
+	}
+
+	result = controller.RunOnce(context.Background())
+	if result.Failed() {
+		fail("baseline run failed: %v", result.Error)
+	}
+
+	if amount, _ := server.BidAmount("2004"); math.Abs(amount-0.05) > 0.00001 {
+		fail("bid 2004 is %v, expected the 0.05 baseline", amount)
+	}
+
+	// A target CPA caps what we chase. Two conversions in the campaign's 100k
+	// impressions afford a 0.04 CPM at a CPA of 2, however high the top bid
+	// goes.
+	controller, err = NewAdsController(
+		WithClient(client),
+		UndercutBy(0.001),
+		WithCampaignWhitelist("1003"),
+		WithCampaignStrategy("1003",
+			NewPerformanceStrategy(NewUndercutStrategy(0.001), 2, 0, 0, 1000)))
+	if err != nil {
+		fail("creating controller: %v", err)
+	}
+
+	result = controller.RunOnce(context.Background())
+	if result.Failed() {
+		fail("performance run failed: %v", result.Error)
+	}
+
+	if amount, _ := server.BidAmount("2004"); math.Abs(amount-0.04) > 0.00001 {
+		fail("bid 2004 is %v, expected the target CPA to cap it at 0.04", amount)
+	}
+
+	if len(result.Applied) != 1 || !strings.Contains(result.Applied[0].Reason, "2.00 CPA") {
+		fail("expected the CPA to be the reason for the cap: %v", result.Applied)
+	}
+
+	// A ROAS of 4 on conversions worth 4.00 is a tighter 1.00 CPA
+	controller, err = NewAdsController(
+		WithClient(client),
+		UndercutBy(0.001),
+		WithCampaignWhitelist("1003"),
+		WithCampaignStrategy("1003",
+			NewPerformanceStrategy(NewUndercutStrategy(0.001), 2, 4, 4, 1000)))
+	if err != nil {
+		fail("creating controller: %v", err)
+	}
+
+	result = controller.RunOnce(context.Background())
+	if amount, _ := server.BidAmount("2004"); math.Abs(amount-0.02) > 0.00001 {
+		fail("bid 2004 is %v, expected the target ROAS to cap it at 0.02", amount)
+	}
+
+	if len(result.Applied) != 1 || !strings.Contains(result.Applied[0].Reason, "4.00 ROAS") {
+		fail("expected the ROAS to be the reason for the cap: %v", result.Applied)
+	}
+
+	// A bid in several countries settles on the lowest of their ideal bids,
+	// including the countries that are happy where it is.
+	server.AddCampaign(&tj_fake.Campaign{
+		CampaignId: 1004,
+		Name:       "geo campaign",
+		Status:     "active",
+		Bids: []*tj_fake.Bid{
+			{BidId: "2005", SpotId: "36", Amount: 0.10, IsActive: true,
+				Countries: []string{"US", "CA"}},
+		},
+	})
+	server.SetCompetitorBids("36", "US", 0.101)
+	server.SetCompetitorBids("36", "CA", 0.30)
+
+	controller, err = NewAdsController(
+		WithClient(client),
+		UndercutBy(0.001),
+		WithCampaignCountries("1004", "US", "CA"),
+		WithCampaignWhitelist("1004"))
+	if err != nil {
+		fail("creating controller: %v", err)
+	}
+
+	result = controller.RunOnce(context.Background())
+	if result.Failed() || len(result.Applied) != 0 {
+		fail("expected the US bid to hold back the CA raise: %v %v", result.Error, result.Applied)
+	}
+
+	// Once we hold the top US bid, stepping down there wins over CA
+	server.SetCompetitorBids("36", "US", 0.08)
+	controller.RunOnce(context.Background())
+	if amount, _ := server.BidAmount("2005"); math.Abs(amount-0.099) > 0.00001 {
+		fail("bid 2005 is %v, expected the lower US bid of 0.099", amount)
+	}
+
+	// Rolling back a run puts its bids back, apart from ones changed since
+	server.SetCompetitorBids("32", DefaultCountryCode, 0.20)
+	server.SetCompetitorBids("33", DefaultCountryCode, 0.30)
+	controller, err = NewAdsController(
+		WithClient(client),
+		UndercutBy(0.001),
+		WithCampaignWhitelist("1001"))
+	if err != nil {
+		fail("creating controller: %v", err)
+	}
+
+	result = controller.RunOnce(context.Background())
+	if result.Failed() || len(result.Applied) != 2 {
+		fail("expected 2 updates to roll back: %v %v", result.Error, result.Applied)
+	}
+
+	server.SetBidAmount("2002", 0.50)
+	rollback := RollbackUpdates(context.Background(), client, result.Applied)
+	if len(rollback.RolledBack) != 1 || len(rollback.Conflicts) != 1 || len(rollback.Errors) != 0 {
+		fail("expected 1 rollback and 1 conflict: %+v", rollback)
+	}
+
+	if conflict := rollback.Conflicts[0]; conflict.Update.BidId != "2002" ||
+		math.Abs(conflict.LiveBid-0.50) > 0.00001 {
+		fail("expected bid 2002 to conflict at 0.50: %+v", conflict)
+	}
+
+	for _, update := range result.Applied {
+		expectedAmount := update.PreviousBid
+		if update.BidId == "2002" {
+			expectedAmount = 0.50
+		}
+
+		if amount, _ := server.BidAmount(update.BidId); math.Abs(amount-expectedAmount) > 0.00001 {
+			fail("bid %v is %v after rollback, expected %v", update.BidId, amount, expectedAmount)
+		}
+	}
+
+	// A session that can't be renewed mid run fails the run and is reported
+	loginErrors := 0
+	alertingConfig := server.Config()
+	alertingConfig.OnLoginError = func(*LoginError) { loginErrors++ }
+	alertingClient := NewClient(alertingConfig)
+	controller, err = NewAdsController(
+		WithClient(alertingClient),
+		UndercutBy(0.001),
+		WithCampaignWhitelist("1001"))
+	if err != nil {
+		fail("creating controller: %v", err)
+	}
+
+	if err = alertingClient.EnsureLoggedIn(context.Background()); err != nil {
+		fail("logging in: %v", err)
+	}
+
+	server.ExpireSessions()
+	server.RejectLogins(true)
+	result = controller.RunOnce(context.Background())
+	server.RejectLogins(false)
+	if !result.Failed() || loginErrors == 0 {
+		fail("expected the failed re-login to fail the run: %v %v", result.Error, loginErrors)
+	}
+
+	// An underspending campaign catches up to the top competitor but no
+	// further, however many runs in a row see it behind.
+	server.AddCampaign(&tj_fake.Campaign{
+		CampaignId: 1005,
+		Name:       "paced campaign",
+		Status:     "active",
+		Bids: []*tj_fake.Bid{
+			{BidId: "2006", SpotId: "37", Amount: 0.05, IsActive: true},
+		},
+		DailyBudget:     100,
+		DailyBudgetLeft: 100,
+	})
+	server.SetCompetitorBids("37", DefaultCountryCode, 0.10)
+
+	// Pace against a day that's half gone, whenever this runs
+	utcNow := time.Now().UTC()
+	sinceMidnight := utcNow.Sub(utcNow.Truncate(24 * time.Hour))
+	pacing := NewPacingStrategy(NewUndercutStrategy(0.001), 0.2, 0.1)
+	pacing.Location = time.FixedZone("midday", int((12*time.Hour-sinceMidnight)/time.Second))
+
+	controller, err = NewAdsController(
+		WithClient(client),
+		UndercutBy(0.001),
+		WithCampaignWhitelist("1005"),
+		WithCampaignStrategy("1005", pacing))
+	if err != nil {
+		fail("creating controller: %v", err)
+	}
+
+	bidSets := len(server.BidSets())
+	for run := 1; run <= 4; run++ {
+		result = controller.RunOnce(context.Background())
+		if result.Failed() {
+			fail("pacing run %v failed: %v", run, result.Error)
+		}
+
+		if amount, _ := server.BidAmount("2006"); math.Abs(amount-0.10) > 0.00001 {
+			fail("bid 2006 is %v after pacing run %v, expected 0.10", amount, run)
+		}
+	}
+
+	if sets := len(server.BidSets()) - bidSets; sets != 1 {
+		fail("expected pacing to settle after 1 bid set, got %v", sets)
+	}
+
+	// Overnight windows carry on into the next morning, including across the
+	// end of the week.
+	daypart, err := ParseDaypart("fri-sun", "20:00-02:00")
+	if err != nil {
+		fail("parsing daypart: %v", err)
+	}
+
+	// 2026-10-16 is a Friday
+	daypartChecks := []struct {
+		at       time.Time
+		contains bool
+	}{
+		{time.Date(2026, 10, 16, 19, 59, 0, 0, Pacific), false},
+		{time.Date(2026, 10, 16, 20, 0, 0, 0, Pacific), true},
+		{time.Date(2026, 10, 17, 1, 59, 0, 0, Pacific), true},
+		{time.Date(2026, 10, 17, 2, 0, 0, 0, Pacific), false},
+		// Sunday night's window runs into Monday, Thursday's doesn't exist
+		{time.Date(2026, 10, 19, 1, 0, 0, 0, Pacific), true},
+		{time.Date(2026, 10, 16, 1, 0, 0, 0, Pacific), false},
+		{time.Date(2026, 10, 19, 20, 0, 0, 0, Pacific), false},
+	}
+
+	for _, check := range daypartChecks {
+		if daypart.Contains(check.at) != check.contains {
+			fail("expected %v in fri-sun 20:00-02:00 to be %v", check.at, check.contains)
+		}
+	}
+
+	windowEnd := daypart.EndAfter(time.Date(2026, 10, 18, 23, 0, 0, 0, Pacific))
+	if !windowEnd.Equal(time.Date(2026, 10, 19, 2, 0, 0, 0, Pacific)) {
+		fail("expected Sunday's window to end Monday at 02:00, got %v", windowEnd)
+	}
+
+	if _, err = ParseDaypart("fri-funday", "20:00-02:00"); err == nil {
+		fail("expected an unknown day to be rejected")
+	}
+
+	// Bad credentials come back as a typed error
+	badConfig := server.Config()
+	badConfig.Password = "wrong"
+	err = NewClient(badConfig).EnsureLoggedIn(context.Background())
+	var loginErr *LoginError
+	if !errors.As(err, &loginErr) {
+		fail("expected a LoginError, got %v", err)
+	}
+
+	fmt.Printf("ok\n")
+}
+
+func fail(format string, args ...interface{}) {
+	fmt.Printf("FAIL: "+format+"\n", args...)
+	os.Exit(1)
+}
@@ -1,20 +1,22 @@
 package main
 
 import (
+	"context"
 	"fmt"
 
 	. "github.com/emef/djv_ads"
 )
 
 func main() {
-	session, err := NewSpoofedSession()
+	ctx := context.Background()
+	session, err := NewSpoofedSession(ctx)
 	if err != nil {
 		fmt.Printf("%v\n", err)
 		return
 	}
 
 	/*
-	topBid, err := session.CurrentMaxTrafficBid("1039854091", "32")
+	topBid, err := session.CurrentMaxTrafficBid(ctx, "1039854091", "32", "US")
 	if err != nil {
 		fmt.Printf("%v\n", err)
 		return
@@ -23,7 +25,7 @@ func main() {
 	fmt.Printf("top bid: %v\n", topBid)
   */
 
-	currentCampaigns, err := session.GetActiveCampaignIds()
+	currentCampaigns, err := session.GetActiveCampaignIds(ctx)
 	if err != nil {
 		fmt.Printf("%v\n", err)
 		return
@@ -1,24 +1,30 @@
 package djv_ads
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
-	"os"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/golang/glog"
-	"golang.org/x/net/context"
-	"golang.org/x/time/rate"
 )
 
+// Bids without any geo targeting compete in this country.
+const DefaultCountryCode = "US"
+
 type AccountState struct {
+	// When we finished collecting the state
+	Timestamp time.Time
 	Campaigns map[string]*Campaign
+	// TJ calls that failed while building the state
+	Errors []*BidError
 }
 
 type Campaign struct {
@@ -26,14 +32,61 @@ type Campaign struct {
 	Name       string
 	IsActive   bool
 	Bids       map[string]*Bid
+	// Today's numbers and the last RecentStatsDays days', nil when TJ's
+	// campaign list didn't have them
+	Stats       *CampaignStats
+	RecentStats *CampaignStats
+}
+
+// How far back Campaign.RecentStats go, today included
+const RecentStatsDays = 7
+
+// Stats are what a campaign got for its money.
+type Stats struct {
+	Cost        float64
+	Impressions int64
+	Clicks      int64
+	Conversions int64
+	// Cost per thousand impressions and per click
+	Ecpm float64
+	Ecpc float64
+}
+
+// Cpa is the cost per conversion, 0 without any conversions.
+func (stats *Stats) Cpa() float64 {
+	if stats.Conversions == 0 {
+		return 0
+	}
+
+	return stats.Cost / float64(stats.Conversions)
+}
+
+// CampaignStats are a campaign's numbers from the members campaign list, over
+// the dates it was listed for.
+type CampaignStats struct {
+	// What's left of the budget is always today's. A 0 budget is unlimited.
+	DailyBudget     float64
+	DailyBudgetLeft float64
+	Stats
+}
+
+// DailySpend is how much of today's budget is gone.
+func (stats *CampaignStats) DailySpend() float64 {
+	if stats.DailyBudget <= 0 || stats.DailyBudgetLeft >= stats.DailyBudget {
+		return 0
+	}
+
+	return stats.DailyBudget - stats.DailyBudgetLeft
 }
 
 type Bid struct {
 	BidId                string
 	BidAmount            float64
 	SpotId               string
+	CountryCode          string
 	IsActive             bool
 	CurrentMaxTrafficBid float64
+	Placements           []*Placement
 }
 
 type BidsResponseJson struct {
@@ -61,18 +114,18 @@ type HTTPError struct {
 	Status     string
 }
 
-func UpdateBid(bidId string, newBidAmount float64, rateLimiter *rate.Limiter) error {
-	rateLimiter.Wait(context.Background())
-	baseUrl := fmt.Sprintf("https://api.trafficjunky.com/api/bids/%v/set.json", bidId)
-	url, err := formatUrl(
-		baseUrl,
+func (client *Client) UpdateBid(
+	ctx context.Context, bidId string, newBidAmount float64) error {
+
+	url, err := client.apiUrl(
+		fmt.Sprintf("/api/bids/%v/set.json", bidId),
 		"bid", strconv.FormatFloat(newBidAmount, 'f', 4, 64))
 
 	if err != nil {
 		return err
 	}
 
-	resp, err := makeRequest(url, "PUT")
+	resp, err := client.makeRequest(ctx, url, "PUT")
 	if err != nil {
 		return err
 	}
@@ -82,16 +135,51 @@ func UpdateBid(bidId string, newBidAmount float64, rateLimiter *rate.Limiter) er
 }
 
 func GetAccountState(
+	ctx context.Context,
 	campaignIdWhitelist []string,
-	session *Session,
-	rateLimiter *rate.Limiter) (*AccountState, error) {
+	client TJClient,
+	campaignCountries map[string][]string) (*AccountState, error) {
 
-	campaignJsons, err := GetAllCampaigns(rateLimiter)
+	campaignJsons, err := client.GetAllCampaigns(ctx)
 	if err != nil {
 		return nil, err
 	}
 
 	campaignChan := make(chan *Campaign, len(campaignJsons))
+
+	// Without a session nothing else is going to work either, so a failed
+	// login stops the rest of the requests and fails the run
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var errorsMu sync.Mutex
+	bidErrors := make([]*BidError, 0)
+	var loginErr *LoginError
+	recordError := func(bidError *BidError, err error) {
+		errorsMu.Lock()
+		defer errorsMu.Unlock()
+		bidErrors = append(bidErrors, bidError)
+
+		if loginErr == nil && errors.As(err, &loginErr) {
+			cancel()
+		}
+	}
+
+	// Budgets and spend are nice to have, the bids are still worth running
+	now := time.Now()
+	campaignStats, err := client.GetCampaignStats(ctx, now, now)
+	if err != nil {
+		glog.Errorf("Error getting campaign stats: %v", err)
+		recordError(&BidError{Operation: OpGetStats, Error: err.Error()}, err)
+	}
+
+	recentStats, err := client.GetCampaignStats(
+		ctx, now.AddDate(0, 0, 1-RecentStatsDays), now)
+	if err != nil {
+		glog.Errorf("Error getting recent campaign stats: %v", err)
+		recordError(&BidError{Operation: OpGetStats, Error: err.Error()}, err)
+	}
+
 	var wg sync.WaitGroup
 	for _, campaignJson := range campaignJsons {
 		campaignId := strconv.Itoa(int(campaignJson.CampaignId))
@@ -113,6 +201,7 @@ func GetAccountState(
 
 		campaignName := campaignJson.Name
 		campaignIsActive := determineCampaignIsActive(campaignJson)
+		countryCodes := bidCountryCodes(campaignCountries[campaignId])
 
 		wg.Add(1)
 		go func() {
@@ -123,7 +212,7 @@ func GetAccountState(
 			// call above does not work).
 
 			bids := make(map[string]*Bid)
-			bidRespJson, err := GetBidsForCampaign(campaignId, rateLimiter)
+			bidRespJson, err := client.GetBidsForCampaign(ctx, campaignId)
 			glog.Infof("Got bids for campaign %s", campaignId)
 			if err == nil {
 				for _, bidJson := range bidRespJson.BidMap {
@@ -132,42 +221,70 @@ func GetAccountState(
 					bidAmount, err := strconv.ParseFloat(bidJson.BidAmount, 64)
 					if err != nil {
 						glog.Errorf("Error parsing bidAmount: %s", bidJson.BidAmount)
+						recordError(&BidError{
+							CampaignId: campaignId,
+							BidId:      bidJson.BidId,
+							SpotId:     bidJson.SpotId,
+							Operation:  OpParseBid,
+							Error:      err.Error(),
+						}, err)
 						continue
 					}
 
-					currentMaxTrafficBid := float64(0.0)
-					if bidIsActive {
-						rateLimiter.Wait(context.Background())
-						currentMaxTrafficBid, err = session.CurrentMaxTrafficBid(
-							bidJson.BidId, bidJson.SpotId)
-						if err != nil {
-							glog.Errorf(
-								"Error retrieving current max top bid for campaignId=%v bidId=%v spotId=%v",
-								campaignId, bidJson.BidId, bidJson.SpotId)
+					for _, countryCode := range countryCodes {
+						currentMaxTrafficBid := float64(0.0)
+						var placements []*Placement
+						if bidIsActive {
+							placements, err = client.PlacementList(ctx,
+								bidJson.BidId, bidJson.SpotId, countryCode)
+							if err != nil {
+								glog.Errorf(
+									"Error retrieving placement list for campaignId=%v bidId=%v spotId=%v country=%v",
+									campaignId, bidJson.BidId, bidJson.SpotId, countryCode)
+								recordError(&BidError{
+									CampaignId:  campaignId,
+									BidId:       bidJson.BidId,
+									SpotId:      bidJson.SpotId,
+									CountryCode: countryCode,
+									Operation:   OpPlacementList,
+									Error:       err.Error(),
+								}, err)
+							} else if len(placements) > 0 {
+								currentMaxTrafficBid = placements[0].Bid
+							}
 						}
-					}
 
-					bid := &Bid{
-						BidId:                bidJson.BidId,
-						BidAmount:            bidAmount,
-						SpotId:               bidJson.SpotId,
-						IsActive:             bidIsActive,
-						CurrentMaxTrafficBid: currentMaxTrafficBid,
-					}
+						bid := &Bid{
+							BidId:                bidJson.BidId,
+							BidAmount:            bidAmount,
+							SpotId:               bidJson.SpotId,
+							CountryCode:          countryCode,
+							IsActive:             bidIsActive,
+							CurrentMaxTrafficBid: currentMaxTrafficBid,
+							Placements:           placements,
+						}
 
-					bids[bidJson.BidId] = bid
+						bids[bidKey(bidJson.BidId, countryCode)] = bid
+					}
 				}
 			} else {
 				glog.Errorf("Error getting bids for campaign %v: %v", campaignId, err)
+				recordError(&BidError{
+					CampaignId: campaignId,
+					Operation:  OpGetBids,
+					Error:      err.Error(),
+				}, err)
 			}
 
 			glog.Infof("Done processing campaign %s", campaignId)
 
 			campaign := &Campaign{
-				CampaignId: campaignId,
-				Name:       campaignName,
-				IsActive:   campaignIsActive,
-				Bids:       bids}
+				CampaignId:  campaignId,
+				Name:        campaignName,
+				IsActive:    campaignIsActive,
+				Bids:        bids,
+				Stats:       campaignStats[campaignId],
+				RecentStats: recentStats[campaignId]}
 
 			campaignChan <- campaign
 		}()
@@ -176,26 +293,76 @@ func GetAccountState(
 	wg.Wait()
 	close(campaignChan)
 
+	if loginErr != nil {
+		return nil, loginErr
+	}
+
 	campaigns := make(map[string]*Campaign)
 	for campaign := range campaignChan {
 		campaigns[campaign.CampaignId] = campaign
 	}
 
 	return &AccountState{
+		Timestamp: time.Now(),
 		Campaigns: campaigns,
+		Errors:    bidErrors,
 	}, nil
 }
 
-func GetAllCampaigns(rateLimiter *rate.Limiter) ([]*CampaignJson, error) {
-	rateLimiter.Wait(context.Background())
-	url, err := formatUrl(
-		"https://api.trafficjunky.com/api/campaigns.json",
-		"maxResults", "300")
+const (
+	campaignsPageSize = 300
+	maxCampaignPages  = 50
+)
+
+func (client *Client) GetAllCampaigns(ctx context.Context) ([]*CampaignJson, error) {
+	campaigns := make([]*CampaignJson, 0)
+	seen := make(map[int32]bool)
+	for page := 0; page < maxCampaignPages; page++ {
+		pageCampaigns, err := client.getCampaignsPage(ctx, page*campaignsPageSize)
+		if err != nil {
+			return nil, err
+		}
+
+		newCampaigns := 0
+		for _, campaign := range pageCampaigns {
+			if !seen[campaign.CampaignId] {
+				seen[campaign.CampaignId] = true
+				campaigns = append(campaigns, campaign)
+				newCampaigns++
+			}
+		}
+
+		if len(pageCampaigns) < campaignsPageSize {
+			return campaigns, nil
+		}
+
+		// A full page of campaigns we already have means paging isn't
+		// advancing, bail rather than loop on the same results.
+		if newCampaigns == 0 {
+			glog.Warningf("Campaign list stopped advancing at offset %v, "+
+				"results may be truncated at %v campaigns",
+				page*campaignsPageSize, len(campaigns))
+			return campaigns, nil
+		}
+	}
+
+	glog.Warningf("Campaign list truncated at %v campaigns (%v pages)",
+		len(campaigns), maxCampaignPages)
+	return campaigns, nil
+}
+
+func (client *Client) getCampaignsPage(
+	ctx context.Context, offset int) ([]*CampaignJson, error) {
+
+	url, err := client.apiUrl(
+		"/api/campaigns.json",
+		"maxResults", strconv.Itoa(campaignsPageSize),
+		"offset", strconv.Itoa(offset))
 	if err != nil {
 		return nil, err
 	}
 
-	resp, err := makeRequest(url, "GET")
+	resp, err := client.makeRequest(ctx, url, "GET")
 	if err != nil {
 		return nil, err
 	}
@@ -211,18 +378,15 @@ func GetAllCampaigns(rateLimiter *rate.Limiter) ([]*CampaignJson, error) {
 	return campaigns, nil
 }
 
-func GetBidsForCampaign(
-	campaignId string,
-	rateLimiter *rate.Limiter) (*BidsResponseJson, error) {
+func (client *Client) GetBidsForCampaign(
+	ctx context.Context, campaignId string) (*BidsResponseJson, error) {
 
-	rateLimiter.Wait(context.Background())
-	baseUrl := fmt.Sprintf("https://api.trafficjunky.com/api/bids/%v.json", campaignId)
-	url, err := formatUrl(baseUrl)
+	url, err := client.apiUrl(fmt.Sprintf("/api/bids/%v.json", campaignId))
 	if err != nil {
 		return nil, err
 	}
 
-	resp, err := makeRequest(url, "GET")
+	resp, err := client.makeRequest(ctx, url, "GET")
 	if err != nil {
 		return nil, err
 	}
@@ -238,6 +402,33 @@ func GetBidsForCampaign(
 	return bids, nil
 }
 
+// bidCountryCodes lists the countries a campaign's bids compete in, each of
+// which gets its own Bid in the account state. Campaigns without any listed
+// only compete in DefaultCountryCode.
+func bidCountryCodes(targeted []string) []string {
+	countryCodes := make([]string, 0, len(targeted))
+	seen := make(map[string]bool)
+	for _, countryCode := range targeted {
+		countryCode = strings.ToUpper(strings.TrimSpace(countryCode))
+		if countryCode == "" || seen[countryCode] {
+			continue
+		}
+
+		seen[countryCode] = true
+		countryCodes = append(countryCodes, countryCode)
+	}
+
+	if len(countryCodes) == 0 {
+		countryCodes = append(countryCodes, DefaultCountryCode)
+	}
+
+	return countryCodes
+}
+
+func bidKey(bidId, countryCode string) string {
+	return bidId + "/" + countryCode
+}
+
 func determineCampaignIsActive(campaignJson *CampaignJson) bool {
 	if campaignJson.Status != "active" {
 		return false
@@ -256,18 +447,18 @@ func determineCampaignIsActive(campaignJson *CampaignJson) bool {
 	return endDate.After(time.Now())
 }
 
-func formatUrl(baseUrl string, extraParams ...string) (string, error) {
+func (client *Client) apiUrl(path string, extraParams ...string) (string, error) {
 	if len(extraParams)%2 != 0 {
 		return "", errors.New("Wrong number of param key/value pairs")
 	}
 
-	url, err := url.Parse(baseUrl)
+	url, err := url.Parse(client.config.ApiBaseUrl + path)
 	if err != nil {
 		return "", err
 	}
 
 	query := url.Query()
-	query.Set("api_key", apiKey())
+	query.Set("api_key", client.config.ApiKey)
 
 	numKeys := len(extraParams) / 2
 	for i := 0; i < numKeys; i++ {
@@ -278,34 +469,24 @@ func formatUrl(baseUrl string, extraParams ...string) (string, error) {
 	return url.String(), nil
 }
 
-func apiKey() string {
-	return os.Getenv("TJ_API_KEY")
-}
-
-func makeRequest(url string, method string) (io.ReadCloser, error) {
-	client := &http.Client{}
+func (client *Client) makeRequest(
+	ctx context.Context, url string, method string) (io.ReadCloser, error) {
 
-	req, err := http.NewRequest(method, url, nil)
-	if err != nil {
-		return nil, err
-	}
+	resp, err := client.retrier.do(ctx, client.httpClient, func() (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, method, url, nil)
+		if err != nil {
+			return nil, err
+		}
 
-	useragent := "Chrome"
-	req.Header.Set("User-Agent", useragent)
-	resp, err := client.Do(req)
+		useragent := "Chrome"
+		req.Header.Set("User-Agent", useragent)
+		return req, nil
+	})
 
 	if err != nil {
 		return nil, err
 	}
 
-	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		defer resp.Body.Close();
-		return nil, HTTPError{
-			Url:        url,
-			StatusCode: resp.StatusCode,
-			Status:     resp.Status}
-	}
-
 	return resp.Body, nil
 }
 
@@ -0,0 +1,218 @@
+package djv_ads
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// TJClient is everything the controller needs from TrafficJunky.
+type TJClient interface {
+	// Logs in unless there's already a session to reuse
+	EnsureLoggedIn(ctx context.Context) error
+	GetAllCampaigns(ctx context.Context) ([]*CampaignJson, error)
+	GetActiveCampaignIds(ctx context.Context) ([]string, error)
+	// Stats by campaign id between the two dates, both included
+	GetCampaignStats(ctx context.Context, since, until time.Time) (map[string]*CampaignStats, error)
+	GetBidsForCampaign(ctx context.Context, campaignId string) (*BidsResponseJson, error)
+	PlacementList(ctx context.Context, bidId, spotId, countryCode string) ([]*Placement, error)
+	UpdateBid(ctx context.Context, bidId string, newBidAmount float64) error
+}
+
+type ClientConfig struct {
+	// api.trafficjunky.com, used with the api key
+	ApiBaseUrl string
+	// members.trafficjunky.com, used with the logged in session
+	MembersBaseUrl string
+	// www.trafficjunky.com, where we log in
+	SiteBaseUrl string
+
+	ApiKey   string
+	Username string
+	Password string
+
+	Retry RetryPolicy
+	// Bounds each request including reading its body, 0 means no timeout
+	RequestTimeout time.Duration
+	// Optional, sees every request attempt
+	Observer RequestObserver
+	// Optional, told about every rejected login, including the ones renewing
+	// a session that expired mid run
+	OnLoginError func(err *LoginError)
+}
+
+// Client talks to the real TJ endpoints (or anything serving the same paths)
+// and shares a single rate limiter across all of its requests.
+type Client struct {
+	config     ClientConfig
+	httpClient *http.Client
+	retrier    *retrier
+
+	mu      sync.Mutex
+	session *Session
+}
+
+func DefaultClientConfig() ClientConfig {
+	return ClientConfig{
+		ApiBaseUrl:     "https://api.trafficjunky.com",
+		MembersBaseUrl: "https://members.trafficjunky.com",
+		SiteBaseUrl:    "https://www.trafficjunky.com",
+		ApiKey:         os.Getenv("TJ_API_KEY"),
+		Username:       os.Getenv("TJ_USERNAME"),
+		Password:       os.Getenv("TJ_PASSWORD"),
+		Retry:          DefaultRetryPolicy(),
+		RequestTimeout: 30 * time.Second,
+	}
+}
+
+// WithBaseUrl points every TJ host at a single base url.
+func (config ClientConfig) WithBaseUrl(baseUrl string) ClientConfig {
+	baseUrl = strings.TrimRight(baseUrl, "/")
+	config.ApiBaseUrl = baseUrl
+	config.MembersBaseUrl = baseUrl
+	config.SiteBaseUrl = baseUrl
+	return config
+}
+
+func NewClient(config ClientConfig) *Client {
+	return &Client{
+		config:     config,
+		httpClient: &http.Client{Timeout: config.RequestTimeout},
+		retrier:    newRetrier(config.Retry, config.Observer),
+	}
+}
+
+func WithClient(client TJClient) Option {
+	return func(controller *AdsController) error {
+		if client == nil {
+			return errors.New("TJ client must not be nil")
+		}
+
+		controller.client = client
+		return nil
+	}
+}
+
+// Login starts a fresh spoofed members session, replacing any current one.
+func (client *Client) Login(ctx context.Context) error {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+
+	return client.login(ctx)
+}
+
+func (client *Client) EnsureLoggedIn(ctx context.Context) error {
+	_, err := client.currentSession(ctx)
+	return err
+}
+
+func (client *Client) GetActiveCampaignIds(ctx context.Context) ([]string, error) {
+	var campaignIds []string
+	err := client.withSession(ctx, func(session *Session) error {
+		var err error
+		campaignIds, err = session.GetActiveCampaignIds(ctx)
+		return err
+	})
+
+	return campaignIds, err
+}
+
+func (client *Client) GetCampaignStats(
+	ctx context.Context, since, until time.Time) (map[string]*CampaignStats, error) {
+
+	var stats map[string]*CampaignStats
+	err := client.withSession(ctx, func(session *Session) error {
+		var err error
+		stats, err = session.GetCampaignStats(ctx, since, until)
+		return err
+	})
+
+	return stats, err
+}
+
+func (client *Client) PlacementList(
+	ctx context.Context, bidId, spotId, countryCode string) ([]*Placement, error) {
+
+	var placements []*Placement
+	err := client.withSession(ctx, func(session *Session) error {
+		var err error
+		placements, err = session.PlacementList(ctx, bidId, spotId, countryCode)
+		return err
+	})
+
+	return placements, err
+}
+
+// withSession runs a members request, logging in again and retrying once if
+// the session turns out to have expired.
+func (client *Client) withSession(
+	ctx context.Context, request func(session *Session) error) error {
+
+	session, err := client.currentSession(ctx)
+	if err != nil {
+		return err
+	}
+
+	err = request(session)
+	if err != ErrSessionExpired {
+		return err
+	}
+
+	glog.Infof("TJ session expired, logging in again")
+	session, err = client.renewSession(ctx, session)
+	if err != nil {
+		return err
+	}
+
+	return request(session)
+}
+
+func (client *Client) currentSession(ctx context.Context) (*Session, error) {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+
+	if client.session == nil {
+		if err := client.login(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	return client.session, nil
+}
+
+// renewSession replaces an expired session. Concurrent requests that saw the
+// same session expire share a single new login.
+func (client *Client) renewSession(ctx context.Context, expired *Session) (*Session, error) {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+
+	if client.session == expired {
+		if err := client.login(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	return client.session, nil
+}
+
+// login must be called with the lock held.
+func (client *Client) login(ctx context.Context) error {
+	client.session = nil
+	session, err := newSession(ctx, client.config, client.retrier)
+	if err != nil {
+		var loginErr *LoginError
+		if errors.As(err, &loginErr) && client.config.OnLoginError != nil {
+			client.config.OnLoginError(loginErr)
+		}
+		return err
+	}
+
+	client.session = session
+	return nil
+}
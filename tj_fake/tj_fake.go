@@ -0,0 +1,545 @@
+// Package tj_fake serves the subset of the TrafficJunky api and members site
+// that djv_ads talks to, backed by in-memory state that callers can script.
+package tj_fake
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emef/djv_ads"
+)
+
+const (
+	ApiKey   = "fake_api_key"
+	Username = "fake_user"
+	Password = "fake_password"
+
+	csrfToken     = "fake_csrf_token"
+	sessionCookie = "tj_fake_session"
+)
+
+type Campaign struct {
+	CampaignId int32
+	Name       string
+	Status     string
+	EndDate    string
+	Bids       []*Bid
+	// Listed in the members campaign list, a 0 budget is listed as unlimited
+	DailyBudget     float64
+	DailyBudgetLeft float64
+	Cost            float64
+	Impressions     int64
+	Clicks          int64
+	Conversions     int64
+}
+
+type Bid struct {
+	BidId    string
+	SpotId   string
+	Amount   float64
+	IsActive bool
+	IsPaused bool
+	// Where the bid is shown, which like TJ the bids api doesn't say. Empty
+	// means only djv_ads.DefaultCountryCode.
+	Countries []string
+}
+
+// BidSet records a call to the bid-set endpoint.
+type BidSet struct {
+	BidId  string
+	Amount float64
+}
+
+type Server struct {
+	server *httptest.Server
+
+	mu             sync.Mutex
+	campaigns      []*Campaign
+	competitorBids map[string][]float64
+	bidSets        []*BidSet
+	failures       map[string][]int
+	sessions       map[string]bool
+	nextSessionId  int
+	rejectLogins   bool
+	requestsByPath map[string]int
+}
+
+func NewServer() *Server {
+	server := &Server{
+		competitorBids: make(map[string][]float64),
+		failures:       make(map[string][]int),
+		sessions:       make(map[string]bool),
+		requestsByPath: make(map[string]int),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/campaigns.json", server.handleCampaigns)
+	mux.HandleFunc("/api/bids/", server.handleBids)
+	mux.HandleFunc("/sign-in", server.handleSignIn)
+	mux.HandleFunc("/login", server.handleLogin)
+	mux.HandleFunc("/dashboard", server.handleDashboard)
+	mux.HandleFunc("/campaign/viewbids/placementlist/", server.handlePlacementList)
+	mux.HandleFunc("/campaign/ajaxlistv5", server.handleCampaignList)
+
+	server.server = httptest.NewServer(server.withFailures(mux))
+	return server
+}
+
+func (server *Server) Close() {
+	server.server.Close()
+}
+
+func (server *Server) URL() string {
+	return server.server.URL
+}
+
+// Config returns a client config pointing every TJ host at this server.
+func (server *Server) Config() djv_ads.ClientConfig {
+	config := djv_ads.ClientConfig{
+		ApiKey:   ApiKey,
+		Username: Username,
+		Password: Password,
+		Retry: djv_ads.RetryPolicy{
+			MaxRetries: 3,
+			BaseDelay:  10 * time.Millisecond,
+			MaxDelay:   100 * time.Millisecond,
+		},
+	}
+
+	return config.WithBaseUrl(server.URL())
+}
+
+func (server *Server) AddCampaign(campaign *Campaign) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	server.campaigns = append(server.campaigns, campaign)
+}
+
+// SetCompetitorBids replaces the other advertisers' bids on a spot.
+func (server *Server) SetCompetitorBids(spotId, countryCode string, amounts ...float64) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	server.competitorBids[spotKey(spotId, countryCode)] = amounts
+}
+
+// FailNext makes the next requests to path fail with the given statuses, in
+// order, before the endpoint behaves normally again.
+func (server *Server) FailNext(path string, statusCodes ...int) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	server.failures[path] = append(server.failures[path], statusCodes...)
+}
+
+// ExpireSessions logs out every members session, as TJ does periodically.
+func (server *Server) ExpireSessions() {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	server.sessions = make(map[string]bool)
+}
+
+// RejectLogins makes logins fail until it's called with false, as if the
+// password had been changed.
+func (server *Server) RejectLogins(reject bool) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	server.rejectLogins = reject
+}
+
+// Logins counts successful logins.
+func (server *Server) Logins() int {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	return server.nextSessionId
+}
+
+func (server *Server) BidSets() []*BidSet {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	bidSets := make([]*BidSet, len(server.bidSets))
+	copy(bidSets, server.bidSets)
+	return bidSets
+}
+
+func (server *Server) BidAmount(bidId string) (float64, bool) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	bid := server.findBid(bidId)
+	if bid == nil {
+		return 0, false
+	}
+
+	return bid.Amount, true
+}
+
+// SetBidAmount changes a bid as if someone had edited it on TJ, without
+// recording a bid set.
+func (server *Server) SetBidAmount(bidId string, amount float64) bool {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	bid := server.findBid(bidId)
+	if bid == nil {
+		return false
+	}
+
+	bid.Amount = amount
+	return true
+}
+
+// Requests counts the requests served for a path, including failed ones.
+func (server *Server) Requests(path string) int {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	return server.requestsByPath[path]
+}
+
+func (server *Server) withFailures(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		server.mu.Lock()
+		server.requestsByPath[r.URL.Path]++
+		statusCode := 0
+		if queued := server.failures[r.URL.Path]; len(queued) > 0 {
+			statusCode = queued[0]
+			server.failures[r.URL.Path] = queued[1:]
+		}
+		server.mu.Unlock()
+
+		if statusCode != 0 {
+			http.Error(w, http.StatusText(statusCode), statusCode)
+			return
+		}
+
+		handler.ServeHTTP(w, r)
+	})
+}
+
+func (server *Server) handleCampaigns(w http.ResponseWriter, r *http.Request) {
+	if !checkApiKey(w, r) {
+		return
+	}
+
+	query := r.URL.Query()
+	offset, _ := strconv.Atoi(query.Get("offset"))
+	maxResults, err := strconv.Atoi(query.Get("maxResults"))
+	if err != nil {
+		maxResults = 50
+	}
+
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	campaignJsons := make([]*djv_ads.CampaignJson, 0)
+	for i := offset; i < len(server.campaigns) && i < offset+maxResults; i++ {
+		campaign := server.campaigns[i]
+		campaignJsons = append(campaignJsons, &djv_ads.CampaignJson{
+			CampaignId: campaign.CampaignId,
+			Name:       campaign.Name,
+			Status:     campaign.Status,
+			EndDate:    campaign.EndDate,
+		})
+	}
+
+	writeJson(w, campaignJsons)
+}
+
+// handleBids serves both /api/bids/{campaignId}.json and
+// /api/bids/{bidId}/set.json.
+func (server *Server) handleBids(w http.ResponseWriter, r *http.Request) {
+	if !checkApiKey(w, r) {
+		return
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, "/api/bids/")
+	if strings.HasSuffix(path, "/set.json") {
+		server.handleBidSet(w, r, strings.TrimSuffix(path, "/set.json"))
+		return
+	}
+
+	campaignId, err := strconv.Atoi(strings.TrimSuffix(path, ".json"))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	var campaign *Campaign
+	for _, c := range server.campaigns {
+		if int(c.CampaignId) == campaignId {
+			campaign = c
+		}
+	}
+
+	if campaign == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	resp := &djv_ads.BidsResponseJson{BidMap: make(map[int32]*djv_ads.BidJson)}
+	for i, bid := range campaign.Bids {
+		bidJson := &djv_ads.BidJson{
+			BidId:     bid.BidId,
+			BidAmount: strconv.FormatFloat(bid.Amount, 'f', 4, 64),
+			SpotId:    bid.SpotId,
+			IsActive:  bid.IsActive,
+		}
+
+		if bid.IsPaused {
+			bidJson.IsPaused = 1
+		}
+
+		resp.BidMap[int32(i)] = bidJson
+	}
+
+	writeJson(w, resp)
+}
+
+func (server *Server) handleBidSet(w http.ResponseWriter, r *http.Request, bidId string) {
+	if r.Method != "PUT" {
+		http.Error(w, "bid set requires PUT", http.StatusMethodNotAllowed)
+		return
+	}
+
+	amount, err := strconv.ParseFloat(r.URL.Query().Get("bid"), 64)
+	if err != nil {
+		http.Error(w, "malformed bid", http.StatusBadRequest)
+		return
+	}
+
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	bid := server.findBid(bidId)
+	if bid == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	bid.Amount = amount
+	server.bidSets = append(server.bidSets, &BidSet{BidId: bidId, Amount: amount})
+	writeJson(w, map[string]interface{}{"bid_id": bidId, "bid": amount})
+}
+
+func (server *Server) handleSignIn(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html")
+	fmt.Fprintf(w, `<html><body><form action="/login" method="post">`+
+		`<input type="hidden" name="_token" value="%v">`+
+		`<input name="username"><input name="password" type="password">`+
+		`</form></body></html>`, csrfToken)
+}
+
+func (server *Server) handleLogin(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Redirect(w, r, "/sign-in", http.StatusFound)
+		return
+	}
+
+	server.mu.Lock()
+	rejected := server.rejectLogins
+	server.mu.Unlock()
+
+	if rejected || r.PostFormValue("_token") != csrfToken ||
+		r.PostFormValue("username") != Username ||
+		r.PostFormValue("password") != Password {
+
+		http.Redirect(w, r, "/sign-in", http.StatusFound)
+		return
+	}
+
+	server.mu.Lock()
+	server.nextSessionId++
+	sessionId := fmt.Sprintf("session-%v", server.nextSessionId)
+	server.sessions[sessionId] = true
+	server.mu.Unlock()
+
+	http.SetCookie(w, &http.Cookie{Name: sessionCookie, Value: sessionId, Path: "/"})
+	http.Redirect(w, r, "/dashboard", http.StatusFound)
+}
+
+func (server *Server) handleDashboard(w http.ResponseWriter, r *http.Request) {
+	if !server.checkSession(w, r) {
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html")
+	fmt.Fprint(w, "<html><body>dashboard</body></html>")
+}
+
+func (server *Server) handlePlacementList(w http.ResponseWriter, r *http.Request) {
+	if !server.checkSession(w, r) {
+		return
+	}
+
+	query := r.URL.Query()
+	spotId := query.Get("spotId")
+	countryCode := query.Get("countryCode")
+
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	type entry struct {
+		amount float64
+		owner  string
+	}
+
+	entries := make([]entry, 0)
+	for i, amount := range server.competitorBids[spotKey(spotId, countryCode)] {
+		entries = append(entries, entry{amount, fmt.Sprintf("competitor-%v", i+1)})
+	}
+
+	for _, campaign := range server.campaigns {
+		for _, bid := range campaign.Bids {
+			if bid.SpotId == spotId && bid.IsActive && !bid.IsPaused &&
+				bidTargetsCountry(bid, countryCode) {
+
+				entries = append(entries, entry{bid.Amount, "bid-" + bid.BidId})
+			}
+		}
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].amount > entries[j].amount
+	})
+
+	rows := make([][]string, 0, len(entries))
+	for i, e := range entries {
+		rows = append(rows, []string{
+			strconv.Itoa(i + 1),
+			fmt.Sprintf("$%.4f", e.amount),
+			e.owner,
+		})
+	}
+
+	writeJson(w, map[string]interface{}{"aaData": rows})
+}
+
+func (server *Server) handleCampaignList(w http.ResponseWriter, r *http.Request) {
+	if !server.checkSession(w, r) {
+		return
+	}
+
+	query := r.URL.Query()
+	start, _ := strconv.Atoi(query.Get("iDisplayStart"))
+	length, err := strconv.Atoi(query.Get("iDisplayLength"))
+	if err != nil {
+		length = 25
+	}
+
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	rows := make([]map[string]interface{}, 0)
+	for i := start; i < len(server.campaigns) && i < start+length; i++ {
+		campaign := server.campaigns[i]
+		dailyBudget, dailyBudgetLeft := "Unlimited", "Unlimited"
+		if campaign.DailyBudget > 0 {
+			dailyBudget = fmt.Sprintf("%.2f", campaign.DailyBudget)
+			dailyBudgetLeft = fmt.Sprintf("$%.2f", campaign.DailyBudgetLeft)
+		}
+
+		rows = append(rows, map[string]interface{}{
+			"id":                        campaign.CampaignId,
+			"name":                      campaign.Name,
+			"status":                    campaign.Status,
+			"daily_budget":              dailyBudget,
+			"daily_budget_left_display": dailyBudgetLeft,
+			"cost":                      fmt.Sprintf("%.2f", campaign.Cost),
+			"impressions":               campaign.Impressions,
+			"clicks":                    campaign.Clicks,
+			"conversions":               campaign.Conversions,
+			"ecpm":                      fmt.Sprintf("$%.4f", ratio(campaign.Cost*1000, campaign.Impressions)),
+			"ecpc":                      fmt.Sprintf("$%.4f", ratio(campaign.Cost, campaign.Clicks)),
+		})
+	}
+
+	writeJson(w, map[string]interface{}{
+		"sEcho":                query.Get("sEcho"),
+		"iTotalRecords":        len(server.campaigns),
+		"iTotalDisplayRecords": len(server.campaigns),
+		"aaData":               rows,
+	})
+}
+
+func ratio(amount float64, count int64) float64 {
+	if count == 0 {
+		return 0
+	}
+
+	return amount / float64(count)
+}
+
+func (server *Server) checkSession(w http.ResponseWriter, r *http.Request) bool {
+	cookie, err := r.Cookie(sessionCookie)
+
+	server.mu.Lock()
+	valid := err == nil && server.sessions[cookie.Value]
+	server.mu.Unlock()
+
+	if !valid {
+		http.Redirect(w, r, "/sign-in", http.StatusFound)
+	}
+
+	return valid
+}
+
+// findBid must be called with the lock held.
+func (server *Server) findBid(bidId string) *Bid {
+	for _, campaign := range server.campaigns {
+		for _, bid := range campaign.Bids {
+			if bid.BidId == bidId {
+				return bid
+			}
+		}
+	}
+
+	return nil
+}
+
+func checkApiKey(w http.ResponseWriter, r *http.Request) bool {
+	if r.URL.Query().Get("api_key") != ApiKey {
+		http.Error(w, "invalid api key", http.StatusUnauthorized)
+		return false
+	}
+
+	return true
+}
+
+func bidTargetsCountry(bid *Bid, countryCode string) bool {
+	if len(bid.Countries) == 0 {
+		return countryCode == djv_ads.DefaultCountryCode
+	}
+
+	for _, bidCountryCode := range bid.Countries {
+		if strings.EqualFold(bidCountryCode, countryCode) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func spotKey(spotId, countryCode string) string {
+	return spotId + "/" + strings.ToUpper(countryCode)
+}
+
+func writeJson(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
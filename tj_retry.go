@@ -0,0 +1,228 @@
+package djv_ads
+
+import (
+	"context"
+	"math/rand"
+	"net/http"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"golang.org/x/time/rate"
+)
+
+type RetryPolicy struct {
+	// Retries after the first attempt, 0 disables retrying
+	MaxRetries int
+	BaseDelay  time.Duration
+	// Caps the backoff, and a Retry-After longer than this gives up
+	MaxDelay time.Duration
+}
+
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxRetries: 3,
+		BaseDelay:  500 * time.Millisecond,
+		MaxDelay:   30 * time.Second,
+	}
+}
+
+// RequestObserver is told about every TJ request attempt, for metrics.
+// StatusCode is 0 when the request failed before getting a response.
+type RequestObserver interface {
+	ObserveRequest(endpoint string, statusCode int, latency time.Duration)
+	ObserveRateLimitWait(wait time.Duration)
+}
+
+type nopObserver struct{}
+
+func (nopObserver) ObserveRequest(string, int, time.Duration) {}
+func (nopObserver) ObserveRateLimitWait(time.Duration)        {}
+
+const (
+	defaultRequestInterval = 300 * time.Millisecond
+	// How far 429s can slow the shared rate limiter down
+	minRequestRate = rate.Limit(0.1)
+)
+
+// retrier runs idempotent TJ requests through the shared rate limiter,
+// retrying transient failures. A 429 halves the limiter's rate, which then
+// creeps back up as requests succeed.
+type retrier struct {
+	policy      RetryPolicy
+	rateLimiter *rate.Limiter
+	baseLimit   rate.Limit
+	observer    RequestObserver
+
+	mu sync.Mutex
+}
+
+func newRetrier(policy RetryPolicy, observer RequestObserver) *retrier {
+	if observer == nil {
+		observer = nopObserver{}
+	}
+
+	baseLimit := rate.Every(defaultRequestInterval)
+	return &retrier{
+		policy:      policy,
+		rateLimiter: rate.NewLimiter(baseLimit, 1),
+		baseLimit:   baseLimit,
+		observer:    observer,
+	}
+}
+
+// do sends the request built by newRequest until it succeeds, fails with a
+// non-retryable error or runs out of retries. Non-2xx responses come back as
+// an HTTPError with the body closed.
+func (retrier *retrier) do(
+	ctx context.Context,
+	httpClient *http.Client,
+	newRequest func() (*http.Request, error)) (*http.Response, error) {
+
+	for attempt := 0; ; attempt++ {
+		waitStart := time.Now()
+		if err := retrier.rateLimiter.Wait(ctx); err != nil {
+			return nil, err
+		}
+		retrier.observer.ObserveRateLimitWait(time.Since(waitStart))
+
+		req, err := newRequest()
+		if err != nil {
+			return nil, err
+		}
+
+		requestStart := time.Now()
+		resp, err := httpClient.Do(req)
+
+		statusCode := 0
+		if err == nil {
+			statusCode = resp.StatusCode
+		}
+		retrier.observer.ObserveRequest(
+			endpointName(req.URL.Path), statusCode, time.Since(requestStart))
+
+		var retryAfter time.Duration
+		if err == nil {
+			if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+				retrier.speedUp()
+				return resp, nil
+			}
+
+			resp.Body.Close()
+			retryAfter = parseRetryAfter(resp.Header.Get("Retry-After"))
+			err = HTTPError{
+				Url:        req.URL.String(),
+				StatusCode: resp.StatusCode,
+				Status:     resp.Status}
+
+			if resp.StatusCode == http.StatusTooManyRequests {
+				retrier.slowDown()
+			}
+
+			if !isRetryableStatus(resp.StatusCode) {
+				return nil, err
+			}
+		}
+
+		// Cancellation shows up as a transport error, don't retry it
+		if attempt >= retrier.policy.MaxRetries || ctx.Err() != nil {
+			return nil, err
+		}
+
+		delay := retrier.backoff(attempt)
+		if retryAfter > retrier.policy.MaxDelay {
+			glog.Warningf("Giving up on %v, Retry-After %v exceeds max delay",
+				req.URL.Path, retryAfter)
+			return nil, err
+		} else if retryAfter > delay {
+			delay = retryAfter
+		}
+
+		glog.Warningf("Retrying %v %v in %v (attempt %v): %v",
+			req.Method, req.URL.Path, delay, attempt+1, err)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// backoff is exponential in the attempt with half of it jittered.
+func (retrier *retrier) backoff(attempt int) time.Duration {
+	delay := retrier.policy.BaseDelay << uint(attempt)
+	if delay > retrier.policy.MaxDelay || delay <= 0 {
+		delay = retrier.policy.MaxDelay
+	}
+
+	half := delay / 2
+	if half <= 0 {
+		return delay
+	}
+
+	return half + time.Duration(rand.Int63n(int64(half)))
+}
+
+func (retrier *retrier) slowDown() {
+	retrier.mu.Lock()
+	defer retrier.mu.Unlock()
+
+	limit := retrier.rateLimiter.Limit() / 2
+	if limit < minRequestRate {
+		limit = minRequestRate
+	}
+
+	glog.Warningf("TJ rate limited us, slowing to %.2f requests/sec", float64(limit))
+	retrier.rateLimiter.SetLimit(limit)
+}
+
+func (retrier *retrier) speedUp() {
+	retrier.mu.Lock()
+	defer retrier.mu.Unlock()
+
+	limit := retrier.rateLimiter.Limit()
+	if limit >= retrier.baseLimit {
+		return
+	}
+
+	limit *= 1.1
+	if limit > retrier.baseLimit {
+		limit = retrier.baseLimit
+	}
+
+	retrier.rateLimiter.SetLimit(limit)
+}
+
+var idSegment = regexp.MustCompile(`/\d+`)
+
+// endpointName replaces ids in a request path so requests to the same
+// endpoint group together, e.g. /api/bids/:id/set.json.
+func endpointName(path string) string {
+	return idSegment.ReplaceAllString(path, "/:id")
+}
+
+func isRetryableStatus(statusCode int) bool {
+	return statusCode == http.StatusTooManyRequests || statusCode >= 500
+}
+
+// parseRetryAfter handles both the delay-seconds and http-date forms,
+// returning 0 when the header is missing or malformed.
+func parseRetryAfter(retryAfter string) time.Duration {
+	if retryAfter == "" {
+		return 0
+	}
+
+	if seconds, err := strconv.Atoi(retryAfter); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+
+	if date, err := http.ParseTime(retryAfter); err == nil {
+		if delay := time.Until(date); delay > 0 {
+			return delay
+		}
+	}
+
+	return 0
+}
@@ -1,31 +1,64 @@
 package djv_ads
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"net/http"
 	"net/http/cookiejar"
 	"net/url"
-	"os"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/PuerkitoBio/goquery"
+	"github.com/golang/glog"
 	"golang.org/x/net/publicsuffix"
 )
 
 type Session struct {
-	client *http.Client
+	client         *http.Client
+	membersBaseUrl string
+	retrier        *retrier
 }
 
-func NewSpoofedSession() (*Session, error) {
-	username := os.Getenv("TJ_USERNAME")
-	password := os.Getenv("TJ_PASSWORD")
+// ErrSessionExpired means TJ bounced a members request back to sign-in, or
+// served a page where we expected json.
+var ErrSessionExpired = errors.New("TJ session expired")
+
+type LoginError struct {
+	Reason string
+	Err    error
+}
+
+func (err *LoginError) Error() string {
+	if err.Err != nil {
+		return fmt.Sprintf("TJ login failed: %v: %v", err.Reason, err.Err)
+	}
+
+	return fmt.Sprintf("TJ login failed: %v", err.Reason)
+}
+
+func (err *LoginError) Unwrap() error {
+	return err.Err
+}
+
+func NewSpoofedSession(ctx context.Context) (*Session, error) {
+	config := DefaultClientConfig()
+	return newSession(ctx, config, newRetrier(config.Retry, config.Observer))
+}
+
+func newSession(
+	ctx context.Context,
+	config ClientConfig,
+	retrier *retrier) (*Session, error) {
+
+	username := config.Username
+	password := config.Password
 
 	if username == "" || password == "" {
-		return nil, errors.New("Missing username or password")
+		return nil, &LoginError{Reason: "missing username or password"}
 	}
 
 	jar, err := cookiejar.New(&cookiejar.Options{PublicSuffixList: publicsuffix.List})
@@ -34,18 +67,25 @@ func NewSpoofedSession() (*Session, error) {
 	}
 
 	client := &http.Client{
-		Jar: jar,
+		Jar:     jar,
+		Timeout: config.RequestTimeout,
 	}
 
-	loginResp, err := client.Get("https://www.trafficjunky.com/sign-in")
+	signInReq, err := http.NewRequestWithContext(
+		ctx, "GET", config.SiteBaseUrl+"/sign-in", nil)
 	if err != nil {
 		return nil, err
 	}
+
+	loginResp, err := client.Do(signInReq)
+	if err != nil {
+		return nil, &LoginError{Reason: "could not load sign-in page", Err: err}
+	}
 	defer loginResp.Body.Close()
 
 	doc, err := goquery.NewDocumentFromReader(loginResp.Body)
 	if err != nil {
-		return nil, err
+		return nil, &LoginError{Reason: "could not parse sign-in page", Err: err}
 	}
 
 	token := ""
@@ -57,7 +97,7 @@ func NewSpoofedSession() (*Session, error) {
 	})
 
 	if token == "" {
-		return nil, errors.New("Could not scrape csrf token")
+		return nil, &LoginError{Reason: "could not scrape csrf token"}
 	}
 
 	loginForm := url.Values{}
@@ -65,117 +105,347 @@ func NewSpoofedSession() (*Session, error) {
 	loginForm.Set("username", username)
 	loginForm.Set("password", password)
 
-	loginPostResp, err := client.PostForm("https://www.trafficjunky.com/login", loginForm)
+	loginReq, err := http.NewRequestWithContext(
+		ctx, "POST", config.SiteBaseUrl+"/login", strings.NewReader(loginForm.Encode()))
 	if err != nil {
 		return nil, err
 	}
+	loginReq.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	loginPostResp, err := client.Do(loginReq)
+	if err != nil {
+		return nil, &LoginError{Reason: "login request failed", Err: err}
+	}
 	defer loginPostResp.Body.Close()
 
-	return &Session{client}, nil
+	if loginPostResp.StatusCode < 200 || loginPostResp.StatusCode >= 300 {
+		return nil, &LoginError{Reason: fmt.Sprintf("login returned %v", loginPostResp.Status)}
+	}
+
+	loginPostDoc, err := goquery.NewDocumentFromReader(loginPostResp.Body)
+	if err != nil {
+		return nil, &LoginError{Reason: "could not parse login response", Err: err}
+	}
+
+	// A failed login shows the sign-in form again, wherever it's served from
+	if hasSignInForm(loginPostDoc) {
+		return nil, &LoginError{Reason: "credentials rejected"}
+	}
+
+	return &Session{client, config.MembersBaseUrl, retrier}, nil
+}
+
+// Placement is one row of the ranked bid list for a spot, position 1 being
+// the highest bid.
+type Placement struct {
+	Position    int
+	Bid         float64
+	Identifiers []string
 }
 
-func (session *Session) CurrentMaxTrafficBid(bidId, spotId string) (float64, error) {
-	url := fmt.Sprintf("https://members.trafficjunky.com/campaign/viewbids/placementlist/?"+
-		"placementId=%v&spotId=%v&countryCode=US&convertToReal=true", bidId, spotId)
+func (session *Session) CurrentMaxTrafficBid(
+	ctx context.Context, bidId, spotId, countryCode string) (float64, error) {
 
-	resp, err := session.client.Get(url)
+	placements, err := session.PlacementList(ctx, bidId, spotId, countryCode)
 	if err != nil {
+		return 0, err
+	}
+
+	if len(placements) == 0 {
+		// not an error, just no data
 		return 0, nil
 	}
+
+	return placements[0].Bid, nil
+}
+
+func (session *Session) PlacementList(
+	ctx context.Context, bidId, spotId, countryCode string) ([]*Placement, error) {
+
+	url := fmt.Sprintf("%v/campaign/viewbids/placementlist/?"+
+		"placementId=%v&spotId=%v&countryCode=%v&convertToReal=true",
+		session.membersBaseUrl, bidId, spotId, countryCode)
+
+	resp, err := session.get(ctx, url)
+	if err != nil {
+		return nil, err
+	}
 	defer resp.Body.Close()
 
 	var jsonResp map[string]interface{}
 	if err = json.NewDecoder(resp.Body).Decode(&jsonResp); err != nil {
-		return 0, err
+		return nil, err
 	}
 
 	aaDataIface, ok := jsonResp["aaData"]
 	aaData, ok := aaDataIface.([]interface{})
 	if !ok {
-		return 0, errors.New("aaData field has wrong type")
+		return nil, errors.New("aaData field has wrong type")
 	}
 
-	if len(aaData) == 0 {
-		// not an error, just no data
-		return 0, nil
-	}
+	placements := make([]*Placement, 0, len(aaData))
+	for i, rowIface := range aaData {
+		row, ok := rowIface.([]interface{})
+		if !ok || len(row) < 2 {
+			return nil, errors.New(fmt.Sprintf("aaData[%v] row has wrong type", i))
+		}
 
-	row, ok := aaData[0].([]interface{})
-	if !ok {
-		return 0, errors.New("aaData row has wrong type")
-	}
+		bidStr, ok := row[1].(string)
+		if !ok {
+			return nil, errors.New(fmt.Sprintf("aaData[%v] row fields have wrong type", i))
+		}
 
-	bidStr, ok := row[1].(string)
-	if !ok {
-		return 0, errors.New("aaData row fields have wrong type")
-	}
+		bidAmount, err := parseDollarAmount(bidStr)
+		if err != nil {
+			return nil, err
+		}
 
-	bidStrParts := strings.Split(bidStr, "$")
-	if len(bidStrParts) != 2 {
-		return 0, errors.New(fmt.Sprintf("bidstr in incorrect format: %s", bidStr))
+		// Everything besides the bid column identifies the placement
+		identifiers := make([]string, 0, len(row)-1)
+		for j, field := range row {
+			if j != 1 {
+				identifiers = append(identifiers, fmt.Sprintf("%v", field))
+			}
+		}
+
+		placements = append(placements, &Placement{
+			Position:    i + 1,
+			Bid:         bidAmount,
+			Identifiers: identifiers,
+		})
 	}
 
-	bidAmount, err := strconv.ParseFloat(bidStrParts[1], 64)
-	if err != nil {
-		return 0, err
+	return placements, nil
+}
+
+func parseDollarAmount(amountStr string) (float64, error) {
+	amountStrParts := strings.Split(amountStr, "$")
+	if len(amountStrParts) != 2 {
+		return 0, errors.New(fmt.Sprintf("bidstr in incorrect format: %s", amountStr))
 	}
 
-	return bidAmount, nil
+	return strconv.ParseFloat(strings.Replace(amountStrParts[1], ",", "", -1), 64)
 }
 
-func (session *Session) GetActiveCampaignIds() ([]string, error) {
+const (
+	activeCampaignsPageSize = 100
+	maxActiveCampaignPages  = 50
+)
+
+const campaignListUrlFormat = "%v/campaign/ajaxlistv5?sEcho=1&iColumns=18&sColumns=id,campaignStatusString,id,campaignPermissionList,name,cookieTargeting,adCount,placementCount,daily_budget,daily_budget_left_display,impressions,clicks,ctr,conversions,cost,ecpm,ecpc,jsonLabels&iDisplayStart=%v&iDisplayLength=%v&mDataProp_0=id&sSearch_0=&bRegex_0=false&bSearchable_0=true&bSortable_0=false&mDataProp_1=campaignStatusString&sSearch_1=&bRegex_1=false&bSearchable_1=true&bSortable_1=false&mDataProp_2=id&sSearch_2=&bRegex_2=false&bSearchable_2=true&bSortable_2=true&mDataProp_3=campaignPermissionList&sSearch_3=&bRegex_3=false&bSearchable_3=true&bSortable_3=false&mDataProp_4=name&sSearch_4=&bRegex_4=false&bSearchable_4=true&bSortable_4=true&mDataProp_5=cookieTargeting&sSearch_5=&bRegex_5=false&bSearchable_5=true&bSortable_5=false&mDataProp_6=adCount&sSearch_6=&bRegex_6=false&bSearchable_6=true&bSortable_6=false&mDataProp_7=placementCount&sSearch_7=&bRegex_7=false&bSearchable_7=true&bSortable_7=false&mDataProp_8=daily_budget&sSearch_8=&bRegex_8=false&bSearchable_8=true&bSortable_8=true&mDataProp_9=daily_budget_left_display&sSearch_9=&bRegex_9=false&bSearchable_9=true&bSortable_9=true&mDataProp_10=impressions&sSearch_10=&bRegex_10=false&bSearchable_10=true&bSortable_10=true&mDataProp_11=clicks&sSearch_11=&bRegex_11=false&bSearchable_11=true&bSortable_11=true&mDataProp_12=ctr&sSearch_12=&bRegex_12=false&bSearchable_12=true&bSortable_12=true&mDataProp_13=conversions&sSearch_13=&bRegex_13=false&bSearchable_13=true&bSortable_13=true&mDataProp_14=cost&sSearch_14=&bRegex_14=false&bSearchable_14=true&bSortable_14=true&mDataProp_15=ecpm&sSearch_15=&bRegex_15=false&bSearchable_15=true&bSortable_15=true&mDataProp_16=ecpc&sSearch_16=&bRegex_16=false&bSearchable_16=true&bSortable_16=true&mDataProp_17=jsonLabels&sSearch_17=&bRegex_17=false&bSearchable_17=true&bSortable_17=false&sSearch=&bRegex=false&iSortCol_0=2&sSortDir_0=desc&iSortingCols=1&formURL=startDate=%v&endDate=%v&isDashboard=true&formJSON={\"startDate\":\"%v\",\"endDate\":\"%v\",\"isDashboard\":\"true\"}"
+
+func (session *Session) GetActiveCampaignIds(ctx context.Context) ([]string, error) {
 	dateFmt := "2006-01-02"
 	startDate := time.Now().Add(-28 * 24 * time.Hour).In(Pacific).Format(dateFmt)
 	endDate := time.Now().In(Pacific).Format(dateFmt)
 
-	url := fmt.Sprintf("https://members.trafficjunky.com/campaign/ajaxlistv5?sEcho=1&iColumns=18&sColumns=id,campaignStatusString,id,campaignPermissionList,name,cookieTargeting,adCount,placementCount,daily_budget,daily_budget_left_display,impressions,clicks,ctr,conversions,cost,ecpm,ecpc,jsonLabels&iDisplayStart=0&iDisplayLength=25&mDataProp_0=id&sSearch_0=&bRegex_0=false&bSearchable_0=true&bSortable_0=false&mDataProp_1=campaignStatusString&sSearch_1=&bRegex_1=false&bSearchable_1=true&bSortable_1=false&mDataProp_2=id&sSearch_2=&bRegex_2=false&bSearchable_2=true&bSortable_2=true&mDataProp_3=campaignPermissionList&sSearch_3=&bRegex_3=false&bSearchable_3=true&bSortable_3=false&mDataProp_4=name&sSearch_4=&bRegex_4=false&bSearchable_4=true&bSortable_4=true&mDataProp_5=cookieTargeting&sSearch_5=&bRegex_5=false&bSearchable_5=true&bSortable_5=false&mDataProp_6=adCount&sSearch_6=&bRegex_6=false&bSearchable_6=true&bSortable_6=false&mDataProp_7=placementCount&sSearch_7=&bRegex_7=false&bSearchable_7=true&bSortable_7=false&mDataProp_8=daily_budget&sSearch_8=&bRegex_8=false&bSearchable_8=true&bSortable_8=true&mDataProp_9=daily_budget_left_display&sSearch_9=&bRegex_9=false&bSearchable_9=true&bSortable_9=true&mDataProp_10=impressions&sSearch_10=&bRegex_10=false&bSearchable_10=true&bSortable_10=true&mDataProp_11=clicks&sSearch_11=&bRegex_11=false&bSearchable_11=true&bSortable_11=true&mDataProp_12=ctr&sSearch_12=&bRegex_12=false&bSearchable_12=true&bSortable_12=true&mDataProp_13=conversions&sSearch_13=&bRegex_13=false&bSearchable_13=true&bSortable_13=true&mDataProp_14=cost&sSearch_14=&bRegex_14=false&bSearchable_14=true&bSortable_14=true&mDataProp_15=ecpm&sSearch_15=&bRegex_15=false&bSearchable_15=true&bSortable_15=true&mDataProp_16=ecpc&sSearch_16=&bRegex_16=false&bSearchable_16=true&bSortable_16=true&mDataProp_17=jsonLabels&sSearch_17=&bRegex_17=false&bSearchable_17=true&bSortable_17=false&sSearch=&bRegex=false&iSortCol_0=2&sSortDir_0=desc&iSortingCols=1&formURL=startDate=%v&endDate=%v&isDashboard=true&formJSON={\"startDate\":\"%v\",\"endDate\":\"%v\",\"isDashboard\":\"true\"}", startDate, endDate, startDate, endDate)
+	campaignIds := make([]string, 0)
+	seen := make(map[string]bool)
+	err := session.eachCampaignRow(ctx, startDate, endDate,
+		func(i int, rowMap map[string]interface{}) error {
+			campaignId, err := rowCampaignId(i, rowMap)
+			if err != nil {
+				return err
+			}
+
+			statusIface, _ := rowMap["status"]
+			status, ok := statusIface.(string)
+			if !ok {
+				return errors.New(fmt.Sprintf("status[%v] is wrong type", i))
+			}
+
+			if status == "active" && !seen[campaignId] {
+				seen[campaignId] = true
+				campaignIds = append(campaignIds, campaignId)
+			}
+			return nil
+		})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return campaignIds, nil
+}
+
+// GetCampaignStats lists every campaign's stats between the two dates, both
+// included, by campaign id.
+func (session *Session) GetCampaignStats(
+	ctx context.Context, since, until time.Time) (map[string]*CampaignStats, error) {
+
+	dateFmt := "2006-01-02"
+	startDate := since.In(Pacific).Format(dateFmt)
+	endDate := until.In(Pacific).Format(dateFmt)
+
+	stats := make(map[string]*CampaignStats)
+	err := session.eachCampaignRow(ctx, startDate, endDate,
+		func(i int, rowMap map[string]interface{}) error {
+			campaignId, err := rowCampaignId(i, rowMap)
+			if err != nil {
+				return err
+			}
+
+			stats[campaignId] = &CampaignStats{
+				DailyBudget:     rowAmount(rowMap["daily_budget"]),
+				DailyBudgetLeft: rowAmount(rowMap["daily_budget_left_display"]),
+				Stats: Stats{
+					Cost:        rowAmount(rowMap["cost"]),
+					Impressions: int64(rowAmount(rowMap["impressions"])),
+					Clicks:      int64(rowAmount(rowMap["clicks"])),
+					Conversions: int64(rowAmount(rowMap["conversions"])),
+					Ecpm:        rowAmount(rowMap["ecpm"]),
+					Ecpc:        rowAmount(rowMap["ecpc"]),
+				},
+			}
+			return nil
+		})
 
-	resp, err := session.client.Get(url)
 	if err != nil {
 		return nil, err
 	}
+
+	return stats, nil
+}
+
+// eachCampaignRow pages through the dashboard campaign list, calling visit
+// with each row and its index.
+func (session *Session) eachCampaignRow(
+	ctx context.Context,
+	startDate, endDate string,
+	visit func(i int, rowMap map[string]interface{}) error) error {
+
+	start := 0
+	for page := 0; page < maxActiveCampaignPages; page++ {
+		rows, totalRows, err := session.getCampaignListPage(ctx,
+			start, activeCampaignsPageSize, startDate, endDate)
+		if err != nil {
+			return err
+		}
+
+		for i, rowMap := range rows {
+			if err := visit(start+i, rowMap); err != nil {
+				return err
+			}
+		}
+
+		start += len(rows)
+		if len(rows) == 0 || start >= totalRows {
+			return nil
+		}
+	}
+
+	glog.Warningf("Campaign list truncated after %v rows (%v pages)",
+		start, maxActiveCampaignPages)
+	return nil
+}
+
+func rowCampaignId(i int, rowMap map[string]interface{}) (string, error) {
+	campaignIdIface, _ := rowMap["id"]
+	campaignIdFloat, ok := campaignIdIface.(float64)
+	if !ok {
+		return "", errors.New(fmt.Sprintf("campaignId[%v] is wrong type: %v", i, campaignIdIface))
+	}
+
+	return strconv.Itoa(int(campaignIdFloat)), nil
+}
+
+// rowAmount reads a number from the campaign list, which may come formatted
+// for display like "$1,234.50". Anything else, like "Unlimited", is 0.
+func rowAmount(value interface{}) float64 {
+	switch value := value.(type) {
+	case float64:
+		return value
+	case string:
+		cleaned := strings.NewReplacer("$", "", ",", "", " ", "").Replace(value)
+		amount, err := strconv.ParseFloat(cleaned, 64)
+		if err != nil {
+			return 0
+		}
+		return amount
+	}
+
+	return 0
+}
+
+// getCampaignListPage fetches one page of the dashboard campaign list along
+// with the total number of rows across all pages.
+func (session *Session) getCampaignListPage(
+	ctx context.Context,
+	start, length int,
+	startDate, endDate string) ([]map[string]interface{}, int, error) {
+
+	url := fmt.Sprintf(campaignListUrlFormat, session.membersBaseUrl,
+		start, length, startDate, endDate, startDate, endDate)
+
+	resp, err := session.get(ctx, url)
+	if err != nil {
+		return nil, 0, err
+	}
 	defer resp.Body.Close()
 
 	var jsonResp map[string]interface{}
 	if err = json.NewDecoder(resp.Body).Decode(&jsonResp); err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 
 	aaDataIface, ok := jsonResp["aaData"]
 	aaData, ok := aaDataIface.([]interface{})
 	if !ok {
-		return nil, errors.New("aaData field has wrong type")
-	}
-
-	if len(aaData) == 0 {
-		// not an error, just no data
-		return nil, nil
+		return nil, 0, errors.New("aaData field has wrong type")
 	}
 
-	campaignIds := make([]string, 0)
+	rows := make([]map[string]interface{}, 0, len(aaData))
 	for i, rowIface := range aaData {
 		rowMap, ok := rowIface.(map[string]interface{})
 		if !ok {
-			return nil, errors.New(fmt.Sprintf("aaData[%v] row has wrong type", i))
+			return nil, 0, errors.New(fmt.Sprintf("aaData[%v] row has wrong type", start+i))
 		}
 
-		campaignIdIface, _ := rowMap["id"]
-		statusIface, _ := rowMap["status"]
+		rows = append(rows, rowMap)
+	}
 
-		campaignId, ok := campaignIdIface.(float64)
-		if !ok {
-			return nil, errors.New(fmt.Sprintf("campaignId[%v] is wrong type: %v", i, campaignIdIface))
+	// Without a total we can't tell if there are more pages, treat this one
+	// as the last.
+	totalRows := start + len(rows)
+	switch total := jsonResp["iTotalDisplayRecords"].(type) {
+	case float64:
+		totalRows = int(total)
+	case string:
+		if parsed, err := strconv.Atoi(total); err == nil {
+			totalRows = parsed
 		}
+	}
 
-		status, ok := statusIface.(string)
-		if !ok {
-			return nil, errors.New(fmt.Sprintf("status[%v] is wrong type", i))
-		}
+	return rows, totalRows, nil
+}
 
-		if status == "active" {
-			campaignIds = append(campaignIds, strconv.Itoa(int(campaignId)))
-		}
+// get fetches a members json endpoint through the shared retrier.
+func (session *Session) get(ctx context.Context, url string) (*http.Response, error) {
+	resp, err := session.retrier.do(ctx, session.client, func() (*http.Request, error) {
+		return http.NewRequestWithContext(ctx, "GET", url, nil)
+	})
+	if err != nil {
+		return nil, err
 	}
 
-	return campaignIds, nil
+	contentType := resp.Header.Get("Content-Type")
+	if isSignInPage(resp) || strings.HasPrefix(contentType, "text/html") {
+		resp.Body.Close()
+		return nil, ErrSessionExpired
+	}
+
+	return resp, nil
+}
+
+// hasSignInForm looks for the sign-in form's password input or the form
+// itself. Not the csrf token, other forms like logout have one too.
+func hasSignInForm(doc *goquery.Document) bool {
+	return doc.Find(`input[type=password], input[name=password], form[action$="/login"]`).
+		Length() > 0
+}
+
+// isSignInPage checks where redirects left us.
+func isSignInPage(resp *http.Response) bool {
+	path := resp.Request.URL.Path
+	return strings.HasPrefix(path, "/sign-in") || strings.HasPrefix(path, "/login")
 }